@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+---------------------------------------------------------------
+Ban Policy
+---------------------------------------------------------------
+*/
+
+// 返却期限を猶予より長く過ぎた貸出のある会員を定期的に探してBAN (または停止) する
+// BAN・停止・警告は member_sanction に理由とともに記録する
+// 警告する設定なら、期限の通知と同じ送り先に警告を送り (reminder に ban_warning として記録)、
+// 警告から warn_lead 以上経つまではBAN・停止しない
+
+// 延滞した会員への処分
+const (
+	banActionBan     = "ban"
+	banActionSuspend = "suspend"
+)
+
+var banActions = []string{banActionBan, banActionSuspend}
+
+// member_sanction.source
+const (
+	sanctionSourceManual = "manual"
+	sanctionSourcePolicy = "policy"
+)
+
+// member_sanction.reason の長さの上限 (文字数)
+const maxSanctionReasonLength = 1024
+
+var banPolicyActionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "ban_policy_actions_total",
+	Help:      "Number of members banned, suspended or warned by the ban policy.",
+}, []string{"action"})
+
+/* --- Sanctions --- */
+
+type MemberSanction struct {
+	ID       string `json:"id" db:"id"`
+	MemberID string `json:"member_id" db:"member_id"`
+	// ban, suspend
+	Action string `json:"action" db:"action"`
+	Source string `json:"source" db:"source"`
+	Reason string `json:"reason" db:"reason"`
+	// きっかけになった貸出 (手動のBANでは空)
+	LendingID string `json:"lending_id,omitempty" db:"lending_id"`
+	// 停止の終わり
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+func newMemberSanction(memberID, action, source, reason, lendingID string, expiresAt *time.Time) MemberSanction {
+	return MemberSanction{
+		ID:        generateID(),
+		MemberID:  memberID,
+		Action:    action,
+		Source:    source,
+		Reason:    reason,
+		LendingID: lendingID,
+		ExpiresAt: expiresAt,
+		CreatedAt: currentTime(),
+	}
+}
+
+// きっかけになった貸出が処分の前に返却された
+var errSanctionLendingReturned = errors.New("the overdue lending has been returned")
+
+// 処分を記録する
+// きっかけの貸出があるなら、同じトランザクションでまだ返却されていないことを確かめる
+// 返却 (returnLendingsHandler) と同じく貸出の行をロックし、確かめた後に返却されないようにする
+func insertMemberSanction(ctx context.Context, tx *sqlx.Tx, s MemberSanction) error {
+	if s.LendingID != "" {
+		err := tx.GetContext(ctx, &Lending{}, forUpdate("SELECT * FROM `lending` WHERE `id` = ?"), s.LendingID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errSanctionLendingReturned
+			}
+			return err
+		}
+	}
+
+	_, err := tx.NamedExecContext(ctx,
+		"INSERT INTO `member_sanction` (`id`, `member_id`, `action`, `source`, `reason`, `lending_id`, `expires_at`, `created_at`) "+
+			"VALUES (:id, :member_id, :action, :source, :reason, :lending_id, :expires_at, :created_at)", s)
+	return err
+}
+
+// 会員の停止中の処分 (なければnil)
+func activeSuspension(ctx context.Context, tx *sqlx.Tx, memberID string, now time.Time) (*MemberSanction, error) {
+	var s MemberSanction
+	err := tx.GetContext(ctx, &s,
+		"SELECT * FROM `member_sanction` WHERE `member_id` = ? AND `action` = ? AND `expires_at` > ? ORDER BY `expires_at` DESC LIMIT 1",
+		memberID, banActionSuspend, now)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// 会員を停止する
+// 会員がいない (BAN済みを含む) か、もう停止中なら何もせず false を返す
+func suspendMember(ctx context.Context, sanction MemberSanction) (bool, error) {
+	event := newEvent(eventMemberSuspended, MemberSuspendedEvent{
+		MemberID:  sanction.MemberID,
+		Reason:    sanction.Reason,
+		ExpiresAt: *sanction.ExpiresAt,
+	})
+	var suspended bool
+	err := runInTx(ctx, nil, func(tx *sqlx.Tx) error {
+		suspended = false
+		err := tx.GetContext(ctx, &Member{}, forUpdate("SELECT * FROM `member` WHERE `id` = ? AND `banned` = false"), sanction.MemberID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		active, err := activeSuspension(ctx, tx, sanction.MemberID, sanction.CreatedAt)
+		if err != nil || active != nil {
+			return err
+		}
+
+		if err := insertMemberSanction(ctx, tx, sanction); err != nil {
+			return err
+		}
+		if err := enqueueEvents(ctx, tx, event); err != nil {
+			return err
+		}
+		suspended = true
+		return nil
+	})
+	if err != nil || !suspended {
+		return false, err
+	}
+	router.markWrite(sanction.MemberID)
+	publishEvents(event)
+	return true, nil
+}
+
+/* --- Policy Job --- */
+
+type banPolicyJob struct {
+	action     string
+	grace      time.Duration
+	suspendFor time.Duration
+	warn       bool
+	warnLead   time.Duration
+	batchSize  int
+
+	// 確認を同時に走らせない
+	mu sync.Mutex
+}
+
+var banPolicy *banPolicyJob
+
+func newBanPolicyJob(c BanPolicyConfig) *banPolicyJob {
+	return &banPolicyJob{
+		action:     c.Action,
+		grace:      c.GracePeriod,
+		suspendFor: c.SuspendFor,
+		warn:       c.Warn,
+		warnLead:   c.WarnLead,
+		batchSize:  c.BatchSize,
+	}
+}
+
+// 定期的に延滞している会員をBAN・停止する
+func (p *banPolicyJob) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// 初期化中はテーブルが作り直されている
+			if initializeRunning() {
+				continue
+			}
+			if _, err := p.Run(ctx, false); err != nil {
+				appLogger.Error("ban policy run failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// 対象の会員への処分 (BanPolicyCandidate.Action)
+// ban・suspend のほか、警告を送る warn と、警告済みで待っている wait がある
+const (
+	banCandidateWarn = "warn"
+	banCandidateWait = "wait"
+)
+
+type BanPolicyCandidate struct {
+	MemberID   string `json:"member_id"`
+	MemberName string `json:"member_name"`
+	Action     string `json:"action"`
+	// ban・suspend の理由
+	Reason string `json:"reason,omitempty"`
+	// warn・wait のとき、BAN・停止する予定の時刻
+	BanAt *time.Time `json:"ban_at,omitempty"`
+	// 対象になった貸出 (期限の古い順)
+	Lendings []OverdueLending `json:"lendings"`
+	// 処分・警告に失敗したときのエラー (次の実行でやり直す)
+	Error string `json:"error,omitempty"`
+
+	// BAN・停止のきっかけの貸出
+	lendingID string
+	// 警告を送る貸出
+	warnings []Reminder
+}
+
+type OverdueLending struct {
+	LendingID string     `json:"lending_id"`
+	BookID    string     `json:"book_id"`
+	BookTitle string     `json:"book_title"`
+	Due       time.Time  `json:"due"`
+	WarnedAt  *time.Time `json:"warned_at,omitempty"`
+}
+
+type BanPolicyRunResult struct {
+	DryRun      bool                 `json:"dry_run"`
+	Action      string               `json:"action"`
+	GracePeriod string               `json:"grace_period"`
+	Candidates  []BanPolicyCandidate `json:"candidates"`
+	// 実際にBAN・停止・警告した会員の数 (dry run では0)
+	Sanctioned int `json:"sanctioned"`
+	Warned     int `json:"warned"`
+	// 処分・警告に失敗した会員の数 (エラーは各会員の error にある)
+	Failed int `json:"failed"`
+}
+
+// 延滞している会員を探して処分する (dryRun なら探すだけ)
+// 会員ごとの処分の失敗はエラーにせず、結果の会員の Error に入れる
+func (p *banPolicyJob) Run(ctx context.Context, dryRun bool) (BanPolicyRunResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := currentTime()
+	candidates, err := p.candidates(ctx, now)
+	if err != nil {
+		return BanPolicyRunResult{}, err
+	}
+	result := BanPolicyRunResult{
+		DryRun:      dryRun,
+		Action:      p.action,
+		GracePeriod: p.grace.String(),
+		Candidates:  candidates,
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	// 1人の処分に失敗しても他の会員の処分は続ける
+	for i, c := range candidates {
+		var (
+			done bool
+			err  error
+		)
+		switch c.Action {
+		case banCandidateWarn:
+			done, err = p.sendWarnings(ctx, c, now)
+			if done {
+				result.Warned++
+			}
+		case banActionBan, banActionSuspend:
+			done, err = p.sanction(ctx, c, now)
+			if done {
+				result.Sanctioned++
+			}
+		}
+		if err != nil {
+			appLogger.Error("ban policy failed for member",
+				slog.String("member_id", c.MemberID), slog.String("action", c.Action), slog.String("error", err.Error()))
+			result.Candidates[i].Error = err.Error()
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+// 猶予を過ぎた (警告するなら警告する時期を過ぎた) 貸出を会員ごとにまとめる
+func (p *banPolicyJob) candidates(ctx context.Context, now time.Time) ([]BanPolicyCandidate, error) {
+	// 期限がこれ以前ならBAN・停止する
+	banDue := now.Add(-p.grace)
+	threshold := banDue
+	if p.warn {
+		// BANする warn_lead 前に警告する (期限を過ぎる前には警告しない)
+		threshold = now.Add(-max(p.grace-p.warnLead, 0))
+	}
+
+	query := "SELECT l.`id` AS `lending_id`, l.`member_id`, l.`book_id`, l.`due`, " +
+		"m.`name` AS `member_name`, b.`title` AS `book_title`, COALESCE(e.`email`, '') AS `email`, w.`sent_at` AS `warned_at` " +
+		"FROM `lending` AS l " +
+		"INNER JOIN `member` AS m ON m.`id` = l.`member_id` " +
+		"INNER JOIN `book` AS b ON b.`id` = l.`book_id` " +
+		"LEFT JOIN `member_email` AS e ON e.`member_id` = l.`member_id` " +
+		"LEFT JOIN `reminder` AS w ON w.`lending_id` = l.`id` AND w.`kind` = ? " +
+		"WHERE l.`due` <= ? AND m.`banned` = false "
+	args := []any{reminderKindBanWarning, threshold}
+	if p.action == banActionSuspend {
+		// 停止中の会員は停止が終わってから見直す
+		query += "AND NOT EXISTS (SELECT 1 FROM `member_sanction` AS s WHERE s.`member_id` = l.`member_id` AND s.`action` = ? AND s.`expires_at` > ?) "
+		args = append(args, banActionSuspend, now)
+	}
+	query += "ORDER BY l.`due` ASC LIMIT ?"
+	args = append(args, p.batchSize)
+
+	var overdue []struct {
+		Reminder
+		WarnedAt sql.NullTime `db:"warned_at"`
+	}
+	if err := db.SelectContext(ctx, &overdue, query, args...); err != nil {
+		return nil, err
+	}
+
+	candidates := []BanPolicyCandidate{}
+	index := map[string]int{}
+	for _, l := range overdue {
+		i, ok := index[l.MemberID]
+		if !ok {
+			i = len(candidates)
+			index[l.MemberID] = i
+			candidates = append(candidates, BanPolicyCandidate{MemberID: l.MemberID, MemberName: l.MemberName})
+		}
+		c := &candidates[i]
+
+		lending := OverdueLending{LendingID: l.LendingID, BookID: l.BookID, BookTitle: l.BookTitle, Due: l.Due}
+		if l.WarnedAt.Valid {
+			lending.WarnedAt = &l.WarnedAt.Time
+		}
+		c.Lendings = append(c.Lendings, lending)
+
+		// この貸出でBAN・停止できる時刻
+		banAt := l.Due.Add(p.grace)
+		if p.warn {
+			warnedAt := now
+			if l.WarnedAt.Valid {
+				warnedAt = l.WarnedAt.Time
+			} else {
+				r := l.Reminder
+				r.Kind = reminderKindBanWarning
+				c.warnings = append(c.warnings, r)
+			}
+			if at := warnedAt.Add(p.warnLead); at.After(banAt) {
+				banAt = at
+			}
+		}
+		if !banAt.After(now) {
+			if c.Action != p.action {
+				c.Action = p.action
+				c.lendingID = l.LendingID
+				c.Reason = fmt.Sprintf("lending %s of %q was due %s and is overdue beyond the %s grace period",
+					l.LendingID, l.BookTitle, l.Due.In(location).Format(time.RFC3339), p.grace)
+			}
+		} else if c.BanAt == nil || banAt.Before(*c.BanAt) {
+			c.BanAt = &banAt
+		}
+	}
+
+	for i := range candidates {
+		c := &candidates[i]
+		switch {
+		case c.Action == p.action:
+			c.BanAt = nil
+		case len(c.warnings) > 0:
+			c.Action = banCandidateWarn
+		default:
+			c.Action = banCandidateWait
+		}
+		for j := range c.warnings {
+			c.warnings[j].BanAt = c.BanAt
+		}
+	}
+	return candidates, nil
+}
+
+// 警告を送る (送り先がない会員は記録だけ残す)
+func (p *banPolicyJob) sendWarnings(ctx context.Context, c BanPolicyCandidate, now time.Time) (bool, error) {
+	var result ReminderRunResult
+	for _, r := range c.warnings {
+		if err := reminders.send(ctx, r, now, &result); err != nil {
+			return false, err
+		}
+	}
+	if result.Sent+result.Skipped == 0 {
+		return false, nil
+	}
+	banPolicyActionsTotal.WithLabelValues(banCandidateWarn).Inc()
+	return true, nil
+}
+
+func (p *banPolicyJob) sanction(ctx context.Context, c BanPolicyCandidate, now time.Time) (bool, error) {
+	var expiresAt *time.Time
+	if p.action == banActionSuspend {
+		t := now.Add(p.suspendFor)
+		expiresAt = &t
+	}
+	sanction := newMemberSanction(c.MemberID, p.action, sanctionSourcePolicy, c.Reason, c.lendingID, expiresAt)
+	var err error
+	ok := true
+	if p.action == banActionBan {
+		err = banMember(ctx, sanction)
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusNotFound {
+			// 他のインスタンスか手動で先にBANされた
+			ok, err = false, nil
+		}
+	} else {
+		ok, err = suspendMember(ctx, sanction)
+	}
+	if errors.Is(err, errSanctionLendingReturned) {
+		// 探してから処分するまでの間に返却された
+		return false, nil
+	}
+	if err != nil || !ok {
+		return false, err
+	}
+
+	banPolicyActionsTotal.WithLabelValues(p.action).Inc()
+	appLogger.LogAttrs(ctx, slog.LevelInfo, "ban policy applied",
+		slog.String("action", p.action),
+		slog.String("member_id", c.MemberID),
+		slog.String("reason", c.Reason))
+	return true, nil
+}
+
+/* --- Ban Policy API --- */
+
+// BAN・停止・警告の対象になる会員を、処分せずに返す
+func dryRunBanPolicyHandler(c echo.Context) error {
+	result, err := banPolicy.Run(c.Request().Context(), true)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// 延滞している会員をすぐに処分する
+func runBanPolicyHandler(c echo.Context) error {
+	result, err := banPolicy.Run(c.Request().Context(), false)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// 会員のBAN・停止の記録
+func getMemberSanctionsHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
+	}
+
+	sanctions := []MemberSanction{}
+	err := readDB(c).SelectContext(c.Request().Context(), &sanctions,
+		"SELECT * FROM `member_sanction` WHERE `member_id` = ? ORDER BY `created_at` DESC", id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, sanctions)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBanPolicyCandidates(t *testing.T) {
+	setupTestSQLite(t)
+	now := time.Date(2023, 9, 9, 12, 0, 0, 0, location)
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range []struct {
+		id, memberID string
+		due          time.Duration
+		warned       time.Duration
+	}{
+		{id: "L1", memberID: "MA", due: -100 * time.Hour},
+		{id: "L3", memberID: "MC", due: -99 * time.Hour, warned: -30 * time.Hour},
+		{id: "L4", memberID: "MD", due: -98 * time.Hour, warned: -10 * time.Hour},
+		{id: "LG", memberID: "MG", due: -97 * time.Hour},
+		{id: "LF", memberID: "MF", due: -96 * time.Hour},
+		{id: "L7", memberID: "MA", due: -80 * time.Hour},
+		{id: "L2", memberID: "MB", due: -50 * time.Hour},
+		{id: "L5", memberID: "ME", due: -1 * time.Hour},
+	} {
+		exec("INSERT INTO `book` (`id`, `title`, `author`, `genre`, `created_at`) VALUES (?, ?, '', 0, ?)", "B"+l.id, "book "+l.id, now)
+		exec("INSERT INTO `lending` (`id`, `member_id`, `book_id`, `due`, `created_at`) VALUES (?, ?, ?, ?, ?)", l.id, l.memberID, "B"+l.id, now.Add(l.due), now)
+		if l.warned != 0 {
+			exec("INSERT INTO `reminder` (`lending_id`, `kind`, `member_id`, `book_id`, `due`, `notifier`, `sent_at`) VALUES (?, ?, ?, ?, ?, 'log', ?)",
+				l.id, reminderKindBanWarning, l.memberID, "B"+l.id, now.Add(l.due), now.Add(l.warned))
+		}
+	}
+	for _, id := range []string{"MA", "MB", "MC", "MD", "ME", "MG"} {
+		insertTestMember(t, id, "member "+id, "", false)
+	}
+	insertTestMember(t, "MF", "member MF", "", true)
+	// MG は停止中
+	exec("INSERT INTO `member_sanction` (`id`, `member_id`, `action`, `source`, `reason`, `lending_id`, `expires_at`, `created_at`) VALUES ('S1', 'MG', ?, 'policy', '', 'LG', ?, ?)",
+		banActionSuspend, now.Add(24*time.Hour), now.Add(-time.Hour))
+
+	type candidate struct {
+		memberID string
+		action   string
+		lendings []string
+		// BAN・停止までの時間 (BAN・停止するなら0)
+		banIn time.Duration
+	}
+	tests := []struct {
+		name   string
+		action string
+		warn   bool
+		want   []candidate
+	}{
+		{
+			name:   "ban",
+			action: banActionBan,
+			want: []candidate{
+				{memberID: "MA", action: banActionBan, lendings: []string{"L1", "L7"}},
+				{memberID: "MC", action: banActionBan, lendings: []string{"L3"}},
+				{memberID: "MD", action: banActionBan, lendings: []string{"L4"}},
+				{memberID: "MG", action: banActionBan, lendings: []string{"LG"}},
+			},
+		},
+		{
+			name:   "suspend skips suspended members",
+			action: banActionSuspend,
+			want: []candidate{
+				{memberID: "MA", action: banActionSuspend, lendings: []string{"L1", "L7"}},
+				{memberID: "MC", action: banActionSuspend, lendings: []string{"L3"}},
+				{memberID: "MD", action: banActionSuspend, lendings: []string{"L4"}},
+			},
+		},
+		{
+			name:   "warn first",
+			action: banActionBan,
+			warn:   true,
+			want: []candidate{
+				{memberID: "MA", action: banCandidateWarn, lendings: []string{"L1", "L7"}, banIn: 24 * time.Hour},
+				{memberID: "MC", action: banActionBan, lendings: []string{"L3"}},
+				{memberID: "MD", action: banCandidateWait, lendings: []string{"L4"}, banIn: 14 * time.Hour},
+				{memberID: "MG", action: banCandidateWarn, lendings: []string{"LG"}, banIn: 24 * time.Hour},
+				{memberID: "MB", action: banCandidateWarn, lendings: []string{"L2"}, banIn: 24 * time.Hour},
+			},
+		},
+		{
+			name:   "warn first and suspend",
+			action: banActionSuspend,
+			warn:   true,
+			want: []candidate{
+				{memberID: "MA", action: banCandidateWarn, lendings: []string{"L1", "L7"}, banIn: 24 * time.Hour},
+				{memberID: "MC", action: banActionSuspend, lendings: []string{"L3"}},
+				{memberID: "MD", action: banCandidateWait, lendings: []string{"L4"}, banIn: 14 * time.Hour},
+				{memberID: "MB", action: banCandidateWarn, lendings: []string{"L2"}, banIn: 24 * time.Hour},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newBanPolicyJob(BanPolicyConfig{
+				Action:      tt.action,
+				GracePeriod: 72 * time.Hour,
+				SuspendFor:  24 * time.Hour,
+				Warn:        tt.warn,
+				WarnLead:    24 * time.Hour,
+				BatchSize:   100,
+			})
+			candidates, err := p.candidates(context.Background(), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []candidate{}
+			for _, c := range candidates {
+				gc := candidate{memberID: c.MemberID, action: c.Action}
+				for _, l := range c.Lendings {
+					gc.lendings = append(gc.lendings, l.LendingID)
+				}
+				if c.BanAt != nil {
+					gc.banIn = c.BanAt.Sub(now)
+				}
+				got = append(got, gc)
+
+				if c.Action == tt.action && c.lendingID != c.Lendings[0].LendingID {
+					t.Errorf("%s: sanctioned for %s, want the oldest lending %s", c.MemberID, c.lendingID, c.Lendings[0].LendingID)
+				}
+				if wantWarnings := c.Action == banCandidateWarn; wantWarnings != (len(c.warnings) > 0) {
+					t.Errorf("%s: %d warnings for %s", c.MemberID, len(c.warnings), c.Action)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
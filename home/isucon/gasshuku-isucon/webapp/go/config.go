@@ -0,0 +1,722 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+---------------------------------------------------------------
+Configuration
+---------------------------------------------------------------
+*/
+
+// 設定値の優先順位は デフォルト < YAMLファイル < 環境変数 < コマンドラインフラグ
+type Config struct {
+	// 設定ファイルのパス (-config / CONFIG_FILE)
+	File string `yaml:"-" json:"file,omitempty"`
+
+	Listen    ListenConfig    `yaml:"listen" json:"listen"`
+	DB        DBConfig        `yaml:"db" json:"db"`
+	Paths     PathsConfig     `yaml:"paths" json:"paths"`
+	Init      InitConfig      `yaml:"init" json:"init"`
+	Cache     CacheConfig     `yaml:"cache" json:"cache"`
+	Log       LogConfig       `yaml:"log" json:"log"`
+	Tracing   TracingConfig   `yaml:"tracing" json:"tracing"`
+	Pages     PagesConfig     `yaml:"pages" json:"pages"`
+	Search    SearchConfig    `yaml:"search" json:"search"`
+	Recommend RecommendConfig `yaml:"recommend" json:"recommend"`
+	Reminder  ReminderConfig  `yaml:"reminder" json:"reminder"`
+	Webhook   WebhookConfig   `yaml:"webhook" json:"webhook"`
+	Events    EventsConfig    `yaml:"events" json:"events"`
+	BanPolicy BanPolicyConfig `yaml:"ban_policy" json:"ban_policy"`
+	Timezone  string          `yaml:"timezone" json:"timezone"`
+	Debug     bool            `yaml:"debug" json:"debug"`
+	Shutdown  ShutdownConfig  `yaml:"shutdown" json:"shutdown"`
+}
+
+type ListenConfig struct {
+	Address string `yaml:"address" json:"address"`
+	// 指定されていればTCPの代わりにUNIXドメインソケットで待ち受ける
+	Socket string `yaml:"socket" json:"socket,omitempty"`
+}
+
+type DBConfig struct {
+	// 接続先のURL (sqlite:<path> または mysql://<DSN>)
+	// 指定されていればホスト名などの個別の設定より優先する
+	URL             string        `yaml:"url" json:"url,omitempty"`
+	Host            string        `yaml:"host" json:"host"`
+	Port            string        `yaml:"port" json:"port"`
+	User            string        `yaml:"user" json:"user"`
+	Password        string        `yaml:"password" json:"password"`
+	Name            string        `yaml:"name" json:"name"`
+	MaxOpenConns    int           `yaml:"max_open_conns" json:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" json:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" json:"conn_max_lifetime"`
+	// 参照系のクエリを振り分けるリードレプリカのDSN (空ならすべてプライマリ)
+	ReplicaDSNs stringList `yaml:"replica_dsns" json:"replica_dsns,omitempty"`
+	// 会員が書き込んでからその会員の読み取りをプライマリに向ける時間
+	ReplicaStickyWindow time.Duration `yaml:"replica_sticky_window" json:"replica_sticky_window"`
+	// レプリカの死活を確認する間隔
+	ReplicaHealthInterval time.Duration `yaml:"replica_health_interval" json:"replica_health_interval"`
+}
+
+type PathsConfig struct {
+	Images string `yaml:"images" json:"images"`
+	// 初期データのスナップショット (1_data.sql など) があるディレクトリ
+	SQLDir       string `yaml:"sql_dir" json:"sql_dir"`
+	InitDBScript string `yaml:"init_db_script" json:"init_db_script"`
+	// 会員証・蔵書ラベルの文字に使うTrueType/OpenTypeフォント
+	// 日本語のグリフがなければ起動できない。空ならシステムの日本語フォントを探し、なければラベルを出力しない
+	LabelFont string `yaml:"label_font" json:"label_font,omitempty"`
+}
+
+// 初期データの読み込み方法
+const (
+	initLoaderNative = "native"
+	initLoaderScript = "script"
+)
+
+type InitConfig struct {
+	// native: プロセス内でスナップショットを読み込む, script: init_db_script を実行する
+	// init_db_script はMySQL用なので、SQLiteでは常に native で読み込む
+	Loader string `yaml:"loader" json:"loader"`
+}
+
+type LogConfig struct {
+	// 空または"stdout"なら標準出力
+	File       string `yaml:"file" json:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb" json:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups" json:"max_backups"`
+	MaxAgeDays int    `yaml:"max_age_days" json:"max_age_days"`
+}
+
+type TracingConfig struct {
+	// uptrace, otlp-grpc, otlp-http, file, off
+	Exporter    string `yaml:"exporter" json:"exporter"`
+	ServiceName string `yaml:"service_name" json:"service_name"`
+	// 0.0 ~ 1.0 (親スパンがあればその判定に従う)
+	SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"`
+	// otlp-grpc/otlp-httpの送信先 (host:port)
+	Endpoint string `yaml:"endpoint" json:"endpoint,omitempty"`
+	Insecure bool   `yaml:"insecure" json:"insecure,omitempty"`
+	// fileエクスポータの出力先
+	File string `yaml:"file" json:"file,omitempty"`
+	// 未指定ならuptrace-goがUPTRACE_DSNを読む
+	UptraceDSN string `yaml:"uptrace_dsn" json:"uptrace_dsn,omitempty"`
+}
+
+type PagesConfig struct {
+	MemberLimit int `yaml:"member_limit" json:"member_limit"`
+	BookLimit   int `yaml:"book_limit" json:"book_limit"`
+}
+
+type SearchConfig struct {
+	// ひらがなとカタカナを区別せずに検索する (変えたら接尾辞テーブルの作り直しが必要)
+	FoldKana bool `yaml:"fold_kana" json:"fold_kana"`
+}
+
+type RecommendConfig struct {
+	// 貸し出した本の共起を数える間隔と、1回に数える貸出の上限
+	Interval  time.Duration `yaml:"interval" json:"interval"`
+	BatchSize int           `yaml:"batch_size" json:"batch_size"`
+}
+
+type ReminderConfig struct {
+	// 貸出期限の通知を確認する間隔 (0で無効)
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// 期限のどれだけ前から「期限が近い」通知を送るか
+	LeadTime time.Duration `yaml:"lead_time" json:"lead_time"`
+	// 1回の確認で送る通知の上限
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+	// file, webhook, smtp
+	Notifier string `yaml:"notifier" json:"notifier"`
+	// fileの出力先 (空または"stdout"なら標準出力)
+	File string `yaml:"file" json:"file,omitempty"`
+	// webhookの送信先
+	WebhookURL string `yaml:"webhook_url" json:"webhook_url,omitempty"`
+	// webhook・smtpの送信1回あたりのタイムアウト
+	Timeout   time.Duration     `yaml:"timeout" json:"timeout"`
+	SMTP      SMTPConfig        `yaml:"smtp" json:"smtp"`
+	Templates ReminderTemplates `yaml:"templates" json:"templates"`
+}
+
+type SMTPConfig struct {
+	Host string `yaml:"host" json:"host,omitempty"`
+	Port string `yaml:"port" json:"port,omitempty"`
+	// 空なら認証しない
+	Username string `yaml:"username" json:"username,omitempty"`
+	Password string `yaml:"password" json:"password,omitempty"`
+	From     string `yaml:"from" json:"from,omitempty"`
+}
+
+// 通知の件名・本文 (text/template, . は Reminder)
+type ReminderTemplates struct {
+	DueSoonSubject string `yaml:"due_soon_subject" json:"due_soon_subject"`
+	DueSoonBody    string `yaml:"due_soon_body" json:"due_soon_body"`
+	OverdueSubject string `yaml:"overdue_subject" json:"overdue_subject"`
+	OverdueBody    string `yaml:"overdue_body" json:"overdue_body"`
+	// BAN・停止の前の警告 (ban_policy.warn)
+	BanWarningSubject string `yaml:"ban_warning_subject" json:"ban_warning_subject"`
+	BanWarningBody    string `yaml:"ban_warning_body" json:"ban_warning_body"`
+}
+
+type WebhookConfig struct {
+	// 送信待ちを確認する間隔 (0で送信しない)
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// 1回の確認で取り出す送信待ちの数と、同時に送る数
+	BatchSize   int `yaml:"batch_size" json:"batch_size"`
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+	// 送信1回あたりのタイムアウト
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// この回数失敗したら諦める
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts"`
+	// 再送までの間隔 (失敗するたびに倍にし、backoff_max で頭打ち)
+	BackoffBase time.Duration `yaml:"backoff_base" json:"backoff_base"`
+	BackoffMax  time.Duration `yaml:"backoff_max" json:"backoff_max"`
+}
+
+type EventsConfig struct {
+	// Last-Event-IDで送り直せるように持っておく直近のイベントの数
+	BufferSize int `yaml:"buffer_size" json:"buffer_size"`
+	// 接続を保つためのコメント行を送る間隔
+	Heartbeat time.Duration `yaml:"heartbeat" json:"heartbeat"`
+}
+
+type BanPolicyConfig struct {
+	// 延滞している会員を確認する間隔 (0で無効)
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// ban: BANする, suspend: 一定期間貸し出さない
+	Action string `yaml:"action" json:"action"`
+	// 返却期限を過ぎてからBAN・停止するまでの猶予
+	GracePeriod time.Duration `yaml:"grace_period" json:"grace_period"`
+	// 停止する期間
+	SuspendFor time.Duration `yaml:"suspend_for" json:"suspend_for"`
+	// BAN・停止の前に期限の通知と同じ送り先で警告する
+	Warn bool `yaml:"warn" json:"warn"`
+	// 警告してからBAN・停止するまでに空ける時間
+	WarnLead time.Duration `yaml:"warn_lead" json:"warn_lead"`
+	// 1回の確認で見る貸出の上限
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+}
+
+type CacheConfig struct {
+	// memory: プロセス内, db: statsテーブル (複数インスタンスで共有する場合)
+	CounterBackend string `yaml:"counter_backend" json:"counter_backend"`
+	// カウンタをDBと照合する間隔 (0で無効)
+	ReconcileInterval time.Duration `yaml:"reconcile_interval" json:"reconcile_interval"`
+	// 他のインスタンスの初期化を確認する間隔 (0で無効)
+	InvalidationInterval time.Duration `yaml:"invalidation_interval" json:"invalidation_interval"`
+}
+
+type ShutdownConfig struct {
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ListenConfig{
+			Address: ":8080",
+		},
+		DB: DBConfig{
+			Host:            "localhost",
+			Port:            "3306",
+			User:            "isucon",
+			Password:        "isucon",
+			Name:            "isulibrary",
+			MaxOpenConns:    0,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: 0,
+
+			ReplicaStickyWindow:   2 * time.Second,
+			ReplicaHealthInterval: time.Second,
+		},
+		Paths: PathsConfig{
+			Images:       "../images",
+			SQLDir:       "../sql",
+			InitDBScript: "../sql/init_db.sh",
+		},
+		Init: InitConfig{
+			Loader: initLoaderScript,
+		},
+		Cache: CacheConfig{
+			CounterBackend:       counterBackendMemory,
+			ReconcileInterval:    30 * time.Second,
+			InvalidationInterval: 0,
+		},
+		Log: LogConfig{
+			File:       "stdout",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+			MaxAgeDays: 7,
+		},
+		Tracing: TracingConfig{
+			Exporter:    tracingExporterUptrace,
+			ServiceName: "dev-1",
+			SampleRatio: 1,
+			File:        "traces.jsonl",
+		},
+		Pages: PagesConfig{
+			MemberLimit: 100,
+			BookLimit:   50,
+		},
+		Recommend: RecommendConfig{
+			Interval:  time.Second,
+			BatchSize: 1000,
+		},
+		Reminder: ReminderConfig{
+			Interval:  0,
+			LeadTime:  24 * time.Hour,
+			BatchSize: 100,
+			Notifier:  notifierFile,
+			File:      "stdout",
+			Timeout:   10 * time.Second,
+			SMTP: SMTPConfig{
+				Port: "25",
+			},
+			Templates: defaultReminderTemplates,
+		},
+		Webhook: WebhookConfig{
+			Interval:    time.Second,
+			BatchSize:   100,
+			Concurrency: 4,
+			Timeout:     5 * time.Second,
+			MaxAttempts: 10,
+			BackoffBase: time.Second,
+			BackoffMax:  time.Hour,
+		},
+		Events: EventsConfig{
+			BufferSize: 1024,
+			Heartbeat:  15 * time.Second,
+		},
+		BanPolicy: BanPolicyConfig{
+			Interval: 0,
+			Action:   banActionBan,
+			// ベンチマーカーがBANしていた基準 (期限から3秒) に合わせる
+			GracePeriod: 3 * time.Second,
+			SuspendFor:  24 * time.Hour,
+			Warn:        false,
+			WarnLead:    time.Second,
+			BatchSize:   100,
+		},
+		Timezone: "Asia/Tokyo",
+		Debug:    true,
+		Shutdown: ShutdownConfig{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (c *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&c.File, "config", c.File, "path to YAML config file")
+	fs.StringVar(&c.Listen.Address, "listen", c.Listen.Address, "TCP address to listen on")
+	fs.StringVar(&c.Listen.Socket, "socket", c.Listen.Socket, "UNIX socket path to listen on instead of TCP")
+	fs.StringVar(&c.DB.URL, "db-url", c.DB.URL, "database URL (sqlite:<path> or mysql://<dsn>); overrides db-host etc.")
+	fs.StringVar(&c.DB.Host, "db-host", c.DB.Host, "database host")
+	fs.StringVar(&c.DB.Port, "db-port", c.DB.Port, "database port")
+	fs.StringVar(&c.DB.User, "db-user", c.DB.User, "database user")
+	fs.StringVar(&c.DB.Password, "db-pass", c.DB.Password, "database password")
+	fs.StringVar(&c.DB.Name, "db-name", c.DB.Name, "database name")
+	fs.IntVar(&c.DB.MaxOpenConns, "db-max-open-conns", c.DB.MaxOpenConns, "maximum open DB connections (0 = unlimited)")
+	fs.IntVar(&c.DB.MaxIdleConns, "db-max-idle-conns", c.DB.MaxIdleConns, "maximum idle DB connections")
+	fs.DurationVar(&c.DB.ConnMaxLifetime, "db-conn-max-lifetime", c.DB.ConnMaxLifetime, "maximum lifetime of a DB connection (0 = unlimited)")
+	fs.Var(&c.DB.ReplicaDSNs, "db-replica-dsn", "comma-separated read replica DSNs")
+	fs.DurationVar(&c.DB.ReplicaStickyWindow, "db-replica-sticky-window", c.DB.ReplicaStickyWindow, "time to read a member's data from the primary after their writes")
+	fs.DurationVar(&c.DB.ReplicaHealthInterval, "db-replica-health-interval", c.DB.ReplicaHealthInterval, "interval to ping read replicas")
+	fs.StringVar(&c.Paths.Images, "images-dir", c.Paths.Images, "directory for generated QR code images")
+	fs.StringVar(&c.Paths.SQLDir, "sql-dir", c.Paths.SQLDir, "directory containing the initial data snapshots")
+	fs.StringVar(&c.Paths.InitDBScript, "init-db-script", c.Paths.InitDBScript, "script run by POST /api/initialize with the script loader")
+	fs.StringVar(&c.Paths.LabelFont, "label-font", c.Paths.LabelFont, "TrueType/OpenType font with Japanese glyphs for member cards and book labels (default: search system fonts)")
+	fs.StringVar(&c.Init.Loader, "init-loader", c.Init.Loader, "initial data loader (native, script)")
+	fs.StringVar(&c.Cache.CounterBackend, "counter-backend", c.Cache.CounterBackend, "where to keep list totals (memory, db)")
+	fs.DurationVar(&c.Cache.InvalidationInterval, "cache-invalidation-interval", c.Cache.InvalidationInterval, "interval to check for initialization by other instances (0 = disabled)")
+	fs.DurationVar(&c.Cache.ReconcileInterval, "cache-reconcile-interval", c.Cache.ReconcileInterval, "interval to reconcile in-process counters with the database (0 = disabled)")
+	fs.StringVar(&c.Log.File, "log-file", c.Log.File, "log file path (\"stdout\" for standard output)")
+	fs.StringVar(&c.Tracing.Exporter, "tracing-exporter", c.Tracing.Exporter, "tracing exporter ("+strings.Join(tracingExporters, ", ")+")")
+	fs.StringVar(&c.Tracing.ServiceName, "tracing-service-name", c.Tracing.ServiceName, "service name reported by otelecho")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracing-sample-ratio", c.Tracing.SampleRatio, "fraction of root traces to sample (0.0-1.0)")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing-endpoint", c.Tracing.Endpoint, "OTLP collector endpoint (host:port)")
+	fs.BoolVar(&c.Tracing.Insecure, "tracing-insecure", c.Tracing.Insecure, "disable TLS for the OTLP exporter")
+	fs.StringVar(&c.Tracing.File, "tracing-file", c.Tracing.File, "JSON lines file written by the file exporter")
+	fs.IntVar(&c.Pages.MemberLimit, "member-page-limit", c.Pages.MemberLimit, "members per page")
+	fs.IntVar(&c.Pages.BookLimit, "book-page-limit", c.Pages.BookLimit, "books per page")
+	fs.BoolVar(&c.Search.FoldKana, "search-fold-kana", c.Search.FoldKana, "treat hiragana and katakana as equal in title/author search")
+	fs.DurationVar(&c.Recommend.Interval, "recommend-interval", c.Recommend.Interval, "interval to count co-borrowed books for recommendations")
+	fs.IntVar(&c.Recommend.BatchSize, "recommend-batch-size", c.Recommend.BatchSize, "maximum lendings counted per run")
+	fs.DurationVar(&c.Reminder.Interval, "reminder-interval", c.Reminder.Interval, "interval to send due-date reminders (0 = disabled)")
+	fs.DurationVar(&c.Reminder.LeadTime, "reminder-lead-time", c.Reminder.LeadTime, "how long before the due date to send a reminder")
+	fs.IntVar(&c.Reminder.BatchSize, "reminder-batch-size", c.Reminder.BatchSize, "maximum reminders sent per run")
+	fs.StringVar(&c.Reminder.Notifier, "reminder-notifier", c.Reminder.Notifier, "reminder notifier ("+strings.Join(reminderNotifiers, ", ")+")")
+	fs.StringVar(&c.Reminder.File, "reminder-file", c.Reminder.File, "JSON lines file written by the file notifier (\"stdout\" for standard output)")
+	fs.StringVar(&c.Reminder.WebhookURL, "reminder-webhook-url", c.Reminder.WebhookURL, "URL the webhook notifier posts reminders to")
+	fs.StringVar(&c.Reminder.SMTP.Host, "smtp-host", c.Reminder.SMTP.Host, "SMTP server host for the smtp notifier")
+	fs.StringVar(&c.Reminder.SMTP.Port, "smtp-port", c.Reminder.SMTP.Port, "SMTP server port")
+	fs.StringVar(&c.Reminder.SMTP.From, "smtp-from", c.Reminder.SMTP.From, "sender address of reminder mails")
+	fs.DurationVar(&c.Webhook.Interval, "webhook-interval", c.Webhook.Interval, "interval to deliver queued webhook events (0 = disabled)")
+	fs.DurationVar(&c.Webhook.Timeout, "webhook-timeout", c.Webhook.Timeout, "timeout of a webhook delivery")
+	fs.IntVar(&c.Webhook.MaxAttempts, "webhook-max-attempts", c.Webhook.MaxAttempts, "delivery attempts before giving up on a webhook event")
+	fs.DurationVar(&c.Webhook.BackoffBase, "webhook-backoff-base", c.Webhook.BackoffBase, "wait before the first webhook retry (doubled on each failure)")
+	fs.DurationVar(&c.Webhook.BackoffMax, "webhook-backoff-max", c.Webhook.BackoffMax, "maximum wait between webhook retries")
+	fs.IntVar(&c.Events.BufferSize, "events-buffer-size", c.Events.BufferSize, "recent events kept for Last-Event-ID resume")
+	fs.DurationVar(&c.Events.Heartbeat, "events-heartbeat", c.Events.Heartbeat, "interval of keep-alive comments on event streams")
+	fs.DurationVar(&c.BanPolicy.Interval, "ban-policy-interval", c.BanPolicy.Interval, "interval to ban members with overdue lendings (0 = disabled)")
+	fs.StringVar(&c.BanPolicy.Action, "ban-policy-action", c.BanPolicy.Action, "what to do with overdue members ("+strings.Join(banActions, ", ")+")")
+	fs.DurationVar(&c.BanPolicy.GracePeriod, "ban-policy-grace-period", c.BanPolicy.GracePeriod, "time after the due date before a member is banned or suspended")
+	fs.DurationVar(&c.BanPolicy.SuspendFor, "ban-policy-suspend-for", c.BanPolicy.SuspendFor, "how long a suspension lasts")
+	fs.IntVar(&c.BanPolicy.BatchSize, "ban-policy-batch-size", c.BanPolicy.BatchSize, "maximum overdue lendings examined per run")
+	fs.BoolVar(&c.BanPolicy.Warn, "ban-policy-warn", c.BanPolicy.Warn, "warn members through the reminder notifier before banning or suspending them")
+	fs.DurationVar(&c.BanPolicy.WarnLead, "ban-policy-warn-lead", c.BanPolicy.WarnLead, "minimum time between the warning and the ban or suspension")
+	fs.StringVar(&c.Timezone, "timezone", c.Timezone, "timezone used for timestamps")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "enable echo debug mode")
+	fs.DurationVar(&c.Shutdown.Timeout, "shutdown-timeout", c.Shutdown.Timeout, "time to wait for in-flight requests on shutdown")
+	return fs
+}
+
+// 設定を読み込む
+// フラグ以降の引数 (migrate up などのサブコマンド) も返す
+func loadConfig(args []string) (Config, []string, error) {
+	// 設定ファイルのパスを知るために一度フラグを読み、指定されたフラグを覚えておく
+	cfg := defaultConfig()
+	fs := cfg.flagSet()
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+	rest := fs.Args()
+	setFlags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	cfg = defaultConfig()
+	cfg.File = getEnvOrDefault("CONFIG_FILE", "")
+	if file, ok := setFlags["config"]; ok {
+		cfg.File = file
+	}
+	if cfg.File != "" {
+		if err := cfg.loadYAML(cfg.File); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return Config{}, nil, err
+	}
+
+	fs = cfg.flagSet()
+	for name, value := range setFlags {
+		if err := fs.Set(name, value); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, rest, nil
+}
+
+func (c *Config) loadYAML(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	envString(&c.Listen.Address, "LISTEN_ADDRESS")
+	envString(&c.Listen.Socket, "LISTEN_SOCKET")
+	envString(&c.DB.URL, "DATABASE_URL")
+	envString(&c.DB.Host, "DB_HOST")
+	envString(&c.DB.Port, "DB_PORT")
+	envString(&c.DB.User, "DB_USER")
+	envString(&c.DB.Password, "DB_PASS")
+	envString(&c.DB.Name, "DB_NAME")
+	if val := os.Getenv("DB_REPLICA_DSN"); val != "" {
+		_ = c.DB.ReplicaDSNs.Set(val)
+	}
+	envString(&c.Paths.Images, "IMAGES_DIR")
+	envString(&c.Paths.SQLDir, "SQL_DIR")
+	envString(&c.Paths.InitDBScript, "INIT_DB_SCRIPT")
+	envString(&c.Paths.LabelFont, "LABEL_FONT")
+	envString(&c.Init.Loader, "INIT_LOADER")
+	envString(&c.Cache.CounterBackend, "COUNTER_BACKEND")
+	envString(&c.Log.File, "LOG_FILE")
+	envString(&c.Tracing.Exporter, "TRACING_EXPORTER")
+	envString(&c.Tracing.ServiceName, "TRACING_SERVICE_NAME")
+	envString(&c.Tracing.Endpoint, "TRACING_ENDPOINT")
+	envString(&c.Tracing.File, "TRACING_FILE")
+	envString(&c.Tracing.UptraceDSN, "UPTRACE_DSN")
+	envString(&c.Reminder.Notifier, "REMINDER_NOTIFIER")
+	envString(&c.Reminder.File, "REMINDER_FILE")
+	envString(&c.Reminder.WebhookURL, "REMINDER_WEBHOOK_URL")
+	envString(&c.Reminder.SMTP.Host, "SMTP_HOST")
+	envString(&c.Reminder.SMTP.Port, "SMTP_PORT")
+	envString(&c.Reminder.SMTP.Username, "SMTP_USERNAME")
+	envString(&c.Reminder.SMTP.Password, "SMTP_PASSWORD")
+	envString(&c.Reminder.SMTP.From, "SMTP_FROM")
+	envString(&c.BanPolicy.Action, "BAN_POLICY_ACTION")
+	envString(&c.Timezone, "APP_TIMEZONE")
+
+	for _, err := range []error{
+		envInt(&c.DB.MaxOpenConns, "DB_MAX_OPEN_CONNS"),
+		envInt(&c.DB.MaxIdleConns, "DB_MAX_IDLE_CONNS"),
+		envDuration(&c.DB.ConnMaxLifetime, "DB_CONN_MAX_LIFETIME"),
+		envDuration(&c.DB.ReplicaStickyWindow, "DB_REPLICA_STICKY_WINDOW"),
+		envDuration(&c.DB.ReplicaHealthInterval, "DB_REPLICA_HEALTH_INTERVAL"),
+		envDuration(&c.Cache.ReconcileInterval, "CACHE_RECONCILE_INTERVAL"),
+		envDuration(&c.Cache.InvalidationInterval, "CACHE_INVALIDATION_INTERVAL"),
+		envInt(&c.Log.MaxSizeMB, "LOG_MAX_SIZE_MB"),
+		envInt(&c.Log.MaxBackups, "LOG_MAX_BACKUPS"),
+		envInt(&c.Log.MaxAgeDays, "LOG_MAX_AGE_DAYS"),
+		envInt(&c.Pages.MemberLimit, "MEMBER_PAGE_LIMIT"),
+		envInt(&c.Pages.BookLimit, "BOOK_PAGE_LIMIT"),
+		envFloat(&c.Tracing.SampleRatio, "TRACING_SAMPLE_RATIO"),
+		envBool(&c.Tracing.Insecure, "TRACING_INSECURE"),
+		envBool(&c.Search.FoldKana, "SEARCH_FOLD_KANA"),
+		envDuration(&c.Recommend.Interval, "RECOMMEND_INTERVAL"),
+		envInt(&c.Recommend.BatchSize, "RECOMMEND_BATCH_SIZE"),
+		envDuration(&c.Reminder.Interval, "REMINDER_INTERVAL"),
+		envDuration(&c.Reminder.LeadTime, "REMINDER_LEAD_TIME"),
+		envInt(&c.Reminder.BatchSize, "REMINDER_BATCH_SIZE"),
+		envDuration(&c.Reminder.Timeout, "REMINDER_TIMEOUT"),
+		envDuration(&c.Webhook.Interval, "WEBHOOK_INTERVAL"),
+		envDuration(&c.Webhook.Timeout, "WEBHOOK_TIMEOUT"),
+		envInt(&c.Webhook.MaxAttempts, "WEBHOOK_MAX_ATTEMPTS"),
+		envDuration(&c.Webhook.BackoffBase, "WEBHOOK_BACKOFF_BASE"),
+		envDuration(&c.Webhook.BackoffMax, "WEBHOOK_BACKOFF_MAX"),
+		envInt(&c.Events.BufferSize, "EVENTS_BUFFER_SIZE"),
+		envDuration(&c.Events.Heartbeat, "EVENTS_HEARTBEAT"),
+		envDuration(&c.BanPolicy.Interval, "BAN_POLICY_INTERVAL"),
+		envDuration(&c.BanPolicy.GracePeriod, "BAN_POLICY_GRACE_PERIOD"),
+		envDuration(&c.BanPolicy.SuspendFor, "BAN_POLICY_SUSPEND_FOR"),
+		envBool(&c.BanPolicy.Warn, "BAN_POLICY_WARN"),
+		envDuration(&c.BanPolicy.WarnLead, "BAN_POLICY_WARN_LEAD"),
+		envInt(&c.BanPolicy.BatchSize, "BAN_POLICY_BATCH_SIZE"),
+		envBool(&c.Debug, "DEBUG"),
+		envDuration(&c.Shutdown.Timeout, "SHUTDOWN_TIMEOUT"),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Listen.Address == "" && c.Listen.Socket == "" {
+		return fmt.Errorf("listen address or socket is required")
+	}
+	if c.Pages.MemberLimit <= 0 || c.Pages.BookLimit <= 0 {
+		return fmt.Errorf("page limits must be positive")
+	}
+	if c.Init.Loader != initLoaderNative && c.Init.Loader != initLoaderScript {
+		return fmt.Errorf("unknown init loader %q", c.Init.Loader)
+	}
+	if c.Cache.CounterBackend != counterBackendMemory && c.Cache.CounterBackend != counterBackendDB {
+		return fmt.Errorf("unknown counter backend %q", c.Cache.CounterBackend)
+	}
+	if _, err := c.DB.DataSource(c.Timezone); err != nil {
+		return fmt.Errorf("invalid database url: %w", err)
+	}
+	if c.DB.Dialect() == dialectSQLite {
+		if len(c.DB.ReplicaDSNs) > 0 {
+			return fmt.Errorf("read replicas require MySQL")
+		}
+	}
+	if !slices.Contains(tracingExporters, c.Tracing.Exporter) {
+		return fmt.Errorf("unknown tracing exporter %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+	if c.Tracing.Exporter == tracingExporterFile && c.Tracing.File == "" {
+		return fmt.Errorf("tracing file is required for the file exporter")
+	}
+	if c.Recommend.Interval <= 0 || c.Recommend.BatchSize <= 0 {
+		return fmt.Errorf("recommend interval and batch size must be positive")
+	}
+	if err := c.Reminder.validate(); err != nil {
+		return fmt.Errorf("reminder: %w", err)
+	}
+	if c.Webhook.Interval < 0 {
+		return fmt.Errorf("webhook interval must not be negative")
+	}
+	if c.Webhook.BatchSize <= 0 || c.Webhook.Concurrency <= 0 || c.Webhook.MaxAttempts <= 0 {
+		return fmt.Errorf("webhook batch size, concurrency and max attempts must be positive")
+	}
+	if c.Webhook.Timeout <= 0 || c.Webhook.BackoffBase <= 0 || c.Webhook.BackoffMax < c.Webhook.BackoffBase {
+		return fmt.Errorf("webhook timeout and backoff must be positive, and backoff max must not be less than backoff base")
+	}
+	if c.Events.BufferSize <= 0 || c.Events.Heartbeat <= 0 {
+		return fmt.Errorf("events buffer size and heartbeat must be positive")
+	}
+	if err := c.BanPolicy.validate(); err != nil {
+		return fmt.Errorf("ban policy: %w", err)
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	return nil
+}
+
+// パスワードなどの秘匿情報を伏せた設定
+func (c Config) Redacted() Config {
+	if c.DB.Password != "" {
+		c.DB.Password = "REDACTED"
+	}
+	if c.Tracing.UptraceDSN != "" {
+		c.Tracing.UptraceDSN = "REDACTED"
+	}
+	if c.Reminder.SMTP.Password != "" {
+		c.Reminder.SMTP.Password = "REDACTED"
+	}
+	if c.DB.Dialect() == dialectMySQL && c.DB.URL != "" {
+		c.DB.URL = "REDACTED"
+	}
+	if len(c.DB.ReplicaDSNs) > 0 {
+		replicas := make(stringList, len(c.DB.ReplicaDSNs))
+		for i := range replicas {
+			replicas[i] = "REDACTED"
+		}
+		c.DB.ReplicaDSNs = replicas
+	}
+	return c
+}
+
+func (c ReminderConfig) validate() error {
+	if !slices.Contains(reminderNotifiers, c.Notifier) {
+		return fmt.Errorf("unknown notifier %q", c.Notifier)
+	}
+	if c.Interval < 0 || c.LeadTime < 0 || c.Timeout < 0 {
+		return fmt.Errorf("interval, lead time and timeout must not be negative")
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	switch c.Notifier {
+	case notifierWebhook:
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("webhook url must be an http(s) URL")
+		}
+	case notifierSMTP:
+		if c.SMTP.Host == "" || c.SMTP.From == "" {
+			return fmt.Errorf("smtp host and from are required for the smtp notifier")
+		}
+	}
+	if _, err := parseReminderTemplates(c.Templates); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c BanPolicyConfig) validate() error {
+	if !slices.Contains(banActions, c.Action) {
+		return fmt.Errorf("unknown action %q", c.Action)
+	}
+	if c.Interval < 0 || c.GracePeriod < 0 || c.WarnLead < 0 {
+		return fmt.Errorf("interval, grace period and warn lead must not be negative")
+	}
+	if c.Action == banActionSuspend && c.SuspendFor <= 0 {
+		return fmt.Errorf("suspend for must be positive")
+	}
+	if c.Warn && c.WarnLead <= 0 {
+		return fmt.Errorf("warn lead must be positive when warn is enabled")
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	return nil
+}
+
+// カンマ区切りで指定する文字列のリスト
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(val string) error {
+	*l = nil
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func envString(dst *string, key string) {
+	if val := os.Getenv(key); val != "" {
+		*dst = val
+	}
+}
+
+func envInt(dst *int, key string) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = i
+	return nil
+}
+
+func envFloat(dst *float64, key string) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = f
+	return nil
+}
+
+func envBool(dst *bool, key string) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func envDuration(dst *time.Duration, key string) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = d
+	return nil
+}
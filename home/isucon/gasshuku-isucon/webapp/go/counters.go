@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+---------------------------------------------------------------
+Counters
+---------------------------------------------------------------
+*/
+
+// レスポンスのTotalに使うカウンタ
+type counterKey string
+
+const counterNotBannedMembers counterKey = "not_banned_members"
+
+// 図書分類ごとの蔵書数のカウンタ
+func bookGenreCounterKey(genre Genre) counterKey {
+	return counterKey("books_genre_" + strconv.Itoa(int(genre)))
+}
+
+// 全カウンタ
+func allCounterKeys() []counterKey {
+	keys := []counterKey{counterNotBannedMembers}
+	for genre := General; genre <= Geography; genre++ {
+		keys = append(keys, bookGenreCounterKey(genre))
+	}
+	return keys
+}
+
+// トランザクションでまとめて反映するカウンタの増減
+type counterDeltas map[counterKey]int64
+
+func (d counterDeltas) add(key counterKey, delta int64) {
+	d[key] += delta
+}
+
+// カウンタの保存先
+// 更新はトランザクション内で Apply、コミット後に Committed を呼ぶ (runCounterTx を使う)
+// プロセス内の実装は Committed で、DBの実装は Apply で値を反映する
+type counterStore interface {
+	Get(ctx context.Context, key counterKey) (int64, error)
+	// DBの実装は q で読む (照合では数え直すのと同じトランザクションで読む)
+	Snapshot(ctx context.Context, q sqlx.QueryerContext) (map[counterKey]int64, error)
+	Apply(ctx context.Context, tx *sqlx.Tx, deltas counterDeltas) error
+	Committed(deltas counterDeltas)
+	// DBから数え直した値で置き換える
+	Reset(ctx context.Context, values map[counterKey]int64) error
+	// 値を増減する (照合での補正用)
+	Add(ctx context.Context, key counterKey, delta int64) error
+	// 複数のインスタンスで共有しているか
+	Shared() bool
+}
+
+// プロセス内のカウンタは、コミットしてから Committed で反映するまでの間DBと食い違う
+// 照合がその間の値を読むと増減を二重に補正してしまうので、
+// カウンタを変えるトランザクションはコミットから Committed までだけを読み取りロックし、
+// 照合は書き込みロックの間に、カウンタの値とDBのスナップショットを揃えて取る
+var counterCommitLock sync.RWMutex
+
+// カウンタを増減するトランザクション
+// fn の後で Apply し、コミットできたら Committed する
+func runCounterTx(ctx context.Context, deltas counterDeltas, fn func(tx *sqlx.Tx) error) error {
+	return retryTx(ctx, func() error {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := counters.Apply(ctx, tx, deltas); err != nil {
+			return err
+		}
+
+		if !counters.Shared() {
+			counterCommitLock.RLock()
+			defer counterCommitLock.RUnlock()
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		counters.Committed(deltas)
+		return nil
+	})
+}
+
+// カウンタの保存先
+const (
+	counterBackendMemory = "memory"
+	counterBackendDB     = "db"
+)
+
+var counters counterStore = newMemoryCounterStore()
+
+func newCounterStore(backend string) counterStore {
+	if backend == counterBackendDB {
+		return &dbCounterStore{}
+	}
+	return newMemoryCounterStore()
+}
+
+// プロセス内のカウンタ
+// 1プロセスで動かす場合はこちらの方が速い
+type memoryCounterStore struct {
+	values map[counterKey]*atomic.Int64
+}
+
+func newMemoryCounterStore() *memoryCounterStore {
+	s := &memoryCounterStore{values: map[counterKey]*atomic.Int64{}}
+	for _, key := range allCounterKeys() {
+		s.values[key] = new(atomic.Int64)
+	}
+	return s
+}
+
+func (s *memoryCounterStore) Get(_ context.Context, key counterKey) (int64, error) {
+	v, ok := s.values[key]
+	if !ok {
+		return 0, fmt.Errorf("unknown counter %q", key)
+	}
+	return v.Load(), nil
+}
+
+func (s *memoryCounterStore) Snapshot(context.Context, sqlx.QueryerContext) (map[counterKey]int64, error) {
+	snapshot := make(map[counterKey]int64, len(s.values))
+	for key, v := range s.values {
+		snapshot[key] = v.Load()
+	}
+	return snapshot, nil
+}
+
+func (s *memoryCounterStore) Shared() bool {
+	return false
+}
+
+func (s *memoryCounterStore) Apply(context.Context, *sqlx.Tx, counterDeltas) error {
+	return nil
+}
+
+func (s *memoryCounterStore) Committed(deltas counterDeltas) {
+	for key, delta := range deltas {
+		if v, ok := s.values[key]; ok {
+			v.Add(delta)
+		}
+	}
+}
+
+func (s *memoryCounterStore) Reset(_ context.Context, values map[counterKey]int64) error {
+	for key, v := range s.values {
+		v.Store(values[key])
+	}
+	return nil
+}
+
+func (s *memoryCounterStore) Add(_ context.Context, key counterKey, delta int64) error {
+	v, ok := s.values[key]
+	if !ok {
+		return fmt.Errorf("unknown counter %q", key)
+	}
+	v.Add(delta)
+	return nil
+}
+
+// statsテーブルに保存するカウンタ
+// 更新は各ハンドラのトランザクション内で行うので、複数のプロセスから使っても値がずれない
+type dbCounterStore struct{}
+
+func (s *dbCounterStore) Get(ctx context.Context, key counterKey) (int64, error) {
+	var value int64
+	err := db.GetContext(ctx, &value, "SELECT `value` FROM `stats` WHERE `name` = ?", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return value, err
+}
+
+func (s *dbCounterStore) Snapshot(ctx context.Context, q sqlx.QueryerContext) (map[counterKey]int64, error) {
+	var rows []struct {
+		Name  counterKey `db:"name"`
+		Value int64      `db:"value"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, "SELECT `name`, `value` FROM `stats` WHERE `name` != ?", cacheEpochStatName); err != nil {
+		return nil, err
+	}
+	snapshot := make(map[counterKey]int64, len(rows))
+	for _, key := range allCounterKeys() {
+		snapshot[key] = 0
+	}
+	for _, row := range rows {
+		snapshot[row.Name] = row.Value
+	}
+	return snapshot, nil
+}
+
+func (s *dbCounterStore) Shared() bool {
+	return true
+}
+
+func (s *dbCounterStore) Apply(ctx context.Context, tx *sqlx.Tx, deltas counterDeltas) error {
+	for key, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		_, err := tx.ExecContext(ctx,
+			statsAddQuery(), key, delta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dbCounterStore) Committed(counterDeltas) {}
+
+func (s *dbCounterStore) Reset(ctx context.Context, values map[counterKey]int64) error {
+	return runInTx(ctx, nil, func(tx *sqlx.Tx) error {
+		for _, key := range allCounterKeys() {
+			_, err := tx.ExecContext(ctx,
+				statsSetQuery(), key, values[key])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *dbCounterStore) Add(ctx context.Context, key counterKey, delta int64) error {
+	_, err := db.ExecContext(ctx, statsAddQuery(), key, delta)
+	return err
+}
+
+// DBから各カウンタの正しい値を数える
+// q がトランザクションなら、そのスナップショットでの値になる
+func countFromDB(ctx context.Context, q sqlx.QueryerContext) (map[counterKey]int64, error) {
+	values := map[counterKey]int64{}
+	for _, key := range allCounterKeys() {
+		values[key] = 0
+	}
+
+	var notBanned int64
+	if err := sqlx.GetContext(ctx, q, &notBanned, "SELECT COUNT(*) FROM `member` WHERE `banned` = false"); err != nil {
+		return nil, err
+	}
+	var genreCounts []genreCount
+	if err := sqlx.SelectContext(ctx, q, &genreCounts, "SELECT genre, count(1) as c FROM `book` GROUP BY genre order by genre"); err != nil {
+		return nil, err
+	}
+
+	values[counterNotBannedMembers] = notBanned
+	for _, genreCount := range genreCounts {
+		values[bookGenreCounterKey(genreCount.Genre)] = genreCount.Count
+	}
+	return values, nil
+}
+
+/*
+---------------------------------------------------------------
+Cross-instance Invalidation
+---------------------------------------------------------------
+*/
+
+// 初期化のたびに更新する世代番号
+// 他のインスタンスはこれを監視して、変わったら鍵とキャッシュを読み直す
+const cacheEpochStatName = "cache_epoch"
+
+var cacheEpoch atomic.Int64
+
+// 世代番号を進めて他のインスタンスに知らせる
+func bumpCacheEpoch(ctx context.Context) error {
+	epoch := time.Now().UnixNano()
+	_, err := db.ExecContext(ctx,
+		statsSetQuery(), cacheEpochStatName, epoch)
+	if err != nil {
+		return err
+	}
+	cacheEpoch.Store(epoch)
+	return nil
+}
+
+// 定期的に世代番号を確認し、他のインスタンスが初期化していたら読み直す
+func startInvalidationWatcher(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if job := currentInitializeJob.Load(); job != nil && job.Running() {
+				continue
+			}
+			if err := checkCacheEpoch(ctx); err != nil {
+				appLogger.Error("cache invalidation check failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// 現在の世代番号 (まだ初期化されていなければ0)
+func readCacheEpoch(ctx context.Context) (int64, error) {
+	var epoch int64
+	err := db.GetContext(ctx, &epoch, "SELECT `value` FROM `stats` WHERE `name` = ?", cacheEpochStatName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return epoch, err
+}
+
+func checkCacheEpoch(ctx context.Context) error {
+	epoch, err := readCacheEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	if epoch == 0 {
+		// 他のインスタンスが初期化中 (スキーマを作り直している)
+		cachesReady.Store(false)
+		return nil
+	}
+	if epoch == cacheEpoch.Load() {
+		return nil
+	}
+
+	appLogger.Info("cache epoch changed, reloading", slog.Int64("epoch", epoch))
+	if err := loadKey(ctx); err != nil {
+		return err
+	}
+	if err := syncCaches(ctx); err != nil {
+		return err
+	}
+	invalidateWebhookSubscriptions()
+	cacheEpoch.Store(epoch)
+	return nil
+}
+
+// 最新の鍵を読み込む
+func loadKey(ctx context.Context) error {
+	var key string
+	err := db.GetContext(ctx, &key, "SELECT `key` FROM `key` WHERE `id` = (SELECT MAX(`id`) FROM `key`)")
+	if err != nil {
+		return err
+	}
+
+	newBlock, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return err
+	}
+	block = newBlock
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+---------------------------------------------------------------
+Library Events
+---------------------------------------------------------------
+*/
+
+// 会員・蔵書・貸出の変更を外部に知らせるイベント
+// ハンドラはトランザクションの中で enqueueEvents を呼び、変更と同時にwebhookの送信待ちに積む
+// コミットできたら publishEvents で /api/events のストリームにも流す
+
+// イベントの種類
+const (
+	eventMemberCreated   = "member.created"
+	eventMemberBanned    = "member.banned"
+	eventMemberSuspended = "member.suspended"
+	eventBookCreated     = "book.created"
+	eventLendingCreated  = "lending.created"
+	eventLendingReturned = "lending.returned"
+)
+
+var eventTypes = []string{
+	eventMemberCreated,
+	eventMemberBanned,
+	eventMemberSuspended,
+	eventBookCreated,
+	eventLendingCreated,
+	eventLendingReturned,
+}
+
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+func newEvent(eventType string, data any) Event {
+	return Event{
+		ID:        generateID(),
+		Type:      eventType,
+		CreatedAt: currentTime(),
+		Data:      data,
+	}
+}
+
+type MemberBannedEvent struct {
+	MemberID string `json:"member_id"`
+	// manual: DELETE /api/members/:id, policy: 延滞による自動BAN
+	Source string `json:"source"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type MemberSuspendedEvent struct {
+	MemberID  string    `json:"member_id"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type LendingReturnedEvent struct {
+	Lending
+	ReturnedAt time.Time `json:"returned_at"`
+}
+
+// イベントを購読しているwebhookの送信待ちに積む
+func enqueueEvents(ctx context.Context, tx *sqlx.Tx, events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return enqueueWebhookDeliveries(ctx, tx, events)
+}
+
+// コミットした後でストリームに流す
+// (webhookと違って送り直しはしないので、ロールバックされたイベントを流さないようにする)
+func publishEvents(events ...Event) {
+	eventHub.Publish(events...)
+}
+
+// イベントの対象の会員・蔵書 (絞り込みに使う)
+func (e Event) subjects() (memberID, bookID string) {
+	switch data := e.Data.(type) {
+	case Member:
+		return data.ID, ""
+	case MemberBannedEvent:
+		return data.MemberID, ""
+	case MemberSuspendedEvent:
+		return data.MemberID, ""
+	case Book:
+		return "", data.ID
+	case PostLendingsResponse:
+		return data.MemberID, data.BookID
+	case LendingReturnedEvent:
+		return data.MemberID, data.BookID
+	}
+	return "", ""
+}
+
+/* --- Event Stream --- */
+
+// 直近のイベントを持つリングバッファと購読者
+// インスタンスごとに持つので、流れるのはそのインスタンスで起きたイベントだけ
+//
+// イベントのIDはコミット前に振るので、コミットの順 (流す順) とは前後することがある
+// そのためストリームのID (Last-Event-ID) には流した順の連番を使い、
+// プロセスごとのIDを前に付けて "<ストリームID>.<連番>" とする
+type eventStream struct {
+	id string
+
+	mu     sync.Mutex
+	buf    []streamedEvent
+	start  int
+	n      int
+	seq    uint64
+	subs   map[chan streamedEvent]struct{}
+	closed bool
+}
+
+type streamedEvent struct {
+	seq   uint64
+	event Event
+}
+
+var eventHub *eventStream
+
+// 購読者ごとに溜められるイベントの数
+// 溜まりきった (読むのが遅い) 購読者は切断し、Last-Event-ID で再接続させる
+const eventSubscriberBuffer = 256
+
+func newEventStream(size int) *eventStream {
+	return &eventStream{
+		id:   generateID(),
+		buf:  make([]streamedEvent, size),
+		subs: map[chan streamedEvent]struct{}{},
+	}
+}
+
+func (s *eventStream) Publish(events ...Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	for _, event := range events {
+		s.seq++
+		e := streamedEvent{seq: s.seq, event: event}
+		if s.n == len(s.buf) {
+			s.buf[s.start] = e
+			s.start = (s.start + 1) % len(s.buf)
+		} else {
+			s.buf[(s.start+s.n)%len(s.buf)] = e
+			s.n++
+		}
+
+		for ch := range s.subs {
+			select {
+			case ch <- e:
+			default:
+				delete(s.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+func (s *eventStream) eventID(seq uint64) string {
+	return s.id + "." + strconv.FormatUint(seq, 10)
+}
+
+// 購読を始め、lastEventID より後のバッファ内のイベントを返す
+// gap は続きを送れないこと (バッファから押し出された、別のプロセスのIDなど)
+func (s *eventStream) Subscribe(lastEventID string) (ch chan streamedEvent, replay []streamedEvent, gap bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch = make(chan streamedEvent, eventSubscriberBuffer)
+	if s.closed {
+		close(ch)
+		return ch, nil, false
+	}
+	s.subs[ch] = struct{}{}
+
+	if lastEventID == "" {
+		return ch, nil, false
+	}
+	streamID, seqStr, _ := strings.Cut(lastEventID, ".")
+	last, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || streamID != s.id || last > s.seq {
+		return ch, nil, true
+	}
+	for i := 0; i < s.n; i++ {
+		e := s.buf[(s.start+i)%len(s.buf)]
+		if e.seq > last {
+			replay = append(replay, e)
+		}
+	}
+	// 続きの最初のイベントがもうバッファにない
+	gap = last < s.seq && (len(replay) == 0 || replay[0].seq != last+1)
+	return ch, replay, gap
+}
+
+func (s *eventStream) Unsubscribe(ch chan streamedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[ch]; ok {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// シャットダウン時にすべてのストリームを閉じる
+func (s *eventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+/* --- Events API --- */
+
+// イベントの絞り込み
+type eventFilter struct {
+	types    []string
+	memberID string
+	bookID   string
+}
+
+func (f eventFilter) match(e Event) bool {
+	if len(f.types) > 0 && !slices.Contains(f.types, e.Type) {
+		return false
+	}
+	memberID, bookID := e.subjects()
+	if f.memberID != "" && memberID != f.memberID {
+		return false
+	}
+	if f.bookID != "" && bookID != f.bookID {
+		return false
+	}
+	return true
+}
+
+// 取りこぼしがあったときに送るイベント
+// 受け取ったら一覧を取り直してもらう
+const eventStreamReset = "reset"
+
+// イベントをServer-Sent Eventsで流す
+// types (カンマ区切り), member_id, book_id で絞り込める
+// 再接続時は Last-Event-ID (EventSourceの初回接続では last_event_id) 以降をバッファから送り直す
+func getEventsHandler(c echo.Context) error {
+	var filter eventFilter
+	if types := c.QueryParam("types"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			if !slices.Contains(eventTypes, t) {
+				return echo.NewHTTPError(http.StatusBadRequest, "unknown event type: "+t)
+			}
+			filter.types = append(filter.types, t)
+		}
+	}
+	filter.memberID = c.QueryParam("member_id")
+	filter.bookID = c.QueryParam("book_id")
+
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+
+	ch, replay, gap := eventHub.Subscribe(lastEventID)
+	defer eventHub.Unsubscribe(ch)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginxにバッファさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	if gap {
+		if _, err := fmt.Fprintf(res, "event: %s\ndata: {}\n\n", eventStreamReset); err != nil {
+			return nil
+		}
+	}
+	var lastSent uint64
+	for _, e := range replay {
+		if err := writeEvent(res, filter, e); err != nil {
+			return nil
+		}
+		lastSent = e.seq
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(cfg.Events.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := io.WriteString(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case e, ok := <-ch:
+			if !ok {
+				// 読むのが遅くて切断されたか、シャットダウン
+				return nil
+			}
+			// 送り直した分と重なったものは飛ばす
+			if e.seq <= lastSent {
+				continue
+			}
+			if err := writeEvent(res, filter, e); err != nil {
+				return nil
+			}
+			lastSent = e.seq
+		}
+		res.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, filter eventFilter, e streamedEvent) error {
+	if !filter.match(e.event) {
+		return nil
+	}
+	data, err := json.Marshal(e.event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", eventHub.eventID(e.seq), e.event.Type, data)
+	return err
+}
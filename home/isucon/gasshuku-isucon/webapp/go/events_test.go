@@ -0,0 +1,183 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// n件のイベントを流したストリーム (バッファは size 件)
+func newTestEventStream(size, n int) *eventStream {
+	s := newEventStream(size)
+	for i := 1; i <= n; i++ {
+		s.Publish(Event{ID: "E" + strconv.Itoa(i), Type: eventBookCreated})
+	}
+	return s
+}
+
+func streamedSeqs(events []streamedEvent) []uint64 {
+	var seqs []uint64
+	for _, e := range events {
+		seqs = append(seqs, e.seq)
+	}
+	return seqs
+}
+
+func TestEventStreamSubscribe(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		published   int
+		lastEventID func(s *eventStream) string
+		wantReplay  []uint64
+		wantGap     bool
+	}{
+		{
+			name:        "new subscriber",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return "" },
+		},
+		{
+			name:        "up to date",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return s.eventID(3) },
+		},
+		{
+			name:        "replay the rest",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return s.eventID(1) },
+			wantReplay:  []uint64{2, 3},
+		},
+		{
+			name:        "replay from before the first event",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return s.eventID(0) },
+			wantReplay:  []uint64{1, 2, 3},
+		},
+		{
+			name:        "replay after the buffer wrapped",
+			size:        4,
+			published:   6,
+			lastEventID: func(s *eventStream) string { return s.eventID(2) },
+			wantReplay:  []uint64{3, 4, 5, 6},
+		},
+		{
+			name:        "pushed out of the buffer",
+			size:        4,
+			published:   6,
+			lastEventID: func(s *eventStream) string { return s.eventID(1) },
+			wantReplay:  []uint64{3, 4, 5, 6},
+			wantGap:     true,
+		},
+		{
+			name:        "all pushed out of the buffer",
+			size:        2,
+			published:   6,
+			lastEventID: func(s *eventStream) string { return s.eventID(0) },
+			wantReplay:  []uint64{5, 6},
+			wantGap:     true,
+		},
+		{
+			name:        "another process",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return "01OTHERPROCESS.1" },
+			wantGap:     true,
+		},
+		{
+			name:        "ahead of the stream",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return s.eventID(4) },
+			wantGap:     true,
+		},
+		{
+			name:        "malformed",
+			size:        4,
+			published:   3,
+			lastEventID: func(s *eventStream) string { return s.id },
+			wantGap:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestEventStream(tt.size, tt.published)
+			ch, replay, gap := s.Subscribe(tt.lastEventID(s))
+			defer s.Unsubscribe(ch)
+
+			if got := streamedSeqs(replay); !reflect.DeepEqual(got, tt.wantReplay) {
+				t.Errorf("replay = %v, want %v", got, tt.wantReplay)
+			}
+			if gap != tt.wantGap {
+				t.Errorf("gap = %v, want %v", gap, tt.wantGap)
+			}
+			for _, e := range replay {
+				if want := "E" + strconv.FormatUint(e.seq, 10); e.event.ID != want {
+					t.Errorf("event %d = %s, want %s", e.seq, e.event.ID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEventStreamPublishAfterSubscribe(t *testing.T) {
+	s := newTestEventStream(4, 2)
+	ch, _, _ := s.Subscribe(s.eventID(2))
+	s.Publish(Event{ID: "E3"}, Event{ID: "E4"})
+
+	for _, want := range []uint64{3, 4} {
+		e := <-ch
+		if e.seq != want {
+			t.Errorf("seq = %d, want %d", e.seq, want)
+		}
+	}
+
+	s.Unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Errorf("channel is open after Unsubscribe")
+	}
+	// 二重に外しても閉じ直さない
+	s.Unsubscribe(ch)
+}
+
+func TestEventStreamDropsSlowSubscriber(t *testing.T) {
+	s := newEventStream(eventSubscriberBuffer * 2)
+	ch, _, _ := s.Subscribe("")
+	for i := 0; i <= eventSubscriberBuffer; i++ {
+		s.Publish(Event{ID: "E" + strconv.Itoa(i)})
+	}
+
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != eventSubscriberBuffer {
+		t.Errorf("received %d events before being dropped, want %d", n, eventSubscriberBuffer)
+	}
+
+	// 切断された購読者は Last-Event-ID で続きから受け取れる
+	_, replay, gap := s.Subscribe(s.eventID(uint64(n)))
+	if gap || len(replay) != 1 || replay[0].seq != uint64(n+1) {
+		t.Errorf("replay = %v, gap = %v, want [%d] without gap", streamedSeqs(replay), gap, n+1)
+	}
+}
+
+func TestEventStreamClose(t *testing.T) {
+	s := newTestEventStream(4, 1)
+	ch, _, _ := s.Subscribe("")
+	s.Close()
+	if _, ok := <-ch; ok {
+		t.Errorf("channel is open after Close")
+	}
+
+	ch, replay, gap := s.Subscribe(s.eventID(0))
+	if _, ok := <-ch; ok || replay != nil || gap {
+		t.Errorf("subscribe after Close: open = %v, replay = %v, gap = %v", ok, replay, gap)
+	}
+	s.Publish(Event{ID: "E2"})
+}
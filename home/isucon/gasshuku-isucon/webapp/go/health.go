@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+---------------------------------------------------------------
+Health Check & Shutdown
+---------------------------------------------------------------
+*/
+
+// readyzでDBへのpingを待つ時間
+const readinessTimeout = time.Second
+
+// シャットダウン中はreadyzを失敗させてロードバランサから外してもらう
+var shuttingDown atomic.Bool
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// プロセスが生きているか
+func healthzHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// リクエストを受け付けられる状態か
+// DBへの疎通、暗号鍵の読み込み、インメモリキャッシュの構築を確認する
+func readyzHandler(c echo.Context) error {
+	checks := map[string]string{}
+	ready := true
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	if shuttingDown.Load() {
+		fail("server", errors.New("shutting down"))
+	} else {
+		checks["server"] = "ok"
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		fail("database", err)
+	} else {
+		checks["database"] = "ok"
+	}
+
+	if block == nil {
+		fail("key", errors.New("key is not loaded"))
+	} else {
+		checks["key"] = "ok"
+	}
+
+	if !cachesLoaded() {
+		fail("cache", errors.New("caches are not populated"))
+	} else {
+		checks["cache"] = "ok"
+	}
+
+	if !ready {
+		return c.JSON(http.StatusServiceUnavailable, ReadinessResponse{Status: "unavailable", Checks: checks})
+	}
+	return c.JSON(http.StatusOK, ReadinessResponse{Status: "ok", Checks: checks})
+}
+
+// サーバーを起動し、SIGTERM/SIGINTを受けたら処理中のリクエストを待ってから停止する
+func startServer(e *echo.Echo, listen ListenConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	address := listen.Address
+	if listen.Socket != "" {
+		// 前回のソケットファイルが残っているとlistenできない
+		_ = os.Remove(listen.Socket)
+		listener, err := net.Listen("unix", listen.Socket)
+		if err != nil {
+			return err
+		}
+		// nginxなど別ユーザーのプロセスから接続できるようにする
+		if err := os.Chmod(listen.Socket, 0o777); err != nil {
+			return err
+		}
+		e.Listener = listener
+		address = ""
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Start(address)
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	e.Logger.Info("shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+
+	return e.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+---------------------------------------------------------------
+Initialize Job
+---------------------------------------------------------------
+*/
+
+// 初期化ジョブの状態
+const (
+	initializeJobRunning   = "running"
+	initializeJobSucceeded = "succeeded"
+	initializeJobFailed    = "failed"
+)
+
+// 初期化中に503を返す間隔の目安 (Retry-After)
+const initializeRetryAfterSeconds = "1"
+
+type initializeJob struct {
+	ID        string
+	StartedAt time.Time
+	progress  *loadProgress
+	done      chan struct{}
+
+	mu         sync.Mutex
+	status     string
+	err        error
+	finishedAt time.Time
+}
+
+func (j *initializeJob) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+func (j *initializeJob) Running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status == initializeJobRunning
+}
+
+// 最後に開始した初期化ジョブ
+var currentInitializeJob atomic.Pointer[initializeJob]
+
+var errInitializeRunning = errors.New("initialize is already running")
+
+// 初期化ジョブが実行中か
+func initializeRunning() bool {
+	job := currentInitializeJob.Load()
+	return job != nil && job.Running()
+}
+
+// 初期化ジョブをバックグラウンドで開始する
+// リクエストのコンテキストとは切り離して最後まで実行する
+func startInitializeJob(run func(ctx context.Context, progress *loadProgress) error) (*initializeJob, error) {
+	job := &initializeJob{
+		ID:        generateID(),
+		StartedAt: currentTime(),
+		progress:  &loadProgress{},
+		done:      make(chan struct{}),
+		status:    initializeJobRunning,
+	}
+
+	for {
+		prev := currentInitializeJob.Load()
+		if prev != nil && prev.Running() {
+			return nil, errInitializeRunning
+		}
+		if currentInitializeJob.CompareAndSwap(prev, job) {
+			break
+		}
+	}
+
+	go func() {
+		defer close(job.done)
+		err := run(context.Background(), job.progress)
+
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		job.finishedAt = currentTime()
+		job.err = err
+		if err != nil {
+			job.status = initializeJobFailed
+		} else {
+			job.status = initializeJobSucceeded
+		}
+	}()
+
+	return job, nil
+}
+
+type InitializeStatusResponse struct {
+	JobID      string     `json:"job_id"`
+	Status     string     `json:"status"`
+	Phase      string     `json:"phase"`
+	Percent    float64    `json:"percent"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// 初期化ジョブの進捗を取得
+func getInitializeStatusHandler(c echo.Context) error {
+	job := currentInitializeJob.Load()
+	if job == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no initialize job")
+	}
+
+	job.mu.Lock()
+	res := InitializeStatusResponse{
+		JobID:     job.ID,
+		Status:    job.status,
+		Phase:     job.progress.Phase(),
+		Percent:   job.progress.Percent(),
+		StartedAt: job.StartedAt,
+	}
+	if job.err != nil {
+		res.Error = job.err.Error()
+	}
+	if !job.finishedAt.IsZero() {
+		finishedAt := job.finishedAt
+		res.FinishedAt = &finishedAt
+	}
+	job.mu.Unlock()
+
+	if res.Status == initializeJobSucceeded {
+		res.Percent = 100
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 初期化中は初期化・監視用以外のエンドポイントに503を返す
+func initializeGuardMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !initializeRunning() {
+			return next(c)
+		}
+
+		path := c.Path()
+		switch {
+		case strings.HasPrefix(path, "/api/initialize"),
+			path == "/healthz", path == "/readyz", path == "/metrics":
+			return next(c)
+		}
+
+		c.Response().Header().Set(echo.HeaderRetryAfter, initializeRetryAfterSeconds)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "initialize is in progress")
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/sync/errgroup"
+)
+
+/*
+---------------------------------------------------------------
+Labels API
+---------------------------------------------------------------
+*/
+
+// 会員証・蔵書ラベルをA4の台紙に並べて出力する
+// 台紙は300dpiの画像として描き、PDFにはその画像をページごとに埋め込む
+// 台紙1枚の画像は約8.7MBあるので、1枚ずつ描いては書き出し、同じ画像に次のページを描く
+
+// 1回に出力できるIDの数
+const maxLabelIDs = 1000
+
+// 台紙の解像度
+const labelDPI = 300
+
+// A4 (mm)
+const (
+	a4Width  = 210.0
+	a4Height = 297.0
+)
+
+func mmToPx(mm float64) int {
+	return int(mm * labelDPI / 25.4)
+}
+
+// 台紙の割り付け (mm)
+type labelLayout struct {
+	Cols, Rows       int
+	CellW, CellH     float64
+	MarginX, MarginY float64
+	Padding          float64
+	// QRコードの最大の幅 (IDが省略されずに収まるよう文字の幅を残す)
+	MaxQR float64
+	// 文字の大きさ (pt)
+	TitleSize, TextSize float64
+}
+
+func (l labelLayout) perPage() int {
+	return l.Cols * l.Rows
+}
+
+var (
+	// 名刺サイズ (91x55mm) を2列5段
+	memberCardLayout = labelLayout{Cols: 2, Rows: 5, CellW: 91, CellH: 55, MarginX: 14, MarginY: 11, Padding: 3, MaxQR: 34, TitleSize: 12, TextSize: 7}
+	// 70x37mmを3列8段 (市販の24面ラベル)
+	bookLabelLayout = labelLayout{Cols: 3, Rows: 8, CellW: 70, CellH: 37, MarginX: 0, MarginY: 0.5, Padding: 2, MaxQR: 21, TitleSize: 9, TextSize: 7}
+)
+
+// 1枚分のラベル
+type label struct {
+	ID string
+	// 会員名・タイトル
+	Title string
+	// IDや分類など、タイトルの下に小さく印字する行
+	Lines []string
+}
+
+// 図書分類の名前
+var genreNames = [...]string{
+	General:         "総記",
+	Philosophy:      "哲学・心理学",
+	Religion:        "宗教・神学",
+	SocialScience:   "社会科学",
+	Vacant:          "未定義",
+	Mathematics:     "数学・自然科学",
+	AppliedSciences: "応用科学・医学・工学",
+	Arts:            "芸術",
+	Literature:      "言語・文学",
+	Geography:       "地理・歴史",
+}
+
+// 請求記号 (分類番号/著者記号)
+// 著者記号は読み仮名があればその1文字目、なければ著者名の1文字目
+func callNumber(book Book) string {
+	author := book.AuthorReading
+	if author == "" {
+		author = book.Author
+	}
+	r, _ := utf8.DecodeRuneInString(author)
+	return fmt.Sprintf("%d/%c", book.Genre, r)
+}
+
+/* --- Fonts --- */
+
+// 印字するフォント (nilなら日本語のフォントがなく、ラベルを出力できない)
+var labelFont *opentype.Font
+
+// -label-font を指定しなかったときに探すフォント
+var labelFontCandidates = []string{
+	"/usr/share/fonts/opentype/noto/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/opentype/ipaexfont-gothic/ipaexg.ttf",
+	"/usr/share/fonts/truetype/fonts-japanese-gothic.ttf",
+	"/usr/share/fonts/google-noto-cjk/NotoSansCJK-Regular.ttc",
+}
+
+// 会員名・タイトル・分類名・省略記号を印字できるか確かめる文字
+const labelFontSample = "会員証蔵書あアｱ…"
+
+// ラベルのフォントを読み込む (起動時)
+// 指定したフォントで日本語を印字できなければエラーにする (Goのフォントで代用すると文字が豆腐になる)
+func initLabelFont() error {
+	if cfg.Paths.LabelFont != "" {
+		f, err := loadLabelFont(cfg.Paths.LabelFont)
+		if err != nil {
+			return fmt.Errorf("label font %s: %w", cfg.Paths.LabelFont, err)
+		}
+		labelFont = f
+		return nil
+	}
+	for _, path := range labelFontCandidates {
+		if f, err := loadLabelFont(path); err == nil {
+			labelFont = f
+			return nil
+		}
+	}
+	appLogger.Warn("labels: no Japanese font found; set -label-font to enable member cards and book labels")
+	return nil
+}
+
+// TrueType/OpenType のフォントを読み込む (コレクションなら1つ目)
+func loadLabelFont(path string) (*opentype.Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, err
+	}
+	f, err := collection.Font(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf sfnt.Buffer
+	for _, r := range labelFontSample {
+		if i, err := f.GlyphIndex(&buf, r); err != nil || i == 0 {
+			return nil, fmt.Errorf("font has no glyph for %q", r)
+		}
+	}
+	return f, nil
+}
+
+func labelFace(size float64) (font.Face, error) {
+	return opentype.NewFace(labelFont, &opentype.FaceOptions{Size: size, DPI: labelDPI, Hinting: font.HintingFull})
+}
+
+/* --- Rendering --- */
+
+// ラベルを描く
+type labelRenderer struct {
+	layout    labelLayout
+	titleFace font.Face
+	textFace  font.Face
+}
+
+func newLabelRenderer(layout labelLayout) (*labelRenderer, error) {
+	titleFace, err := labelFace(layout.TitleSize)
+	if err != nil {
+		return nil, err
+	}
+	textFace, err := labelFace(layout.TextSize)
+	if err != nil {
+		return nil, err
+	}
+	return &labelRenderer{layout: layout, titleFace: titleFace, textFace: textFace}, nil
+}
+
+func (r *labelRenderer) pageCount(labels []label) int {
+	return (len(labels) + r.layout.perPage() - 1) / r.layout.perPage()
+}
+
+// 台紙の画像 (ページごとに drawPage で描き直して使う)
+func newLabelPage() *image.Gray {
+	return image.NewGray(image.Rect(0, 0, mmToPx(a4Width), mmToPx(a4Height)))
+}
+
+// n枚目 (0始まり) の台紙を描く
+func (r *labelRenderer) drawPage(page *image.Gray, n int, labels []label, qrCodes map[string]image.Image) *image.Gray {
+	start := n * r.layout.perPage()
+	end := min(start+r.layout.perPage(), len(labels))
+
+	draw.Draw(page, page.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, l := range labels[start:end] {
+		col, row := i%r.layout.Cols, i/r.layout.Cols
+		x := mmToPx(r.layout.MarginX + float64(col)*r.layout.CellW)
+		y := mmToPx(r.layout.MarginY + float64(row)*r.layout.CellH)
+		cell := image.Rect(x, y, x+mmToPx(r.layout.CellW), y+mmToPx(r.layout.CellH))
+		r.draw(page, cell, l, qrCodes[l.ID])
+	}
+	return page
+}
+
+// 1枚分を単独の画像として描く (ZIP用)
+func (r *labelRenderer) single(l label, qrCode image.Image) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, mmToPx(r.layout.CellW), mmToPx(r.layout.CellH)))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	r.draw(img, img.Bounds(), l, qrCode)
+	return img
+}
+
+// 切り取り線の色
+var labelGuideColor = color.Gray{Y: 0xd0}
+
+func (r *labelRenderer) draw(dst *image.Gray, cell image.Rectangle, l label, qrCode image.Image) {
+	// 切り取り線
+	for x := cell.Min.X; x < cell.Max.X; x++ {
+		dst.SetGray(x, cell.Min.Y, labelGuideColor)
+		dst.SetGray(x, cell.Max.Y-1, labelGuideColor)
+	}
+	for y := cell.Min.Y; y < cell.Max.Y; y++ {
+		dst.SetGray(cell.Min.X, y, labelGuideColor)
+		dst.SetGray(cell.Max.X-1, y, labelGuideColor)
+	}
+
+	pad := mmToPx(r.layout.Padding)
+	textX := cell.Min.X + pad
+	if qrCode != nil {
+		// QRコードはモジュールがぼやけないよう整数倍で拡大する
+		src := qrCode.Bounds()
+		scale := max(min(cell.Dy()-pad*2, mmToPx(r.layout.MaxQR))/src.Dy(), 1)
+		size := src.Dy() * scale
+		top := cell.Min.Y + (cell.Dy()-size)/2
+		qrRect := image.Rect(cell.Min.X+pad, top, cell.Min.X+pad+src.Dx()*scale, top+size)
+		draw.NearestNeighbor.Scale(dst, qrRect, qrCode, src, draw.Src, nil)
+		textX = qrRect.Max.X + pad
+	}
+
+	maxWidth := fixed.I(cell.Max.X - pad - textX)
+	y := cell.Min.Y + pad
+	y += r.titleFace.Metrics().Ascent.Ceil()
+	drawLabelText(dst, r.titleFace, textX, y, fitText(r.titleFace, l.Title, maxWidth))
+	y += r.titleFace.Metrics().Descent.Ceil() + mmToPx(1.5)
+	for _, line := range l.Lines {
+		y += r.textFace.Metrics().Height.Ceil()
+		if y > cell.Max.Y-pad {
+			break
+		}
+		drawLabelText(dst, r.textFace, textX, y, fitText(r.textFace, line, maxWidth))
+	}
+}
+
+func drawLabelText(dst *image.Gray, face font.Face, x, y int, s string) {
+	d := font.Drawer{Dst: dst, Src: image.Black, Face: face, Dot: fixed.P(x, y)}
+	d.DrawString(s)
+}
+
+// 幅に収まらなければ末尾を省略する
+func fitText(face font.Face, s string, maxWidth fixed.Int26_6) string {
+	if font.MeasureString(face, s) <= maxWidth {
+		return s
+	}
+	runes := []rune(s)
+	for n := len(runes) - 1; n > 0; n-- {
+		t := string(runes[:n]) + "…"
+		if font.MeasureString(face, t) <= maxWidth {
+			return t
+		}
+	}
+	return ""
+}
+
+/* --- Output Formats --- */
+
+const (
+	labelFormatPDF = "pdf"
+	labelFormatPNG = "png"
+	labelFormatZIP = "zip"
+)
+
+// 台紙の画像をページごとに埋め込んだPDFを書く
+// 画像はグレースケールをそのままFlateで圧縮する
+// page(i) が返す画像は次のページを描くまでに書き終えるので、使い回してよい
+func writeLabelPDF(w io.Writer, pageCount int, page func(i int) *image.Gray) error {
+	bw := bufio.NewWriter(w)
+	var (
+		offset  int
+		offsets []int
+	)
+	write := func(format string, args ...any) {
+		n, _ := fmt.Fprintf(bw, format, args...)
+		offset += n
+	}
+	object := func() int {
+		offsets = append(offsets, offset)
+		return len(offsets)
+	}
+
+	write("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+
+	// 1: Catalog, 2: Pages, 以降ページごとに Page, Contents, Image
+	object()
+	write("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	object()
+	write("2 0 obj\n<< /Type /Pages /Kids [")
+	for i := 0; i < pageCount; i++ {
+		write(" %d 0 R", 3+i*3)
+	}
+	write(" ] /Count %d >>\nendobj\n", pageCount)
+
+	// A4 (pt)
+	const pageW, pageH = a4Width / 25.4 * 72, a4Height / 25.4 * 72
+	for i := 0; i < pageCount; i++ {
+		page := page(i)
+		pageID := object()
+		write("%d 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pageID, pageW, pageH, pageID+2, pageID+1)
+
+		contents := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", pageW, pageH)
+		contentsID := object()
+		write("%d 0 obj\n<< /Length %d >>\nstream\n%sendstream\nendobj\n", contentsID, len(contents), contents)
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		for y := 0; y < page.Rect.Dy(); y++ {
+			row := page.Pix[y*page.Stride : y*page.Stride+page.Rect.Dx()]
+			if _, err := zw.Write(row); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		imageID := object()
+		write("%d 0 obj\n<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n",
+			imageID, page.Rect.Dx(), page.Rect.Dy(), compressed.Len())
+		n, _ := bw.Write(compressed.Bytes())
+		offset += n
+		write("\nendstream\nendobj\n")
+	}
+
+	xref := offset
+	write("xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		write("%010d 00000 n \n", o)
+	}
+	write("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return bw.Flush()
+}
+
+// ラベルを1枚ずつPNGにしてZIPにまとめる
+func writeLabelZIP(w io.Writer, r *labelRenderer, labels []label, qrCodes map[string]image.Image) error {
+	zw := zip.NewWriter(w)
+	for _, l := range labels {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: l.ID + ".png", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(f, r.single(l, qrCodes[l.ID])); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+/* --- Handlers --- */
+
+type PostLabelsRequest struct {
+	IDs []string `json:"ids"`
+	// pdf (既定), png (1ページに収まる場合のみ), zip
+	Format string `json:"format"`
+}
+
+func bindLabelsRequest(c echo.Context, layout labelLayout) (PostLabelsRequest, error) {
+	var req PostLabelsRequest
+	if labelFont == nil {
+		return req, echo.NewHTTPError(http.StatusServiceUnavailable, "label font is not configured")
+	}
+	if err := c.Bind(&req); err != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(req.IDs) == 0 {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "at least one ids is required")
+	}
+	if len(req.IDs) > maxLabelIDs {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "too many ids (max "+strconv.Itoa(maxLabelIDs)+")")
+	}
+	switch req.Format {
+	case "":
+		req.Format = labelFormatPDF
+	case labelFormatPDF:
+	case labelFormatZIP:
+		// ZIPの中のファイル名はIDなので、同じIDがあると同じ名前のファイルができてしまう
+		seen := make(map[string]bool, len(req.IDs))
+		for _, id := range req.IDs {
+			if seen[id] {
+				return req, echo.NewHTTPError(http.StatusBadRequest, "duplicate id in zip: "+id)
+			}
+			seen[id] = true
+		}
+	case labelFormatPNG:
+		if len(req.IDs) > layout.perPage() {
+			return req, echo.NewHTTPError(http.StatusBadRequest, "png sheet holds at most "+strconv.Itoa(layout.perPage())+" labels; use pdf or zip")
+		}
+	default:
+		return req, echo.NewHTTPError(http.StatusBadRequest, "format must be pdf, png or zip")
+	}
+	return req, nil
+}
+
+// 会員証の台紙を出力
+func postMemberCardsHandler(c echo.Context) error {
+	req, err := bindLabelsRequest(c, memberCardLayout)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In(memberWithReadingQuery+"WHERE m.`id` IN (?) AND m.`banned` = false", req.IDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	var members []Member
+	if err := readDB(c).SelectContext(c.Request().Context(), &members, readDB(c).Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	memberMap := make(map[string]Member, len(members))
+	for _, member := range members {
+		memberMap[member.ID] = member
+	}
+
+	labels := make([]label, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		member, ok := memberMap[id]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "member not found: "+id)
+		}
+		lines := []string{}
+		if member.NameReading != "" {
+			lines = append(lines, member.NameReading)
+		}
+		lines = append(lines, "ID: "+member.ID)
+		labels = append(labels, label{ID: member.ID, Title: member.Name, Lines: lines})
+	}
+
+	return renderLabels(c, memberCardLayout, "member-cards", req.Format, labels)
+}
+
+// 蔵書ラベルの台紙を出力
+func postBookLabelsHandler(c echo.Context) error {
+	req, err := bindLabelsRequest(c, bookLabelLayout)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM `book` WHERE `id` IN (?)", req.IDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	var books []Book
+	if err := readDB(c).SelectContext(c.Request().Context(), &books, readDB(c).Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := attachBookReadings(c.Request().Context(), readDB(c), books); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	bookMap := make(map[string]Book, len(books))
+	for _, book := range books {
+		bookMap[book.ID] = book
+	}
+
+	labels := make([]label, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		book, ok := bookMap[id]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "book not found: "+id)
+		}
+		genre := strconv.Itoa(int(book.Genre))
+		if int(book.Genre) < len(genreNames) {
+			genre += " " + genreNames[book.Genre]
+		}
+		labels = append(labels, label{ID: book.ID, Title: book.Title, Lines: []string{
+			book.Author,
+			genre,
+			callNumber(book),
+			book.ID,
+		}})
+	}
+
+	return renderLabels(c, bookLabelLayout, "book-labels", req.Format, labels)
+}
+
+func renderLabels(c echo.Context, layout labelLayout, name, format string, labels []label) error {
+	qrCodes, err := labelQRCodes(c.Request().Context(), labels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	r, err := newLabelRenderer(layout)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var (
+		contentType string
+		write       func(w io.Writer) error
+	)
+	switch format {
+	case labelFormatPDF:
+		contentType = "application/pdf"
+		page := newLabelPage()
+		write = func(w io.Writer) error {
+			return writeLabelPDF(w, r.pageCount(labels), func(i int) *image.Gray {
+				return r.drawPage(page, i, labels, qrCodes)
+			})
+		}
+	case labelFormatPNG:
+		contentType = "image/png"
+		write = func(w io.Writer) error {
+			return png.Encode(w, r.drawPage(newLabelPage(), 0, labels, qrCodes))
+		}
+	case labelFormatZIP:
+		contentType = "application/zip"
+		write = func(w io.Writer) error {
+			return writeLabelZIP(w, r, labels, qrCodes)
+		}
+	}
+
+	// 台紙は大きいので、描いたページから順にそのままレスポンスに書き出す
+	// 書き出し始めた後はステータスを変えられないので、エラーはログに残るだけで応答は途中で切れる
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	res.WriteHeader(http.StatusOK)
+	return write(res)
+}
+
+// QRコードを同時に生成する数
+const labelQRConcurrency = 4
+
+// ラベルに載せるQRコード (GET .../qrcode と同じもの)
+// 生成のロックはIDごとなので、並べて生成しても GET .../qrcode を待たせない
+func labelQRCodes(ctx context.Context, labels []label) (map[string]image.Image, error) {
+	ids := make([]string, 0, len(labels))
+	seen := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		if !seen[l.ID] {
+			seen[l.ID] = true
+			ids = append(ids, l.ID)
+		}
+	}
+
+	images := make([]image.Image, len(ids))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(labelQRConcurrency)
+	for i, id := range ids {
+		i, id := i, id
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			data, err := generateQRCode(id)
+			if err != nil {
+				return err
+			}
+			images[i], err = png.Decode(bytes.NewReader(data))
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	qrCodes := make(map[string]image.Image, len(ids))
+	for i, id := range ids {
+		qrCodes[id] = images[i]
+	}
+	return qrCodes, nil
+}
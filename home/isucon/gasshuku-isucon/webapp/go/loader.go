@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dbgofy/gasshuku-isucon-20230909/home/isucon/gasshuku-isucon/webapp/go/suffix"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/errgroup"
+)
+
+/*
+---------------------------------------------------------------
+Data Loader
+---------------------------------------------------------------
+*/
+
+// 初期データのスナップショット (paths.sql_dir 配下)
+const dataSnapshotFile = "1_data.sql"
+
+// 初期データを読み込む間は外しておくインデックス (MySQLのみ)
+// マイグレーションで作り直した後に外し、読み込みが終わってからテーブルごとにまとめて作る
+// (sql/4_index.sql と揃えること)
+var deferredIndexes = []struct {
+	table, name, columns string
+}{
+	{"lending", "IX_lending_member_id", "`member_id`"},
+	{"lending", "IX_lending_due", "`due`"},
+	{"book_title_suffix", "IX_book_title_suffix", "`title_suffix`"},
+	{"book_title_suffix", "IX_book_title_suffix_book_id", "`book_id`"},
+	{"book_author_suffix", "IX_book_author_suffix", "`author_suffix`"},
+	{"book_author_suffix", "IX_book_author_suffix_book_id", "`book_id`"},
+}
+
+// 初期化の進捗を表すフェーズ
+const (
+	loadPhaseSchema    = "schema"
+	loadPhaseData      = "data"
+	loadPhaseSuffix    = "suffix"
+	loadPhaseIndex     = "index"
+	loadPhaseRecommend = "recommend"
+	loadPhaseCache     = "cache"
+	loadPhaseDone      = "done"
+)
+
+// データ読み込みの進捗
+// 読み込んだスナップショットのバイト数で全体に対する割合を出す
+type loadProgress struct {
+	mu    sync.Mutex
+	phase string
+
+	done  atomic.Int64
+	total atomic.Int64
+
+	// 最後にログを出した時の割合 (10%刻みで出力する)
+	loggedPercent atomic.Int64
+}
+
+func (p *loadProgress) setPhase(phase string) {
+	p.mu.Lock()
+	p.phase = phase
+	p.mu.Unlock()
+	appLogger.Info("initialize", slog.String("phase", phase), slog.Float64("percent", p.Percent()))
+}
+
+func (p *loadProgress) Phase() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.phase
+}
+
+func (p *loadProgress) Percent() float64 {
+	total := p.total.Load()
+	if total == 0 {
+		return 0
+	}
+	return float64(p.done.Load()) * 100 / float64(total)
+}
+
+func (p *loadProgress) add(n int64) {
+	p.done.Add(n)
+	percent := int64(p.Percent()) / 10 * 10
+	if last := p.loggedPercent.Load(); percent > last && p.loggedPercent.CompareAndSwap(last, percent) {
+		appLogger.Info("initialize", slog.String("phase", p.Phase()), slog.Int64("percent", percent))
+	}
+}
+
+// スナップショットからDBを復元するローダー
+type dataLoader struct {
+	db       *sqlx.DB
+	dir      string
+	progress *loadProgress
+}
+
+func newDataLoader(db *sqlx.DB, dir string, progress *loadProgress) *dataLoader {
+	return &dataLoader{db: db, dir: dir, progress: progress}
+}
+
+// スキーマと初期データを読み込み、接尾辞テーブルなどの派生データを構築する
+func (l *dataLoader) Load(ctx context.Context) error {
+	var total int64
+	for _, name := range []string{dataSnapshotFile, suffix.Title.DumpFile(), suffix.Author.DumpFile()} {
+		info, err := os.Stat(l.path(name))
+		if err == nil {
+			total += info.Size()
+		}
+	}
+	l.progress.total.Store(total)
+
+	// スキーマはマイグレーションで作り直す
+	l.progress.setPhase(loadPhaseSchema)
+	m, err := newMigrator(l.db, dialect)
+	if err != nil {
+		return err
+	}
+	if err := m.Reset(ctx); err != nil {
+		return err
+	}
+	if err := l.alterDeferredIndexes(ctx, false); err != nil {
+		return err
+	}
+
+	l.disableRedoLog(ctx)
+	defer l.enableRedoLog(context.WithoutCancel(ctx))
+
+	l.progress.setPhase(loadPhaseData)
+	var (
+		staleMu    sync.Mutex
+		staleKinds []suffix.Kind
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	if dialect == dialectSQLite {
+		// SQLiteは書き込みが1つずつしかできないので順に読み込む
+		g.SetLimit(1)
+	}
+	g.Go(func() error {
+		err := l.execFile(gctx, dataSnapshotFile)
+		if errors.Is(err, fs.ErrNotExist) && dialect == dialectSQLite {
+			// 手元で動かすときは初期データなしでも始められるようにする
+			appLogger.Warn("initialize: no initial data, starting with an empty database", slog.String("file", l.path(dataSnapshotFile)))
+			return nil
+		}
+		return err
+	})
+	for _, kind := range suffix.Kinds {
+		kind := kind
+		g.Go(func() error {
+			usable, err := l.suffixDumpUsable(kind)
+			if err != nil {
+				return err
+			}
+			if !usable {
+				// 接尾辞のダンプがないか正規化の設定が違えば、蔵書から生成する
+				staleMu.Lock()
+				staleKinds = append(staleKinds, kind)
+				staleMu.Unlock()
+				return nil
+			}
+			return l.execFile(gctx, kind.DumpFile())
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if len(staleKinds) > 0 {
+		l.progress.setPhase(loadPhaseSuffix)
+		if err := l.buildSuffixes(ctx, staleKinds...); err != nil {
+			return err
+		}
+	}
+
+	if dialect == dialectMySQL {
+		l.progress.setPhase(loadPhaseIndex)
+	}
+	return l.alterDeferredIndexes(ctx, true)
+}
+
+// 読み込みの間だけ外すインデックスを外す・作る
+// ALTER TABLEはテーブルごとにまとめ、テーブルどうしは並べて実行する
+func (l *dataLoader) alterDeferredIndexes(ctx context.Context, add bool) error {
+	if dialect != dialectMySQL {
+		return nil
+	}
+
+	var tables []string
+	clauses := map[string][]string{}
+	for _, index := range deferredIndexes {
+		if _, ok := clauses[index.table]; !ok {
+			tables = append(tables, index.table)
+		}
+		clause := "DROP INDEX `" + index.name + "`"
+		if add {
+			clause = "ADD INDEX `" + index.name + "` (" + index.columns + ")"
+		}
+		clauses[index.table] = append(clauses[index.table], clause)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for _, table := range tables {
+		query := "ALTER TABLE `" + table + "` " + strings.Join(clauses[table], ", ")
+		g.Go(func() error {
+			_, err := l.db.ExecContext(gctx, query)
+			return err
+		})
+	}
+	return g.Wait()
+}
+
+func (l *dataLoader) path(name string) string {
+	return filepath.Join(l.dir, name)
+}
+
+// 大量のINSERTの間はREDOログを止める (権限がなければそのまま続ける)
+func (l *dataLoader) disableRedoLog(ctx context.Context) {
+	if dialect != dialectMySQL {
+		return
+	}
+	if _, err := l.db.ExecContext(ctx, "ALTER INSTANCE DISABLE INNODB REDO_LOG"); err != nil {
+		appLogger.Warn("initialize: cannot disable redo log", slog.String("error", err.Error()))
+	}
+}
+
+func (l *dataLoader) enableRedoLog(ctx context.Context) {
+	if dialect != dialectMySQL {
+		return
+	}
+	if _, err := l.db.ExecContext(ctx, "ALTER INSTANCE ENABLE INNODB REDO_LOG"); err != nil {
+		appLogger.Warn("initialize: cannot enable redo log", slog.String("error", err.Error()))
+	}
+}
+
+// SQLファイルを文ごとに実行する
+// LOCK TABLESなどセッションに紐づく文があるので、1ファイルを1つのコネクションで実行する
+func (l *dataLoader) execFile(ctx context.Context, name string) error {
+	file, err := os.Open(l.path(name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	conn, err := l.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if dialect == dialectSQLite {
+		// 1文ごとにコミットすると遅いので、ファイル全体を1つのトランザクションにする
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK")
+		}()
+	} else {
+		if _, err := conn.ExecContext(ctx, "SET SESSION unique_checks = 0, SESSION foreign_key_checks = 0"); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	// スナップショットはmysqldumpの出力なので、SQLiteでは書き換えてから実行する
+	convert := dialect == dialectSQLite
+
+	scanner := newSQLStatementScanner(&progressReader{r: file, progress: l.progress})
+	for {
+		stmt, err := scanner.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if convert {
+			if stmt = sqliteStatement(stmt); stmt == "" {
+				continue
+			}
+		}
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if dialect == dialectSQLite {
+		if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// 接尾辞のダンプをそのまま読み込めるか
+// suffixarray dump で作ったダンプは1行目の正規化の設定が今と同じときだけ使う
+// 1行目にその記録がないダンプ (mysqldumpで作った元からあるもの) は、作り直すと遅いのでそのまま使う
+func (l *dataLoader) suffixDumpUsable(kind suffix.Kind) (bool, error) {
+	file, err := os.Open(l.path(kind.DumpFile()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	header = strings.TrimSpace(header)
+	if header == suffix.DumpHeader(kind) {
+		return true, nil
+	}
+	if !suffix.IsDumpHeader(kind, header) {
+		appLogger.Info("initialize: suffix dump has no normalization header, loading as is",
+			slog.String("file", l.path(kind.DumpFile())))
+		return true, nil
+	}
+	appLogger.Warn("initialize: suffix dump was not generated with the current normalization, rebuilding",
+		slog.String("file", l.path(kind.DumpFile())))
+	return false, nil
+}
+
+// 蔵書のタイトル・著者から接尾辞テーブルを作り直す
+func (l *dataLoader) buildSuffixes(ctx context.Context, kinds ...suffix.Kind) error {
+	builder := suffix.NewBuilder(l.db)
+	builder.Logf = func(format string, args ...any) {
+		appLogger.Info("initialize: " + fmt.Sprintf(format, args...))
+	}
+	return builder.Rebuild(ctx, kinds...)
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *loadProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.progress.add(int64(n))
+	return n, err
+}
+
+// mysqldump形式のSQLを文ごとに切り出す
+// 文字列・識別子内のセミコロンは区切りとみなさず、行頭の "--" コメントは読み飛ばす
+type sqlStatementScanner struct {
+	r *bufio.Reader
+}
+
+func newSQLStatementScanner(r io.Reader) *sqlStatementScanner {
+	return &sqlStatementScanner{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+func (s *sqlStatementScanner) Next() (string, error) {
+	var (
+		buf       strings.Builder
+		quote     rune
+		escaped   bool
+		lineStart = true
+	)
+
+	for {
+		ch, _, err := s.r.ReadRune()
+		if errors.Is(err, io.EOF) {
+			stmt := strings.TrimSpace(buf.String())
+			if stmt == "" {
+				return "", io.EOF
+			}
+			return stmt, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if quote != 0 {
+			buf.WriteRune(ch)
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\' && quote != '`':
+				escaped = true
+			case ch == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		if lineStart && ch == '-' {
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == '-' {
+				if _, err := s.r.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+					return "", err
+				}
+				continue
+			}
+		}
+		lineStart = ch == '\n'
+
+		switch ch {
+		case '\'', '"', '`':
+			quote = ch
+		case ';':
+			stmt := strings.TrimSpace(buf.String())
+			if stmt == "" {
+				buf.Reset()
+				continue
+			}
+			return stmt, nil
+		}
+		buf.WriteRune(ch)
+	}
+}
+
+// mysqldumpが出力する日時のリテラル (タイムゾーンなし)
+var mysqlDatetimeLiteral = regexp.MustCompile(`'(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?)'`)
+
+// mysqldumpの文をSQLiteで実行できる形に書き換える
+// データのINSERT以外 (LOCK TABLES, SET, /*!...*/ など) は空文字列を返して読み飛ばす
+// 文字列リテラル内のバックスラッシュによるエスケープはSQLiteの書き方に直す
+// 日時はMySQLと同じく接続のタイムゾーンとみなし、オフセットを付けて保存する
+func sqliteStatement(stmt string) string {
+	upper := strings.ToUpper(strings.TrimSpace(stmt))
+	if !strings.HasPrefix(upper, "INSERT") && !strings.HasPrefix(upper, "REPLACE") {
+		return ""
+	}
+
+	var (
+		buf     strings.Builder
+		inQuote bool
+		escaped bool
+	)
+	buf.Grow(len(stmt))
+	for _, ch := range stmt {
+		switch {
+		case !inQuote:
+			if ch == '\'' {
+				inQuote = true
+			}
+			buf.WriteRune(ch)
+		case escaped:
+			escaped = false
+			switch ch {
+			case '\'':
+				buf.WriteString("''")
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case '0':
+				buf.WriteByte(0)
+			case 'Z':
+				buf.WriteByte(0x1a)
+			case '%', '_':
+				// LIKEのパターン用のエスケープはMySQLでもバックスラッシュが残る
+				buf.WriteByte('\\')
+				buf.WriteRune(ch)
+			default:
+				buf.WriteRune(ch)
+			}
+		case ch == '\\':
+			escaped = true
+		case ch == '\'':
+			inQuote = false
+			buf.WriteRune(ch)
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+
+	return mysqlDatetimeLiteral.ReplaceAllStringFunc(buf.String(), func(literal string) string {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", strings.Trim(literal, "'"), location)
+		if err != nil {
+			return literal
+		}
+		return "'" + t.Format("2006-01-02 15:04:05.999999999-07:00") + "'"
+	})
+}
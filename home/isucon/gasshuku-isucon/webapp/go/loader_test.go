@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLStatementScanner(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "empty",
+			input: "",
+			want:  nil,
+		},
+		{
+			name:  "statements",
+			input: "CREATE TABLE `a` (`id` int);\nINSERT INTO `a` VALUES (1);\n",
+			want:  []string{"CREATE TABLE `a` (`id` int)", "INSERT INTO `a` VALUES (1)"},
+		},
+		{
+			name:  "last statement without semicolon",
+			input: "SELECT 1;\nSELECT 2",
+			want:  []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:  "empty statements",
+			input: ";;\n  ;SELECT 1;;",
+			want:  []string{"SELECT 1"},
+		},
+		{
+			name:  "comment lines",
+			input: "-- MySQL dump\n-- ; not a statement\nSELECT 1;\n-- trailing\n",
+			want:  []string{"SELECT 1"},
+		},
+		{
+			name:  "dashes inside a line",
+			input: "SELECT 1 -- 1;\n",
+			want:  []string{"SELECT 1 -- 1"},
+		},
+		{
+			name:  "semicolons in quotes",
+			input: "INSERT INTO `a;b` VALUES ('x;y', \"z;w\");SELECT 2;",
+			want:  []string{"INSERT INTO `a;b` VALUES ('x;y', \"z;w\")", "SELECT 2"},
+		},
+		{
+			name:  "escaped quotes",
+			input: `INSERT INTO a VALUES ('it\'s; fine', 'back\\');SELECT 2;`,
+			want:  []string{`INSERT INTO a VALUES ('it\'s; fine', 'back\\')`, "SELECT 2"},
+		},
+		{
+			name:  "doubled quotes",
+			input: "INSERT INTO a VALUES ('it''s; fine');",
+			want:  []string{"INSERT INTO a VALUES ('it''s; fine')"},
+		},
+		{
+			name:  "backslash in identifier",
+			input: "SELECT `a\\`;SELECT 2;",
+			want:  []string{"SELECT `a\\`", "SELECT 2"},
+		},
+		{
+			name:  "dashes in a string",
+			input: "INSERT INTO a VALUES ('\n-- not a comment;');",
+			want:  []string{"INSERT INTO a VALUES ('\n-- not a comment;')"},
+		},
+		{
+			name:  "multibyte",
+			input: "INSERT INTO a VALUES ('吾輩は猫である；');",
+			want:  []string{"INSERT INTO a VALUES ('吾輩は猫である；')"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := newSQLStatementScanner(strings.NewReader(tt.input))
+			var got []string
+			for {
+				stmt, err := scanner.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, stmt)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLiteStatement(t *testing.T) {
+	defer func(loc *time.Location) { location = loc }(location)
+	location = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+	tests := []struct {
+		name string
+		stmt string
+		want string
+	}{
+		{
+			name: "skip lock tables",
+			stmt: "LOCK TABLES `book` WRITE",
+			want: "",
+		},
+		{
+			name: "skip conditional comments",
+			stmt: "/*!40101 SET NAMES utf8mb4 */",
+			want: "",
+		},
+		{
+			name: "insert as is",
+			stmt: "INSERT INTO `book` VALUES ('B1','title',1)",
+			want: "INSERT INTO `book` VALUES ('B1','title',1)",
+		},
+		{
+			name: "lower case replace",
+			stmt: "  replace into `book` VALUES ('B1')",
+			want: "  replace into `book` VALUES ('B1')",
+		},
+		{
+			name: "escaped quote",
+			stmt: `INSERT INTO a VALUES ('it\'s')`,
+			want: `INSERT INTO a VALUES ('it''s')`,
+		},
+		{
+			name: "control characters",
+			stmt: `INSERT INTO a VALUES ('a\nb\rc\td\0e\Z')`,
+			want: "INSERT INTO a VALUES ('a\nb\rc\td\x00e\x1a')",
+		},
+		{
+			name: "backslash and double quote",
+			stmt: `INSERT INTO a VALUES ('\\ \"')`,
+			want: `INSERT INTO a VALUES ('\ "')`,
+		},
+		{
+			name: "like escapes keep the backslash",
+			stmt: `INSERT INTO a VALUES ('100\% \_')`,
+			want: `INSERT INTO a VALUES ('100\% \_')`,
+		},
+		{
+			name: "backslash outside quotes",
+			stmt: `INSERT INTO a VALUES (1\n)`,
+			want: `INSERT INTO a VALUES (1\n)`,
+		},
+		{
+			name: "datetime in the connection time zone",
+			stmt: "INSERT INTO `lending` VALUES ('L1','2023-09-09 12:34:56')",
+			want: "INSERT INTO `lending` VALUES ('L1','2023-09-09 12:34:56+09:00')",
+		},
+		{
+			name: "datetime with fraction",
+			stmt: "INSERT INTO `lending` VALUES ('2023-09-09 12:34:56.123456')",
+			want: "INSERT INTO `lending` VALUES ('2023-09-09 12:34:56.123456+09:00')",
+		},
+		{
+			name: "invalid datetime as is",
+			stmt: "INSERT INTO `lending` VALUES ('2023-13-40 25:00:00')",
+			want: "INSERT INTO `lending` VALUES ('2023-13-40 25:00:00')",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sqliteStatement(tt.stmt); got != tt.want {
+				t.Errorf("sqliteStatement(%q) = %q, want %q", tt.stmt, got, tt.want)
+			}
+		})
+	}
+}
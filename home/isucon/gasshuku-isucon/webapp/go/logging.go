@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+/*
+---------------------------------------------------------------
+Logging
+---------------------------------------------------------------
+*/
+
+const (
+	requestIDHeader     = "X-Request-ID"
+	requestIDContextKey = "request_id"
+	logAttrsContextKey  = "log_attrs"
+)
+
+// アクセスログ・エラーログの出力先
+var appLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// ログファイルが指定されていればローテーションするファイルに、なければ標準出力に出力する
+func setupLogger() {
+	appLogger = slog.New(slog.NewJSONHandler(newLogWriter(cfg.Log), nil))
+}
+
+func newLogWriter(c LogConfig) io.Writer {
+	if c.File == "" || c.File == "stdout" {
+		return os.Stdout
+	}
+
+	return &lumberjack.Logger{
+		Filename:   c.File,
+		MaxSize:    c.MaxSizeMB,
+		MaxBackups: c.MaxBackups,
+		MaxAge:     c.MaxAgeDays,
+	}
+}
+
+// リクエストIDを決定してコンテキストとレスポンスヘッダに設定
+// X-Request-ID が来ていればそれを、なければトレースIDを、どちらもなければ新規に採番する
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(requestIDHeader)
+		if id == "" {
+			if sc := trace.SpanContextFromContext(c.Request().Context()); sc.HasTraceID() {
+				id = sc.TraceID().String()
+			} else {
+				id = generateID()
+			}
+		}
+
+		c.Set(requestIDContextKey, id)
+		c.Response().Header().Set(requestIDHeader, id)
+
+		return next(c)
+	}
+}
+
+func requestID(c echo.Context) string {
+	id, _ := c.Get(requestIDContextKey).(string)
+	return id
+}
+
+// ハンドラからアクセスログに載せる属性
+type logAttrs struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// アクセスログに属性を追加する (会員ID・蔵書IDなど)
+func addLogAttrs(c echo.Context, attrs ...slog.Attr) {
+	la, ok := c.Get(logAttrsContextKey).(*logAttrs)
+	if !ok {
+		return
+	}
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	la.attrs = append(la.attrs, attrs...)
+}
+
+// リクエストごとにJSONのアクセスログを出力
+// エラーはここでHTTPErrorHandlerに渡し、確定したステータスとサイズを記録する
+func accessLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Path() {
+		case "/metrics", "/healthz", "/readyz":
+			return next(c)
+		}
+
+		la := &logAttrs{}
+		c.Set(logAttrsContextKey, la)
+		if id := c.Param("id"); id != "" {
+			switch {
+			case strings.HasPrefix(c.Path(), "/api/members/"):
+				la.attrs = append(la.attrs, slog.String("member_id", id))
+			case strings.HasPrefix(c.Path(), "/api/books/"):
+				la.attrs = append(la.attrs, slog.String("book_id", id))
+			}
+		}
+
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		req := c.Request()
+		res := c.Response()
+		attrs := []slog.Attr{
+			slog.String("request_id", requestID(c)),
+			slog.String("method", req.Method),
+			slog.String("route", c.Path()),
+			slog.String("uri", req.RequestURI),
+			slog.Int("status", res.Status),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int64("bytes_in", req.ContentLength),
+			slog.Int64("bytes_out", res.Size),
+			slog.String("remote_ip", c.RealIP()),
+		}
+		la.mu.Lock()
+		attrs = append(attrs, la.attrs...)
+		la.mu.Unlock()
+
+		level := slog.LevelInfo
+		if res.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		appLogger.LogAttrs(req.Context(), level, "access", attrs...)
+
+		return err
+	}
+}
+
+// HTTPErrorHandler
+// otelechoとアクセスログの両方から呼ばれるので、レスポンス済みなら何もしない
+func httpErrorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+		e.DefaultHTTPErrorHandler(err, c)
+
+		status := http.StatusInternalServerError
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			status = httpErr.Code
+		}
+
+		level := slog.LevelWarn
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		appLogger.LogAttrs(c.Request().Context(), level, "error",
+			slog.String("request_id", requestID(c)),
+			slog.String("error", err.Error()),
+			slog.String("method", c.Request().Method),
+			slog.String("route", c.Path()),
+			slog.Int("status", status),
+			slog.Any("params", c.QueryParams()),
+		)
+	}
+}
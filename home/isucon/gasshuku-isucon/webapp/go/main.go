@@ -9,33 +9,48 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/uptrace/opentelemetry-go-extra/otelsql"
-	"github.com/uptrace/opentelemetry-go-extra/otelsqlx"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
-	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"hash/fnv"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/dbgofy/gasshuku-isucon-20230909/home/isucon/gasshuku-isucon/webapp/go/suffix"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"github.com/oklog/ulid/v2"
-	"github.com/uptrace/uptrace-go/uptrace"
-	"golang.org/x/sync/errgroup"
 )
 
 func main() {
 	ctx := context.Background()
 
+	var err error
+	var args []string
+	cfg, args, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	location, err = time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	setupLogger()
+	suffix.SetOptions(suffix.Options{FoldKana: cfg.Search.FoldKana})
+	appLogger.Info("effective config", slog.Any("config", cfg.Redacted()))
+
 	var revision string
 	{
 		info, _ := debug.ReadBuildInfo()
@@ -44,70 +59,147 @@ func main() {
 				revision = s.Value
 			}
 		}
-		uptrace.ConfigureOpentelemetry(
-			uptrace.WithServiceName("webapp:" + revision),
-		)
-		defer uptrace.Shutdown(ctx)
+		shutdownTracing, err := setupTracing(ctx, cfg.Tracing, "webapp:"+revision)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := shutdownTracing(ctx); err != nil {
+				appLogger.Error("failed to shut down tracing", slog.String("error", err.Error()))
+			}
+		}()
 	}
 
-	host := getEnvOrDefault("DB_HOST", "localhost")
-	port := getEnvOrDefault("DB_PORT", "3306")
-	user := getEnvOrDefault("DB_USER", "isucon")
-	pass := getEnvOrDefault("DB_PASS", "isucon")
-	name := getEnvOrDefault("DB_NAME", "isulibrary")
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=Asia%%2FTokyo", user, pass, host, port, name)
-
-	var err error
-	db, err = otelsqlx.Open("mysql", dsn, otelsql.WithAttributes(semconv.DBSystemKey.String("mysql:"+revision)))
+	dialect = cfg.DB.Dialect()
+	dsn, err := cfg.DB.DataSource(cfg.Timezone)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err = openDB(dialect, dsn, revision)
 	if err != nil {
 		log.Panic(err)
 	}
 	defer db.Close()
 
-	var key string
-	err = db.Get(&key, "SELECT `key` FROM `key` WHERE `id` = (SELECT MAX(`id`) FROM `key`)")
-	if err != nil {
+	var replicaDBs []*sqlx.DB
+	for _, dsn := range cfg.DB.ReplicaDSNs {
+		replicaDB, err := openReplicaDB(dsn, revision)
+		if err != nil {
+			log.Panic(err)
+		}
+		replicaDBs = append(replicaDBs, replicaDB)
+	}
+	router = newReplicaRouter(db, replicaDBs, cfg.DB.ReplicaStickyWindow)
+	defer router.Close()
+
+	if len(args) > 0 {
+		if args[0] != "migrate" {
+			log.Fatalf("unknown command %q", args[0])
+		}
+		if err := runMigrateCommand(ctx, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	counters = newCounterStore(cfg.Cache.CounterBackend)
+
+	if dialect == dialectSQLite {
+		if err := bootstrapSQLite(ctx); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if err := checkSchemaVersion(ctx); err != nil {
+		log.Fatal(err)
+	}
+	if err := fillReadingSortKeys(ctx); err != nil {
 		log.Panic(err)
 	}
 
-	block, err = aes.NewCipher([]byte(key))
+	if err := initLabelFont(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadKey(ctx); err != nil {
+		log.Panic(err)
+	}
+
+	if err := syncCaches(ctx); err != nil {
+		log.Panic(err)
+	}
+
+	epoch, err := readCacheEpoch(ctx)
 	if err != nil {
 		log.Panic(err)
 	}
+	cacheEpoch.Store(epoch)
 
-	e := echo.New()
-	e.Debug = true
-	e.HTTPErrorHandler = func(err error, c echo.Context) {
-		e.DefaultHTTPErrorHandler(err, c)
-		go c.Logger().Errorj(log.JSON{
-			"error":  err.Error(),
-			"method": c.Request().Method,
-			"path":   c.Path(),
-			"params": c.QueryParams(),
-		})
+	backgroundCtx, cancelBackground := context.WithCancel(ctx)
+	defer cancelBackground()
+	startCacheReconciler(backgroundCtx, cfg.Cache.ReconcileInterval)
+	startInvalidationWatcher(backgroundCtx, cfg.Cache.InvalidationInterval)
+	router.startHealthCheck(backgroundCtx, cfg.DB.ReplicaHealthInterval)
+	startCoBorrowAggregator(backgroundCtx, cfg.Recommend.Interval, cfg.Recommend.BatchSize)
+	reminders, err = newReminderScheduler(cfg.Reminder)
+	if err != nil {
+		log.Fatal(err)
 	}
-	e.Use(otelecho.Middleware("dev-1"))
+	reminders.Start(backgroundCtx, cfg.Reminder.Interval)
+	banPolicy = newBanPolicyJob(cfg.BanPolicy)
+	banPolicy.Start(backgroundCtx, cfg.BanPolicy.Interval)
+	newWebhookDispatcher(cfg.Webhook).Start(backgroundCtx)
+	eventHub = newEventStream(cfg.Events.BufferSize)
+
+	e := echo.New()
+	e.Debug = cfg.Debug
+	e.HTTPErrorHandler = httpErrorHandler(e)
+	// イベントのストリームはシャットダウンを待たずに閉じる
+	e.Server.RegisterOnShutdown(eventHub.Close)
+	e.Use(otelecho.Middleware(cfg.Tracing.ServiceName))
+	e.Use(requestIDMiddleware)
+	e.Use(accessLogMiddleware)
+	registerMetrics(e)
+	e.Use(initializeGuardMiddleware)
+
+	e.GET("/healthz", healthzHandler)
+	e.GET("/readyz", readyzHandler)
 
 	api := e.Group("/api")
 	{
 		api.POST("/initialize", initializeHandler)
+		api.GET("/initialize/status", getInitializeStatusHandler)
 
 		membersAPI := api.Group("/members")
 		{
 			membersAPI.POST("", postMemberHandler)
 			membersAPI.GET("", getMembersHandler)
+			membersAPI.POST("/cards", postMemberCardsHandler)
 			membersAPI.GET("/:id", getMemberHandler)
 			membersAPI.PATCH("/:id", patchMemberHandler)
 			membersAPI.DELETE("/:id", banMemberHandler)
 			membersAPI.GET("/:id/qrcode", getMemberQRCodeHandler)
+			membersAPI.GET("/:id/recommendations", getMemberRecommendationsHandler)
+			membersAPI.GET("/:id/reminders", getMemberRemindersHandler)
+			membersAPI.GET("/:id/sanctions", getMemberSanctionsHandler)
 		}
 
 		booksAPI := api.Group("/books")
 		{
 			booksAPI.POST("", postBooksHandler)
 			booksAPI.GET("", getBooksHandler)
+			booksAPI.POST("/labels", postBookLabelsHandler)
 			booksAPI.GET("/:id", getBookHandler)
+			booksAPI.PATCH("/:id", patchBookHandler)
 			booksAPI.GET("/:id/qrcode", getBookQRCodeHandler)
+			booksAPI.GET("/:id/recommendations", getBookRecommendationsHandler)
+		}
+
+		scanAPI := api.Group("/scan")
+		{
+			scanAPI.POST("", postScanHandler)
+			scanAPI.POST("/checkout", postScanCheckoutHandler)
+			scanAPI.POST("/image", postScanImageHandler)
 		}
 
 		lendingsAPI := api.Group("/lendings")
@@ -116,9 +208,32 @@ func main() {
 			lendingsAPI.GET("", getLendingsHandler)
 			lendingsAPI.POST("/return", returnLendingsHandler)
 		}
+
+		api.GET("/events", getEventsHandler)
+
+		webhooksAPI := api.Group("/webhooks")
+		{
+			webhooksAPI.POST("", postWebhookHandler)
+			webhooksAPI.GET("", getWebhooksHandler)
+			webhooksAPI.GET("/:id", getWebhookHandler)
+			webhooksAPI.PATCH("/:id", patchWebhookHandler)
+			webhooksAPI.DELETE("/:id", deleteWebhookHandler)
+			webhooksAPI.GET("/:id/deliveries", getWebhookDeliveriesHandler)
+		}
+
+		adminAPI := api.Group("/admin")
+		{
+			adminAPI.GET("/cache", getCacheStateHandler)
+			adminAPI.POST("/cache/reconcile", reconcileCachesHandler)
+			adminAPI.POST("/reminders/run", runRemindersHandler)
+			adminAPI.GET("/ban-policy/dry-run", dryRunBanPolicyHandler)
+			adminAPI.POST("/ban-policy/run", runBanPolicyHandler)
+		}
 	}
 
-	e.Logger.Fatal(e.Start(":8080"))
+	if err := startServer(e, cfg.Listen); err != nil {
+		e.Logger.Error(err)
+	}
 }
 
 /*
@@ -135,6 +250,8 @@ type Member struct {
 	PhoneNumber string    `json:"phone_number" db:"phone_number"`
 	Banned      bool      `json:"banned" db:"banned"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	// 名前の読み仮名 (member_reading)
+	NameReading string `json:"name_reading,omitempty" db:"name_reading"`
 }
 
 // 図書分類
@@ -161,6 +278,9 @@ type Book struct {
 	Author    string    `json:"author" db:"author"`
 	Genre     Genre     `json:"genre" db:"genre"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	// タイトル・著者の読み仮名 (book_reading)
+	TitleReading  string `json:"title_reading,omitempty" db:"-"`
+	AuthorReading string `json:"author_reading,omitempty" db:"-"`
 }
 
 // 貸出記録
@@ -183,6 +303,16 @@ func generateID() string {
 	return ulid.Make().String()
 }
 
+var (
+	cfg      Config
+	location = time.FixedZone("Asia/Tokyo", 9*60*60)
+)
+
+// 設定されたタイムゾーンの現在時刻 (DBの精度に合わせてマイクロ秒で切り捨て)
+func currentTime() time.Time {
+	return time.Now().In(location).Truncate(time.Microsecond)
+}
+
 var db *sqlx.DB
 
 func getEnvOrDefault(key string, defaultValue string) string {
@@ -194,14 +324,90 @@ func getEnvOrDefault(key string, defaultValue string) string {
 	return defaultValue
 }
 
-var (
-	block              cipher.Block
-	qrFileLock         sync.Mutex
-	notBannedMemberNum atomic.Int32
+// ハンドラで扱うMySQLのエラー番号
+const (
+	mysqlErrDupEntry        = 1062 // ER_DUP_ENTRY
+	mysqlErrLockWaitTimeout = 1205 // ER_LOCK_WAIT_TIMEOUT
+	mysqlErrLockDeadlock    = 1213 // ER_LOCK_DEADLOCK
+)
+
+// デッドロック・ロック待ちタイムアウト時のリトライ回数
+const txMaxRetries = 3
+
+func isMySQLError(err error, number uint16) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == number
+}
+
+func isRetryableTxError(err error) bool {
+	return isMySQLError(err, mysqlErrLockDeadlock) || isMySQLError(err, mysqlErrLockWaitTimeout) || isSQLiteBusyError(err)
+}
+
+// トランザクション内でfnを実行してコミットする
+// デッドロック・ロック待ちタイムアウトで失敗した場合はトランザクションごとやり直す
+// fnは複数回呼ばれる可能性があるので、DB以外の副作用はコミット後に行うこと
+func runInTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	return retryTx(ctx, func() error {
+		return runInTxOnce(ctx, opts, fn)
+	})
+}
+
+// トランザクション1回分の attempt を、デッドロック・ロック待ちタイムアウトならやり直す
+func retryTx(ctx context.Context, attemptTx func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := attemptTx()
+		if err == nil || !isRetryableTxError(err) || attempt >= txMaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * 10 * time.Millisecond):
+		}
+	}
+}
+
+func runInTxOnce(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runInTxのエラーをHTTPエラーに変換
+// fnがechoのHTTPErrorを返した場合はそのまま返す
+func txHTTPError(err error) error {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
 
-	bookByGenreCache []*atomic.Int64
+var (
+	block cipher.Block
+	// QRコードを生成するときのロック
+	// 同じIDを同時に生成しないためのものなので、IDのハッシュで分けて別のIDは並べて生成できるようにする
+	qrFileLocks [64]sync.Mutex
 )
 
+func qrFileLock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return &qrFileLocks[h.Sum32()%uint32(len(qrFileLocks))]
+}
+
 // AES + CTRモード + base64エンコードでテキストを暗号化
 func encrypt(plainText string) (string, error) {
 	cipherText := make([]byte, aes.BlockSize+len([]byte(plainText)))
@@ -220,6 +426,9 @@ func decrypt(cipherText string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if len(cipherByte) < aes.BlockSize {
+		return "", errors.New("cipher text is too short")
+	}
 	decryptedText := make([]byte, len([]byte(cipherByte[aes.BlockSize:])))
 	decryptStream := cipher.NewCTR(block, []byte(cipherByte[:aes.BlockSize]))
 	decryptStream.XORKeyStream(decryptedText, []byte(cipherByte[aes.BlockSize:]))
@@ -228,20 +437,27 @@ func decrypt(cipherText string) (string, error) {
 
 // QRコードを生成
 func generateQRCode(id string) ([]byte, error) {
-	qrCodeFileName := fmt.Sprintf("../images/%s.png", id)
+	qrCodeFileName := filepath.Join(cfg.Paths.Images, id+".png")
 	file, err := os.Open(qrCodeFileName)
 	if err == nil {
 		defer file.Close()
+		qrCacheHitsTotal.Inc()
 		return io.ReadAll(file)
 	}
+	qrCacheMissesTotal.Inc()
 
 	encryptedID, err := encrypt(id)
 	if err != nil {
 		return nil, err
 	}
 
-	qrFileLock.Lock()
-	defer qrFileLock.Unlock()
+	lock := qrFileLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	// 待っている間に同じIDのQRコードが生成されていればそれを使う
+	if qrCode, err := os.ReadFile(qrCodeFileName); err == nil {
+		return qrCode, nil
+	}
 	//TODO: 一旦直前でlockするようにする
 	/*
 		生成するQRコードの仕様
@@ -250,20 +466,26 @@ func generateQRCode(id string) ([]byte, error) {
 		 - バージョン6 (41x41ピクセル、マージン含め49x49ピクセル)
 		 - エラー訂正レベルM (15%)
 	*/
+	// qrFileLocksはプロセス内でしか効かないので、一時ファイルに書いてからrenameする
+	// 他のインスタンスが同時に生成しても、書きかけのファイルを読むことはない
+	tmpFileName := fmt.Sprintf("%s.%s.tmp", qrCodeFileName, generateID())
+	defer os.Remove(tmpFileName)
 	err = exec.
-		Command("sh", "-c", fmt.Sprintf("echo \"%s\" | qrencode -o %s -t PNG -s 1 -v 6 --strict-version -l M", encryptedID, qrCodeFileName)).
+		Command("sh", "-c", fmt.Sprintf("echo \"%s\" | qrencode -o %s -t PNG -s 1 -v 6 --strict-version -l M", encryptedID, tmpFileName)).
 		Run()
 	if err != nil {
 		return nil, err
 	}
 
-	file, err = os.Open(qrCodeFileName)
+	qrCode, err := os.ReadFile(tmpFileName)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if err := os.Rename(tmpFileName, qrCodeFileName); err != nil {
+		return nil, err
+	}
 
-	return io.ReadAll(file)
+	return qrCode, nil
 }
 
 /*
@@ -285,7 +507,12 @@ type genreCount struct {
 	Count int64 `db:"c"`
 }
 
+type InitializeAcceptedResponse struct {
+	JobID string `json:"job_id"`
+}
+
 // 初期化用ハンドラ
+// async=true なら初期化ジョブを開始して202を返し、進捗は GET /api/initialize/status で確認する
 func initializeHandler(c echo.Context) error {
 	var req InitializeHandlerRequest
 	if err := c.Bind(&req); err != nil {
@@ -296,56 +523,35 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "key must be 16 characters")
 	}
 
-	g, ctx := errgroup.WithContext(c.Request().Context())
-
-	g.Go(func() error {
-		cmd := exec.CommandContext(ctx, "bash", "../sql/init_db.sh")
-		cmd.Env = os.Environ()
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		return err
-	})
-
-	g.Go(func() error {
-		_, err := db.ExecContext(c.Request().Context(), "INSERT INTO `key` (`key`) VALUES (?)", req.Key)
-		return err
-	})
+	async := c.QueryParam("async")
+	if async != "" && async != "true" && async != "false" {
+		return echo.NewHTTPError(http.StatusBadRequest, "async must be boolean value")
+	}
 
-	g.Go(func() error {
-		var err error
-		block, err = aes.NewCipher([]byte(req.Key))
-		if err != nil {
-			log.Panic(err.Error())
-		}
-		return nil
-	})
+	newBlock, err := aes.NewCipher([]byte(req.Key))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
-	g.Go(func() error {
-		var total int32
-		err := db.GetContext(c.Request().Context(), &total, "SELECT COUNT(*) FROM `member` WHERE `banned` = false")
-		if err != nil {
-			return err
-		}
-		notBannedMemberNum.Store(total)
-		return nil
+	job, err := startInitializeJob(func(ctx context.Context, progress *loadProgress) error {
+		return initialize(ctx, req.Key, newBlock, progress)
 	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
 
-	g.Go(func() error {
-		var genreCounts []genreCount
-		err := db.SelectContext(c.Request().Context(), &genreCounts, "SELECT genre, count(1) as c FROM `book` GROUP BY genre order by genre")
-		if err != nil {
-			return err
-		}
-		bookByGenreCache = make([]*atomic.Int64, 10)
-		for _, genreCount := range genreCounts {
-			bookByGenreCache[genreCount.Genre] = new(atomic.Int64)
-			bookByGenreCache[genreCount.Genre].Store(genreCount.Count)
-		}
-		return nil
-	})
+	if async == "true" {
+		return c.JSON(http.StatusAccepted, InitializeAcceptedResponse{
+			JobID: job.ID,
+		})
+	}
 
-	if err := g.Wait(); err != nil {
+	select {
+	case <-job.done:
+	case <-c.Request().Context().Done():
+		return c.Request().Context().Err()
+	}
+	if err := job.Err(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
@@ -354,6 +560,93 @@ func initializeHandler(c echo.Context) error {
 	})
 }
 
+// DBを初期データに戻し、鍵を登録してキャッシュを構築する
+func initialize(ctx context.Context, key string, newBlock cipher.Block, progress *loadProgress) error {
+	// データの読み込みが終わるまではキャッシュを使わせない
+	cachesReady.Store(false)
+
+	if err := loadInitialData(ctx, progress); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, "INSERT INTO `key` (`key`) VALUES (?)", key)
+	if err != nil {
+		return err
+	}
+	block = newBlock
+
+	progress.setPhase(loadPhaseRecommend)
+	if err := rebuildRecommendations(ctx); err != nil {
+		return err
+	}
+
+	progress.setPhase(loadPhaseCache)
+	if err := loadCaches(ctx); err != nil {
+		return err
+	}
+	if err := bumpCacheEpoch(ctx); err != nil {
+		return err
+	}
+	// スキーマを作り直したので、登録されていたwebhookは消えている
+	invalidateWebhookSubscriptions()
+	progress.setPhase(loadPhaseDone)
+
+	return nil
+}
+
+// 初期データをDBに読み込む
+func loadInitialData(ctx context.Context, progress *loadProgress) error {
+	if cfg.Init.Loader == initLoaderScript && dialect == dialectMySQL {
+		cmd := exec.CommandContext(ctx, "bash", cfg.Paths.InitDBScript)
+		cmd.Env = os.Environ()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	return newDataLoader(db, cfg.Paths.SQLDir, progress).Load(ctx)
+}
+
+// インメモリキャッシュを構築済みか
+var cachesReady atomic.Bool
+
+func cachesLoaded() bool {
+	return cachesReady.Load()
+}
+
+// カウンタをDBから数え直して構築
+func loadCaches(ctx context.Context) error {
+	values, err := countFromDB(ctx, db)
+	if err != nil {
+		return err
+	}
+	if err := counters.Reset(ctx, values); err != nil {
+		return err
+	}
+
+	cachesReady.Store(true)
+	return nil
+}
+
+// 起動時や他のインスタンスの初期化後にカウンタを使える状態にする
+// 共有のカウンタは他のインスタンスの更新を上書きしないよう、空のときだけ構築する
+func syncCaches(ctx context.Context) error {
+	if !counters.Shared() {
+		return loadCaches(ctx)
+	}
+
+	var n int
+	if err := db.GetContext(ctx, &n, "SELECT COUNT(*) FROM `stats` WHERE `name` != ?", cacheEpochStatName); err != nil {
+		return err
+	}
+	if n == 0 {
+		return loadCaches(ctx)
+	}
+
+	cachesReady.Store(true)
+	return nil
+}
+
 /*
 ---------------------------------------------------------------
 Members API
@@ -364,6 +657,9 @@ type PostMemberRequest struct {
 	Name        string `json:"name"`
 	Address     string `json:"address"`
 	PhoneNumber string `json:"phone_number"`
+	NameReading string `json:"name_reading"`
+	// 期限の通知の送り先 (任意)
+	Email string `json:"email"`
 }
 
 // 会員登録
@@ -375,6 +671,14 @@ func postMemberHandler(c echo.Context) error {
 	if req.Name == "" || req.Address == "" || req.PhoneNumber == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "name, address, phoneNumber are required")
 	}
+	nameReading, err := normalizeReading("name_reading", req.NameReading)
+	if err != nil {
+		return err
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		return err
+	}
 
 	id := generateID()
 
@@ -384,27 +688,49 @@ func postMemberHandler(c echo.Context) error {
 		Address:     req.Address,
 		PhoneNumber: req.PhoneNumber,
 		Banned:      false,
-		CreatedAt:   time.Now().In(time.FixedZone("Asia/Tokyo", 9*60*60)).Truncate(time.Microsecond),
-	}
-	_, err := db.ExecContext(c.Request().Context(),
-		"INSERT INTO `member` (`id`, `name`, `address`, `phone_number`, `banned`, `created_at`) VALUES (?, ?, ?, ?, false, ?)",
-		res.ID, res.Name, res.Address, res.PhoneNumber, res.CreatedAt)
+		CreatedAt:   currentTime(),
+		NameReading: nameReading,
+	}
+	deltas := counterDeltas{}
+	deltas.add(counterNotBannedMembers, 1)
+	event := newEvent(eventMemberCreated, res)
+	err = runCounterTx(c.Request().Context(), deltas, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(c.Request().Context(),
+			"INSERT INTO `member` (`id`, `name`, `address`, `phone_number`, `banned`, `created_at`) VALUES (?, ?, ?, ?, false, ?)",
+			res.ID, res.Name, res.Address, res.PhoneNumber, res.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if res.NameReading != "" {
+			if err := setMemberReading(c.Request().Context(), tx, res.ID, res.NameReading); err != nil {
+				return err
+			}
+		}
+		if email != "" {
+			if err := setMemberEmail(c.Request().Context(), tx, res.ID, email); err != nil {
+				return err
+			}
+		}
+		return enqueueEvents(c.Request().Context(), tx, event)
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return txHTTPError(err)
 	}
-	notBannedMemberNum.Add(1)
+	router.markWrite(res.ID)
+	publishEvents(event)
+	addLogAttrs(c, slog.String("member_id", res.ID))
 
 	return c.JSON(http.StatusCreated, res)
 }
 
-const memberPageLimit = 100
-
 type GetMembersResponse struct {
 	Members []Member `json:"members"`
 	Total   int      `json:"total"`
 }
 
 // 会員一覧を取得 (ページネーションあり)
+// name で名前の前方一致 (match=reading なら読み仮名の前方一致) で絞り込める
+// order=name_asc, name_desc は読み仮名の五十音順で、読み仮名のない会員はその後に名前順で並ぶ
 func getMembersHandler(c echo.Context) error {
 	var err error
 
@@ -415,47 +741,57 @@ func getMembersHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid order")
 	}
 
-	var lastMemberName string
-	if lastMemberID != "" && (order == "name_asc" || order == "name_desc") {
-		err = db.GetContext(c.Request().Context(), &lastMemberName, "SELECT `name` FROM `member` WHERE `id` = ?", lastMemberID)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-		}
+	match, err := parseMatch(c)
+	if err != nil {
+		return err
 	}
-
-	query := "SELECT * FROM `member` WHERE `banned` = false "
-	var filterString string
-	switch order {
-	case "name_asc":
-		filterString = lastMemberName
-		if filterString == "" {
-			query += "ORDER BY `name` ASC "
-		} else {
-			query += "AND `name` > ? ORDER BY `name` ASC "
-		}
-	case "name_desc":
-		filterString = lastMemberName
-		if filterString == "" {
-			query += "ORDER BY `name` DESC "
+	var filter memberFilter
+	if name := c.QueryParam("name"); name != "" {
+		if match == matchReading {
+			filter.Reading, err = normalizeReading("name", name)
+			if err != nil {
+				return err
+			}
 		} else {
-			query += "AND `name` < ? ORDER BY `name` DESC "
+			filter.Name = name
 		}
-	default:
-		filterString = lastMemberID
-		if filterString == "" {
-			query += "ORDER BY `id` ASC "
-		} else {
-			query += "AND `id` > ? ORDER BY `id` ASC "
+	}
+
+	// 絞り込まないときの件数はプライマリ側のカウンタなので、一覧もプライマリで読んで揃える
+	reader := readDB(c)
+	if filter.empty() {
+		reader = router.primaryReader()
+	}
+
+	var last *Member
+	if lastMemberID != "" {
+		last = &Member{ID: lastMemberID}
+		if order == "name_asc" || order == "name_desc" {
+			err = reader.GetContext(c.Request().Context(), last, memberWithReadingQuery+"WHERE m.`id` = ?", lastMemberID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(http.StatusBadRequest, "last_member_id not found")
+				}
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
 		}
 	}
-	query += "LIMIT ?"
 
-	members := []Member{}
-	if filterString == "" {
-		err = db.SelectContext(c.Request().Context(), &members, query, memberPageLimit)
+	var total int
+	if filter.empty() {
+		notBanned, err := counters.Get(c.Request().Context(), counterNotBannedMembers)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		total = int(notBanned)
 	} else {
-		err = db.SelectContext(c.Request().Context(), &members, query, filterString, memberPageLimit)
+		total, err = countMembers(c.Request().Context(), reader, filter)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 	}
+
+	members, err := selectMembers(c.Request().Context(), reader, filter, order, last, cfg.Pages.MemberLimit)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -465,7 +801,7 @@ func getMembersHandler(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, GetMembersResponse{
 		Members: members,
-		Total:   int(notBannedMemberNum.Load()),
+		Total:   total,
 	})
 }
 
@@ -488,7 +824,7 @@ func getMemberHandler(c echo.Context) error {
 	}
 
 	member := Member{}
-	err := db.GetContext(c.Request().Context(), &member, "SELECT * FROM `member` WHERE `id` = ? AND `banned` = false", id)
+	err := readDB(c).GetContext(c.Request().Context(), &member, memberWithReadingQuery+"WHERE m.`id` = ? AND m.`banned` = false", id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, err.Error())
@@ -504,6 +840,8 @@ type PatchMemberRequest struct {
 	Name        string `json:"name"`
 	Address     string `json:"address"`
 	PhoneNumber string `json:"phone_number"`
+	NameReading string `json:"name_reading"`
+	Email       string `json:"email"`
 }
 
 // 会員情報編集
@@ -517,26 +855,16 @@ func patchMemberHandler(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	if req.Name == "" && req.Address == "" && req.PhoneNumber == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "name, address or phoneNumber is required")
+	if req.Name == "" && req.Address == "" && req.PhoneNumber == "" && req.NameReading == "" && req.Email == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name, address, phoneNumber, nameReading or email is required")
 	}
-
-	tx, err := db.BeginTxx(c.Request().Context(), nil)
+	nameReading, err := normalizeReading("name_reading", req.NameReading)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
-
-	// 会員の存在を確認
-	err = tx.GetContext(c.Request().Context(), &Member{}, "SELECT * FROM `member` WHERE `id` = ? AND `banned` = false", id)
+	email, err := normalizeEmail(req.Email)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
-		}
-
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
 	}
 
 	query := "UPDATE `member` SET "
@@ -557,58 +885,104 @@ func patchMemberHandler(c echo.Context) error {
 	query += " WHERE `id` = ?"
 	params = append(params, id)
 
-	_, err = tx.ExecContext(c.Request().Context(), query, params...)
+	err = runInTx(c.Request().Context(), nil, func(tx *sqlx.Tx) error {
+		// 会員の存在を確認
+		err := tx.GetContext(c.Request().Context(), &Member{}, forUpdate("SELECT * FROM `member` WHERE `id` = ? AND `banned` = false"), id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+
+			return err
+		}
+
+		if len(params) > 1 {
+			_, err = tx.ExecContext(c.Request().Context(), query, params...)
+			if err != nil {
+				return err
+			}
+		}
+		if nameReading != "" {
+			if err := setMemberReading(c.Request().Context(), tx, id, nameReading); err != nil {
+				return err
+			}
+		}
+		if email != "" {
+			return setMemberEmail(c.Request().Context(), tx, id, email)
+		}
+		return nil
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return txHTTPError(err)
 	}
-
-	_ = tx.Commit()
+	router.markWrite(id)
 
 	return c.NoContent(http.StatusNoContent)
 }
 
-// 会員をBAN
+// 会員をBAN (reason で理由を残せる)
 func banMemberHandler(c echo.Context) error {
 	id := c.Param("id")
 	if id == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
 	}
+	reason := c.QueryParam("reason")
+	if utf8.RuneCountInString(reason) > maxSanctionReasonLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "reason is too long")
+	}
 
-	tx, err := db.BeginTxx(c.Request().Context(), nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	sanction := newMemberSanction(id, banActionBan, sanctionSourceManual, reason, "", nil)
+	if err := banMember(c.Request().Context(), sanction); err != nil {
+		return txHTTPError(err)
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
 
-	// 会員の存在を確認
-	err = tx.GetContext(c.Request().Context(), &Member{}, "SELECT * FROM `member` WHERE `id` = ? AND `banned` = false", id)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 会員をBANして貸出を消し、理由を member_sanction に残す
+// 会員がいない (BAN済みを含む) ときは404のHTTPErrorを返す
+func banMember(ctx context.Context, sanction MemberSanction) error {
+	id := sanction.MemberID
+	deltas := counterDeltas{}
+	deltas.add(counterNotBannedMembers, -1)
+	event := newEvent(eventMemberBanned, MemberBannedEvent{MemberID: id, Source: sanction.Source, Reason: sanction.Reason})
+	err := runCounterTx(ctx, deltas, func(tx *sqlx.Tx) error {
+		// 会員の存在を確認
+		err := tx.GetContext(ctx, &Member{}, forUpdate("SELECT * FROM `member` WHERE `id` = ? AND `banned` = false"), id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+
+			return err
 		}
 
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
+		// 貸出を消す前に記録する (きっかけの貸出が返却済みでないか確かめる)
+		if err := insertMemberSanction(ctx, tx, sanction); err != nil {
+			return err
+		}
 
-	_, err = tx.ExecContext(c.Request().Context(), "UPDATE `member` SET `banned` = true WHERE `id` = ?", id)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
+		_, err = tx.ExecContext(ctx, "UPDATE `member` SET `banned` = true WHERE `id` = ?", id)
+		if err != nil {
+			return err
+		}
 
-	_, err = tx.ExecContext(c.Request().Context(), "DELETE FROM `lending` WHERE `member_id` = ?", id)
+		_, err = tx.ExecContext(ctx, "DELETE FROM `lending` WHERE `member_id` = ?", id)
+		if err != nil {
+			return err
+		}
+		return enqueueEvents(ctx, tx, event)
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
 	}
+	router.markWrite(id)
+	publishEvents(event)
 
-	notBannedMemberNum.Add(-1)
-	_ = tx.Commit()
-
-	return c.NoContent(http.StatusNoContent)
+	return nil
 }
 
-// 会員証用のQRコードを取得
+// 会員証用のQRコードを取得 (format=png|svg, scale で形式と大きさを変えられる)
 func getMemberQRCodeHandler(c echo.Context) error {
 	id := c.Param("id")
 	if id == "" {
@@ -616,7 +990,7 @@ func getMemberQRCodeHandler(c echo.Context) error {
 	}
 
 	// 会員の存在確認
-	err := db.GetContext(c.Request().Context(), &Member{}, "SELECT * FROM `member` WHERE `id` = ? AND `banned` = false", id)
+	err := readDB(c).GetContext(c.Request().Context(), &Member{}, "SELECT * FROM `member` WHERE `id` = ? AND `banned` = false", id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, err.Error())
@@ -625,12 +999,7 @@ func getMemberQRCodeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	qrCode, err := generateQRCode(id)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-
-	return c.Blob(http.StatusOK, "image/png", qrCode)
+	return writeQRCode(c, id)
 }
 
 /*
@@ -640,19 +1009,11 @@ Books API
 */
 
 type PostBooksRequest struct {
-	Title  string `json:"title"`
-	Author string `json:"author"`
-	Genre  Genre  `json:"genre"`
-}
-
-type bookTitleSuffix struct {
-	BookID      string `db:"book_id"`
-	TitleSuffix string `db:"title_suffix"`
-}
-
-type bookAuthorSuffix struct {
-	BookID       string `db:"book_id"`
-	AuthorSuffix string `db:"author_suffix"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	Genre         Genre  `json:"genre"`
+	TitleReading  string `json:"title_reading"`
+	AuthorReading string `json:"author_reading"`
 }
 
 // 蔵書を登録 (複数札を一気に登録)
@@ -662,9 +1023,10 @@ func postBooksHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	createdAt := time.Now().In(time.FixedZone("Asia/Tokyo", 9*60*60)).Truncate(time.Microsecond)
+	createdAt := currentTime()
 
 	books := make([]Book, 0, len(reqSlice))
+	var readings []bookReading
 	for _, req := range reqSlice {
 		if req.Title == "" || req.Author == "" {
 			return echo.NewHTTPError(http.StatusBadRequest, "title, author is required")
@@ -672,75 +1034,83 @@ func postBooksHandler(c echo.Context) error {
 		if req.Genre < 0 || req.Genre > 9 {
 			return echo.NewHTTPError(http.StatusBadRequest, "genre is invalid")
 		}
-		books = append(books, Book{
-			ID:        generateID(),
-			Title:     req.Title,
-			Author:    req.Author,
-			Genre:     req.Genre,
-			CreatedAt: createdAt,
-		})
+		titleReading, err := normalizeReading("title_reading", req.TitleReading)
+		if err != nil {
+			return err
+		}
+		authorReading, err := normalizeReading("author_reading", req.AuthorReading)
+		if err != nil {
+			return err
+		}
+		book := Book{
+			ID:            generateID(),
+			Title:         req.Title,
+			Author:        req.Author,
+			Genre:         req.Genre,
+			CreatedAt:     createdAt,
+			TitleReading:  titleReading,
+			AuthorReading: authorReading,
+		}
+		books = append(books, book)
+		if titleReading != "" || authorReading != "" {
+			readings = append(readings, bookReading{BookID: book.ID, TitleReading: titleReading, AuthorReading: authorReading})
+		}
 	}
 
-	bookTitleSuffixes := make([]bookTitleSuffix, 0, len(books))
-	bookAuthorSuffixes := make([]bookAuthorSuffix, 0, len(books))
+	suffixBooks := make([]suffix.Book, 0, len(books))
+	deltas := counterDeltas{}
+	events := make([]Event, 0, len(books))
 	for _, book := range books {
-		title := []rune(book.Title)
-		for i := 0; i < len(title); i++ {
-			bookTitleSuffixes = append(bookTitleSuffixes, bookTitleSuffix{
-				BookID:      book.ID,
-				TitleSuffix: string(title[i:]),
-			})
-		}
-		author := []rune(book.Author)
-		for i := 0; i < len(author); i++ {
-			bookAuthorSuffixes = append(bookAuthorSuffixes, bookAuthorSuffix{
-				BookID:       book.ID,
-				AuthorSuffix: string(author[i:]),
-			})
-		}
-	}
-	tx, err := db.BeginTxx(c.Request().Context(), nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		suffixBooks = append(suffixBooks, suffix.Book{ID: book.ID, Title: book.Title, Author: book.Author})
+		deltas.add(bookGenreCounterKey(book.Genre), 1)
+		events = append(events, newEvent(eventBookCreated, book))
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
-	// bulk insert
-	_, err = db.NamedExecContext(c.Request().Context(), "INSERT INTO `book` (`id`, `title`, `author`, `genre`, `created_at`) VALUES (:id , :title , :author , :genre , :created_at)", books)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-	_, err = db.NamedExecContext(c.Request().Context(), "INSERT INTO `book_title_suffix` (`book_id`, `title_suffix`) VALUES (:book_id , :title_suffix)", bookTitleSuffixes)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-	_, err = db.NamedExecContext(c.Request().Context(), "INSERT INTO `book_author_suffix` (`book_id`, `author_suffix`) VALUES (:book_id , :author_suffix)", bookAuthorSuffixes)
+	err := runCounterTx(c.Request().Context(), deltas, func(tx *sqlx.Tx) error {
+		// bulk insert
+		_, err := tx.NamedExecContext(c.Request().Context(), "INSERT INTO `book` (`id`, `title`, `author`, `genre`, `created_at`) VALUES (:id , :title , :author , :genre , :created_at)", books)
+		if err != nil {
+			return err
+		}
+		for _, kind := range suffix.Kinds {
+			if err := suffix.Insert(c.Request().Context(), tx, kind, suffix.Rows(kind, suffixBooks...)); err != nil {
+				return err
+			}
+		}
+		if err := setBookReadings(c.Request().Context(), tx, readings); err != nil {
+			return err
+		}
+		return enqueueEvents(c.Request().Context(), tx, events...)
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return txHTTPError(err)
 	}
+	publishEvents(events...)
 
-	for _, req := range reqSlice {
-		bookByGenreCache[req.Genre].Add(1)
+	bookIDs := make([]string, 0, len(books))
+	for _, book := range books {
+		bookIDs = append(bookIDs, book.ID)
 	}
-
-	_ = tx.Commit()
+	router.markBookWrite(bookIDs...)
+	addLogAttrs(c, slog.Any("book_ids", bookIDs))
 
 	return c.JSON(http.StatusCreated, books)
 }
 
-const bookPageLimit = 50
-
 type GetBooksResponse struct {
 	Books []GetBookResponse `json:"books"`
 	Total int               `json:"total"`
 }
 
 // 蔵書を検索
+// match=reading ならタイトル・著者を読み仮名の前方一致で探す
 func getBooksHandler(c echo.Context) error {
 	title := c.QueryParam("title")
 	author := c.QueryParam("author")
 	genre := c.QueryParam("genre")
+	match, err := parseMatch(c)
+	if err != nil {
+		return err
+	}
 	if genre != "" {
 		genreInt, err := strconv.Atoi(genre)
 		if err != nil {
@@ -760,7 +1130,21 @@ func getBooksHandler(c echo.Context) error {
 		pageStr = "1"
 	}
 
-	tx, err := db.BeginTxx(c.Request().Context(), nil)
+	if match == matchReading {
+		if title, err = normalizeReading("title", title); err != nil {
+			return err
+		}
+		if author, err = normalizeReading("author", author); err != nil {
+			return err
+		}
+	}
+
+	// 分類だけで絞り込むときの件数はプライマリ側のカウンタなので、一覧もプライマリで読んで揃える
+	reader := readDB(c)
+	if genre != "" && title == "" && author == "" {
+		reader = router.primaryReader()
+	}
+	tx, err := reader.BeginTxx(c.Request().Context(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -774,13 +1158,26 @@ func getBooksHandler(c echo.Context) error {
 		query += "genre = ? AND "
 		args = append(args, genre)
 	}
-	if title != "" {
-		query += "id in (SELECT book_id from book_title_suffix WHERE title_suffix LIKE ? ) AND "
-		args = append(args, title+"%")
-	}
-	if author != "" {
-		query += "id in (SELECT book_id from book_author_suffix WHERE author_suffix LIKE ? ) AND "
-		args = append(args, author+"%")
+	switch {
+	case match == matchReading:
+		if title != "" {
+			query += "id in (SELECT book_id from book_reading WHERE title_reading LIKE ? ) AND "
+			args = append(args, title+"%")
+		}
+		if author != "" {
+			query += "id in (SELECT book_id from book_reading WHERE author_reading LIKE ? ) AND "
+			args = append(args, author+"%")
+		}
+	default:
+		// 接尾辞テーブルと同じ正規化をしてから前方一致で探す
+		if title != "" {
+			query += "id in (SELECT book_id from book_title_suffix WHERE title_suffix LIKE ?" + likeEscape() + ") AND "
+			args = append(args, likePrefix(suffix.Normalize(title)))
+		}
+		if author != "" {
+			query += "id in (SELECT book_id from book_author_suffix WHERE author_suffix LIKE ?" + likeEscape() + ") AND "
+			args = append(args, likePrefix(suffix.Normalize(author)))
+		}
 	}
 	query = strings.TrimSuffix(query, "AND ")
 
@@ -790,7 +1187,11 @@ func getBooksHandler(c echo.Context) error {
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
-		total = int(bookByGenreCache[Genre(genreInt)].Load())
+		genreTotal, err := counters.Get(c.Request().Context(), bookGenreCounterKey(Genre(genreInt)))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		total = int(genreTotal)
 	} else {
 		err = tx.GetContext(c.Request().Context(), &total, query, args...)
 		if err != nil {
@@ -809,7 +1210,7 @@ func getBooksHandler(c echo.Context) error {
 		args = append(args, lastBookID)
 	}
 	query += "ORDER BY `id` ASC LIMIT ? "
-	args = append(args, bookPageLimit)
+	args = append(args, cfg.Pages.BookLimit)
 
 	var books []Book
 	err = tx.SelectContext(c.Request().Context(), &books, query, args...)
@@ -819,6 +1220,9 @@ func getBooksHandler(c echo.Context) error {
 	if len(books) == 0 {
 		return echo.NewHTTPError(http.StatusNotFound, "no books to show in this page")
 	}
+	if err := attachBookReadings(c.Request().Context(), tx, books); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	res := GetBooksResponse{
 		Books: make([]GetBookResponse, len(books)),
@@ -832,7 +1236,7 @@ func getBooksHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	query = db.Rebind(query)
+	query = tx.Rebind(query)
 
 	var lendingBookIDs []string
 	err = tx.SelectContext(c.Request().Context(), &lendingBookIDs, query, args...)
@@ -882,7 +1286,7 @@ func getBookHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "encrypted must be boolean value")
 	}
 
-	tx, err := db.BeginTxx(c.Request().Context(), &sql.TxOptions{ReadOnly: true})
+	tx, err := readDB(c).BeginTxx(c.Request().Context(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -899,9 +1303,13 @@ func getBookHandler(c echo.Context) error {
 
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	books := []Book{book}
+	if err := attachBookReadings(c.Request().Context(), tx, books); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	res := GetBookResponse{
-		Book: book,
+		Book: books[0],
 	}
 	err = tx.GetContext(c.Request().Context(), &Lending{}, "SELECT * FROM `lending` WHERE `book_id` = ?", id) //TODO: LeftJoinで一回でいけそう
 	if err == nil {
@@ -917,7 +1325,66 @@ func getBookHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
-// 蔵書のQRコードを取得
+type PatchBookRequest struct {
+	TitleReading  string `json:"title_reading"`
+	AuthorReading string `json:"author_reading"`
+}
+
+// 蔵書の読み仮名を編集
+func patchBookHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
+	}
+
+	var req PatchBookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.TitleReading == "" && req.AuthorReading == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "titleReading or authorReading is required")
+	}
+	titleReading, err := normalizeReading("title_reading", req.TitleReading)
+	if err != nil {
+		return err
+	}
+	authorReading, err := normalizeReading("author_reading", req.AuthorReading)
+	if err != nil {
+		return err
+	}
+
+	err = runInTx(c.Request().Context(), nil, func(tx *sqlx.Tx) error {
+		// 蔵書の存在を確認
+		books := []Book{{}}
+		err := tx.GetContext(c.Request().Context(), &books[0], forUpdate("SELECT * FROM `book` WHERE `id` = ?"), id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+
+			return err
+		}
+		if err := attachBookReadings(c.Request().Context(), tx, books); err != nil {
+			return err
+		}
+
+		reading := bookReading{BookID: id, TitleReading: books[0].TitleReading, AuthorReading: books[0].AuthorReading}
+		if titleReading != "" {
+			reading.TitleReading = titleReading
+		}
+		if authorReading != "" {
+			reading.AuthorReading = authorReading
+		}
+		return setBookReadings(c.Request().Context(), tx, []bookReading{reading})
+	})
+	if err != nil {
+		return txHTTPError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 蔵書のQRコードを取得 (format=png|svg, scale で形式と大きさを変えられる)
 func getBookQRCodeHandler(c echo.Context) error {
 	id := c.Param("id")
 	if id == "" {
@@ -925,7 +1392,7 @@ func getBookQRCodeHandler(c echo.Context) error {
 	}
 
 	// 蔵書の存在確認
-	err := db.GetContext(c.Request().Context(), &Book{}, "SELECT * FROM `book` WHERE `id` = ?", id)
+	err := readDB(c).GetContext(c.Request().Context(), &Book{}, "SELECT * FROM `book` WHERE `id` = ?", id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, err.Error())
@@ -934,12 +1401,7 @@ func getBookQRCodeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	qrCode, err := generateQRCode(id)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-
-	return c.Blob(http.StatusOK, "image/png", qrCode)
+	return writeQRCode(c, id)
 }
 
 /*
@@ -974,73 +1436,120 @@ func postLendingsHandler(c echo.Context) error {
 	if len(req.BookIDs) == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest, "at least one book_ids is required")
 	}
+	addLogAttrs(c, slog.String("member_id", req.MemberID), slog.Any("book_ids", req.BookIDs))
 
-	tx, err := db.BeginTxx(c.Request().Context(), nil)
+	res, err := lendBooks(c.Request().Context(), req.MemberID, req.BookIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return txHTTPError(err)
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
 
-	// 会員の存在確認
-	var member Member
-	err = tx.GetContext(c.Request().Context(), &member, "SELECT * FROM `member` WHERE `id` = ?", req.MemberID) //TODO: お前Tx内でやる必要なくね
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
-		}
+	return c.JSON(http.StatusCreated, res)
+}
 
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+// 会員に蔵書をまとめて貸し出す
+func lendBooks(ctx context.Context, memberID string, bookIDs []string) ([]PostLendingsResponse, error) {
+	bookIDSet := make(map[string]struct{}, len(bookIDs))
+	for _, bookID := range bookIDs {
+		if _, ok := bookIDSet[bookID]; ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "book_ids must not contain duplicates")
+		}
+		bookIDSet[bookID] = struct{}{}
 	}
 
-	lendingTime := time.Now().In(time.FixedZone("Asia/Tokyo", 9*60*60)).Truncate(time.Microsecond)
-	due := lendingTime.Add(LendingPeriod * time.Millisecond) //MEMO: created_atから算出できるので持つ必要なさそう？
-	res := make([]PostLendingsResponse, len(req.BookIDs))
-
-	for i, bookID := range req.BookIDs {
-		// 蔵書の存在確認
-		var book Book
-		err = tx.GetContext(c.Request().Context(), &book, "SELECT * FROM `book` WHERE `id` = ?", bookID) //TODO: お前もTx内でやる必要ないよね。あとIN使え。
+	var (
+		res    []PostLendingsResponse
+		events []Event
+	)
+	err := runInTx(ctx, nil, func(tx *sqlx.Tx) error {
+		// 会員の存在確認
+		var member Member
+		err := tx.GetContext(ctx, &member, "SELECT * FROM `member` WHERE `id` = ?", memberID) //TODO: お前Tx内でやる必要なくね
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return echo.NewHTTPError(http.StatusNotFound, err.Error())
 			}
 
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return err
 		}
 
-		// 貸し出し中かどうか確認
-		var lending Lending
-		err = tx.GetContext(c.Request().Context(), &lending, "SELECT * FROM `lending` WHERE `book_id` = ?", bookID)
-		if err == nil {
-			return echo.NewHTTPError(http.StatusConflict, "this book is already lent")
-		} else if !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		lendingTime := currentTime()
+		// 延滞で停止されている会員には貸し出さない (停止する方針のときだけ確かめる)
+		if cfg.BanPolicy.Action == banActionSuspend {
+			suspension, err := activeSuspension(ctx, tx, memberID, lendingTime)
+			if err != nil {
+				return err
+			}
+			if suspension != nil {
+				return echo.NewHTTPError(http.StatusForbidden, "member is suspended until "+suspension.ExpiresAt.Format(time.RFC3339))
+			}
 		}
 
-		id := generateID()
+		due := lendingTime.Add(LendingPeriod * time.Millisecond) //MEMO: created_atから算出できるので持つ必要なさそう？
+		res = make([]PostLendingsResponse, len(bookIDs))
+		books := make([]Book, 0, len(bookIDs))
 
-		// 貸し出し
-		_, err = tx.ExecContext(c.Request().Context(),
-			"INSERT INTO `lending` (`id`, `book_id`, `member_id`, `due`, `created_at`) VALUES (?, ?, ?, ?, ?)", //TODO: bulkInsert
-			id, bookID, req.MemberID, due, lendingTime)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-		}
+		for i, bookID := range bookIDs {
+			// 蔵書の存在確認
+			var book Book
+			err = tx.GetContext(ctx, &book, "SELECT * FROM `book` WHERE `id` = ?", bookID) //TODO: お前もTx内でやる必要ないよね。あとIN使え。
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(http.StatusNotFound, err.Error())
+				}
 
-		err := tx.GetContext(c.Request().Context(), &res[i], "SELECT * FROM `lending` WHERE `id` = ?", id) //TODO: だから必要ないやろお前
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				return err
+			}
+
+			// 貸し出し中かどうか確認
+			// 同時に貸し出された場合はlending.book_idのユニーク制約でINSERTが失敗する
+			var lending Lending
+			err = tx.GetContext(ctx, &lending, "SELECT * FROM `lending` WHERE `book_id` = ?", bookID)
+			if err == nil {
+				return echo.NewHTTPError(http.StatusConflict, "this book is already lent")
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+
+			id := generateID()
+
+			// 貸し出し
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO `lending` (`id`, `book_id`, `member_id`, `due`, `created_at`) VALUES (?, ?, ?, ?, ?)", //TODO: bulkInsert
+				id, bookID, memberID, due, lendingTime)
+			if err != nil {
+				if isDuplicateKeyError(err) {
+					return echo.NewHTTPError(http.StatusConflict, "this book is already lent")
+				}
+
+				return err
+			}
+
+			err := tx.GetContext(ctx, &res[i], "SELECT * FROM `lending` WHERE `id` = ?", id) //TODO: だから必要ないやろお前
+			if err != nil {
+				return err
+			}
+
+			res[i].MemberName = member.Name
+			res[i].BookTitle = book.Title
+			books = append(books, book)
 		}
 
-		res[i].MemberName = member.Name
-		res[i].BookTitle = book.Title
+		if err := recordBorrowing(ctx, tx, memberID, books, lendingTime); err != nil {
+			return err
+		}
+		events = make([]Event, 0, len(res))
+		for _, lending := range res {
+			events = append(events, newEvent(eventLendingCreated, lending))
+		}
+		return enqueueEvents(ctx, tx, events...)
+	})
+	if err != nil {
+		return nil, err
 	}
+	router.markWrite(memberID)
+	publishEvents(events...)
 
-	_ = tx.Commit()
-
-	return c.JSON(http.StatusCreated, res)
+	return res, nil
 }
 
 type GetLendingsResponse struct {
@@ -1077,12 +1586,12 @@ func getLendingsHandler(c echo.Context) error {
 	args := []any{}
 	if overDue == "true" {
 		query += " WHERE `due` > ?"
-		args = append(args, time.Now().In(time.FixedZone("Asia/Tokyo", 9*60*60)).Truncate(time.Microsecond))
+		args = append(args, currentTime())
 	}
 	query += " ORDER BY `lending`.`id` ASC"
 
 	var lendings []GetLendingsHandlerQuery
-	err := db.SelectContext(c.Request().Context(), &lendings, query, args...)
+	err := readDB(c).SelectContext(c.Request().Context(), &lendings, query, args...)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -1122,46 +1631,50 @@ func returnLendingsHandler(c echo.Context) error {
 	if len(req.BookIDs) == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest, "at least one book_ids is required")
 	}
+	addLogAttrs(c, slog.String("member_id", req.MemberID), slog.Any("book_ids", req.BookIDs))
 
-	tx, err := db.BeginTxx(c.Request().Context(), nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
-
-	// 会員の存在確認
-	err = tx.GetContext(c.Request().Context(), &Member{}, "SELECT * FROM `member` WHERE `id` = ?", req.MemberID)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
-		}
-
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-	}
-
-	for _, bookID := range req.BookIDs {
-		// 貸し出しの存在確認
-		var lending Lending
-		err = tx.GetContext(c.Request().Context(), &lending,
-			"SELECT * FROM `lending` WHERE `member_id` = ? AND `book_id` = ?", req.MemberID, bookID) //TODO: 消してみてダメだったらnotFoundを返せばいいので、これいらないはず
+	var events []Event
+	err := runInTx(c.Request().Context(), nil, func(tx *sqlx.Tx) error {
+		// 会員の存在確認
+		err := tx.GetContext(c.Request().Context(), &Member{}, "SELECT * FROM `member` WHERE `id` = ?", req.MemberID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return echo.NewHTTPError(http.StatusNotFound, err.Error())
 			}
 
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			return err
 		}
 
-		_, err = tx.ExecContext(c.Request().Context(),
-			"DELETE FROM `lending` WHERE `member_id` =? AND `book_id` =?", req.MemberID, bookID)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		returnedAt := currentTime()
+		events = make([]Event, 0, len(req.BookIDs))
+		for _, bookID := range req.BookIDs {
+			// 貸し出しの存在確認
+			var lending Lending
+			err = tx.GetContext(c.Request().Context(), &lending,
+				forUpdate("SELECT * FROM `lending` WHERE `member_id` = ? AND `book_id` = ?"), req.MemberID, bookID) //TODO: 消してみてダメだったらnotFoundを返せばいいので、これいらないはず
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(http.StatusNotFound, err.Error())
+				}
+
+				return err
+			}
+
+			_, err = tx.ExecContext(c.Request().Context(),
+				"DELETE FROM `lending` WHERE `member_id` =? AND `book_id` =?", req.MemberID, bookID)
+			if err != nil {
+				return err
+			}
+			events = append(events, newEvent(eventLendingReturned, LendingReturnedEvent{Lending: lending, ReturnedAt: returnedAt}))
 		}
-	}
 
-	_ = tx.Commit()
+		return enqueueEvents(c.Request().Context(), tx, events...)
+	})
+	if err != nil {
+		return txHTTPError(err)
+	}
+	router.markWrite(req.MemberID)
+	publishEvents(events...)
 
 	return c.NoContent(http.StatusNoContent)
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+/*
+---------------------------------------------------------------
+Metrics
+---------------------------------------------------------------
+*/
+
+const metricsNamespace = "isulibrary"
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and status.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "route", "status"})
+
+	qrCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "qrcode_cache_hits_total",
+		Help:      "Number of QR code requests served from the image cache.",
+	})
+
+	qrCacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "qrcode_cache_misses_total",
+		Help:      "Number of QR code requests that had to generate a new image.",
+	})
+)
+
+// スクレイプ時にDBへ問い合わせる際のタイムアウト
+const metricsQueryTimeout = 500 * time.Millisecond
+
+// /metrics を登録してリクエスト計測用のミドルウェアを設定
+func registerMetrics(e *echo.Echo) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db.DB, "isulibrary"),
+		httpRequestsTotal,
+		httpRequestDuration,
+		qrCacheHitsTotal,
+		qrCacheMissesTotal,
+		cacheReconcileTotal,
+		cacheDriftTotal,
+		cacheDriftAbsolute,
+		remindersSentTotal,
+		remindersFailedTotal,
+		banPolicyActionsTotal,
+		webhookDeliveriesTotal,
+		&libraryCollector{},
+	)
+
+	e.Use(metricsMiddleware)
+	e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+}
+
+// ルート(echoのパス)とステータスごとにリクエスト数とレイテンシを記録
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Path() == "/metrics" {
+			return next(c)
+		}
+
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else {
+				status = http.StatusInternalServerError
+			}
+		}
+
+		labels := prometheus.Labels{
+			"method": c.Request().Method,
+			"route":  c.Path(),
+			"status": strconv.Itoa(status),
+		}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// プロセス内のキャッシュと貸出状況を公開するコレクタ
+type libraryCollector struct{}
+
+var (
+	notBannedMembersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "not_banned_members"),
+		"Number of members that are not banned (list total counter).",
+		nil, nil)
+	booksByGenreDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "books"),
+		"Number of books by genre (list total counter).",
+		[]string{"genre"}, nil)
+	activeLendingsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "lendings_active"),
+		"Number of books currently lent.",
+		nil, nil)
+	overdueLendingsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "lendings_overdue"),
+		"Number of lendings past their due date.",
+		nil, nil)
+	qrCacheHitRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "qrcode_cache_hit_ratio"),
+		"Ratio of QR code requests served from the image cache since startup.",
+		nil, nil)
+	scrapeErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "scrape_error"),
+		"1 if querying the database for lending metrics failed.",
+		nil, nil)
+)
+
+func (*libraryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- notBannedMembersDesc
+	ch <- booksByGenreDesc
+	ch <- activeLendingsDesc
+	ch <- overdueLendingsDesc
+	ch <- qrCacheHitRatioDesc
+	ch <- scrapeErrorsDesc
+}
+
+func (*libraryCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsQueryTimeout)
+	defer cancel()
+
+	if snapshot, err := counters.Snapshot(ctx, db); err == nil {
+		ch <- prometheus.MustNewConstMetric(notBannedMembersDesc, prometheus.GaugeValue, float64(snapshot[counterNotBannedMembers]))
+		for genre := General; genre <= Geography; genre++ {
+			ch <- prometheus.MustNewConstMetric(booksByGenreDesc, prometheus.GaugeValue, float64(snapshot[bookGenreCounterKey(genre)]), strconv.Itoa(int(genre)))
+		}
+	}
+
+	hits, misses := counterValue(qrCacheHitsTotal), counterValue(qrCacheMissesTotal)
+	if hits+misses > 0 {
+		ch <- prometheus.MustNewConstMetric(qrCacheHitRatioDesc, prometheus.GaugeValue, hits/(hits+misses))
+	}
+
+	var lendings struct {
+		Active  int64 `db:"active"`
+		Overdue int64 `db:"overdue"`
+	}
+	err := db.GetContext(ctx, &lendings,
+		"SELECT COUNT(*) AS `active`, COALESCE(SUM(`due` < ?), 0) AS `overdue` FROM `lending`",
+		currentTime())
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(activeLendingsDesc, prometheus.GaugeValue, float64(lendings.Active))
+	ch <- prometheus.MustNewConstMetric(overdueLendingsDesc, prometheus.GaugeValue, float64(lendings.Overdue))
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
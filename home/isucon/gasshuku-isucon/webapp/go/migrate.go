@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+---------------------------------------------------------------
+Migrations
+---------------------------------------------------------------
+*/
+
+// migrations/<dialect>/<version>_<name>.{up,down}.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// 存在しないテーブル・インデックスを消そうとした (スキーマを作り直すときは無視する)
+const (
+	mysqlErrCantDropFieldOrKey = 1091 // ER_CANT_DROP_FIELD_OR_KEY
+	mysqlErrNoSuchTable        = 1146 // ER_NO_SUCH_TABLE
+)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// スキーマのマイグレーションを適用する
+type migrator struct {
+	db         *sqlx.DB
+	dialect    sqlDialect
+	migrations []migration
+}
+
+func newMigrator(db *sqlx.DB, d sqlDialect) (*migrator, error) {
+	migrations, err := loadMigrations(d)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+// 埋め込んだマイグレーションをバージョン順に読み込む
+func loadMigrations(d sqlDialect) ([]migration, error) {
+	dir := path.Join("migrations", string(d))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s, %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (m *migrator) ensureTable(ctx context.Context) error {
+	query := "CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+		"`version` bigint NOT NULL, `name` varchar(255) NOT NULL, `applied_at` datetime(6) NOT NULL, PRIMARY KEY (`version`)" +
+		") ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4"
+	if m.dialect == dialectSQLite {
+		query = "CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+			"`version` bigint NOT NULL, `name` varchar(255) NOT NULL, `applied_at` datetime NOT NULL, PRIMARY KEY (`version`))"
+	}
+	_, err := m.db.ExecContext(ctx, query)
+	return err
+}
+
+// 適用済みのバージョンと適用日時
+func (m *migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := m.db.SelectContext(ctx, &rows, "SELECT `version`, `applied_at` FROM `schema_migrations`"); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+func (m *migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if at, ok := applied[mig.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// 未適用のマイグレーション
+func (m *migrator) Pending(ctx context.Context) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// 未適用のマイグレーションを古い順にsteps個 (0以下なら全部) 適用する
+// マイグレーションを入れる前に作ったDBは、先に adoptBaseline で取り込む
+func (m *migrator) Up(ctx context.Context, steps int) ([]migration, error) {
+	if err := m.adoptBaseline(ctx); err != nil {
+		return nil, err
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if steps > 0 && steps < len(pending) {
+		pending = pending[:steps]
+	}
+
+	for i, mig := range pending {
+		if err := m.apply(ctx, mig, true, false); err != nil {
+			return pending[:i], err
+		}
+	}
+	return pending, nil
+}
+
+// 適用済みのマイグレーションを新しい順にsteps個 (0以下なら全部) 戻す
+func (m *migrator) Down(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if _, ok := applied[m.migrations[i].Version]; ok {
+			targets = append(targets, m.migrations[i])
+		}
+	}
+	if steps > 0 && steps < len(targets) {
+		targets = targets[:steps]
+	}
+
+	for i, mig := range targets {
+		if err := m.apply(ctx, mig, false, false); err != nil {
+			return targets[:i], err
+		}
+	}
+	return targets, nil
+}
+
+// スキーマを空から作り直す (初期化用)
+// マイグレーションの管理外で作られたテーブルも消せるよう、適用状況にかかわらずすべて戻してから適用する
+func (m *migrator) Reset(ctx context.Context) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if err := m.apply(ctx, m.migrations[i], false, true); err != nil {
+			return err
+		}
+	}
+	_, err := m.Up(ctx, 0)
+	return err
+}
+
+// マイグレーションを1つ適用し、schema_migrationsに記録する
+// MySQLではDDLが暗黙にコミットされるので、途中で失敗した場合は手で直す必要がある
+func (m *migrator) apply(ctx context.Context, mig migration, up bool, ignoreMissing bool) error {
+	body, direction := mig.Down, "down"
+	if up {
+		body, direction = mig.Up, "up"
+	}
+
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	scanner := newSQLStatementScanner(strings.NewReader(body))
+	for {
+		stmt, err := scanner.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d_%s (%s): %w", mig.Version, mig.Name, direction, err)
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			if ignoreMissing && (isMySQLError(err, mysqlErrCantDropFieldOrKey) || isMySQLError(err, mysqlErrNoSuchTable)) {
+				continue
+			}
+			return fmt.Errorf("migration %d_%s (%s): %w", mig.Version, mig.Name, direction, err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO `schema_migrations` (`version`, `name`, `applied_at`) VALUES (?, ?, ?)",
+			mig.Version, mig.Name, currentTime())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM `schema_migrations` WHERE `version` = ?", mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	appLogger.Info("migration applied", slog.Int("version", mig.Version), slog.String("name", mig.Name), slog.String("direction", direction))
+	return nil
+}
+
+/* --- Baseline Adoption --- */
+
+// マイグレーションを入れる前の 0_schema.sql (と 3_index.sql) で作ったDBには schema_migrations がない
+// そのまま up すると 0001 の CREATE TABLE IF NOT EXISTS が何もせずに適用済みになり、
+// UQ_book_id などのキーが入らないので、既存のテーブルのキーを確かめて足してからバージョンを記録する
+
+// 0001 で作るテーブル (member があればマイグレーション前のDBとみなし、残りもそろっているか確かめる)
+var baselineTables = []string{"book", "key", "lending", "member", "book_title_suffix", "book_author_suffix"}
+
+// 以前のスキーマ・インデックスのスクリプトで作られていない (か別の名前で作られた) かもしれないキー
+type baselineIndex struct {
+	Version int
+	Table   string
+	Name    string
+	// カンマ区切り
+	Columns string
+	Unique  bool
+}
+
+var baselineIndexes = []baselineIndex{
+	{Version: 1, Table: "lending", Name: "UQ_book_id", Columns: "book_id", Unique: true},
+	{Version: 3, Table: "book_title_suffix", Name: "IX_book_title_suffix", Columns: "title_suffix"},
+	{Version: 3, Table: "book_author_suffix", Name: "IX_book_author_suffix", Columns: "author_suffix"},
+	{Version: 3, Table: "lending", Name: "IX_lending_member_id", Columns: "member_id"},
+	{Version: 4, Table: "book_title_suffix", Name: "IX_book_title_suffix_book_id", Columns: "book_id"},
+	{Version: 4, Table: "book_author_suffix", Name: "IX_book_author_suffix_book_id", Columns: "book_id"},
+}
+
+// マイグレーション前のDBなら、足りないキーを足し、同じ列の別名のキーは名前をそろえて、0001・0003・0004 を適用済みにする
+// 取り込めない (テーブルが一部しかない、貸出が重複している) ときは手で直すようエラーにする
+func (m *migrator) adoptBaseline(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		return nil
+	}
+	if ok, err := m.tableExists(ctx, "member"); err != nil || !ok {
+		return err
+	}
+
+	for _, table := range baselineTables {
+		ok, err := m.tableExists(ctx, table)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("schema_migrations is empty but table %s is missing; fix the schema by hand before running migrations", table)
+		}
+	}
+	if m.dialect == dialectSQLite {
+		return fmt.Errorf("sqlite database was created before migrations; delete it and let the server recreate it")
+	}
+
+	versions := map[int]bool{}
+	for _, idx := range baselineIndexes {
+		if err := m.ensureBaselineIndex(ctx, idx); err != nil {
+			return fmt.Errorf("adopt existing schema: %w", err)
+		}
+		versions[idx.Version] = true
+	}
+	for _, mig := range m.migrations {
+		if mig.Version != 1 && !versions[mig.Version] {
+			continue
+		}
+		_, err := m.db.ExecContext(ctx, "INSERT INTO `schema_migrations` (`version`, `name`, `applied_at`) VALUES (?, ?, ?)",
+			mig.Version, mig.Name, currentTime())
+		if err != nil {
+			return err
+		}
+		appLogger.Info("migration adopted", slog.Int("version", mig.Version), slog.String("name", mig.Name))
+	}
+	return nil
+}
+
+func (m *migrator) tableExists(ctx context.Context, table string) (bool, error) {
+	query := "SELECT COUNT(*) FROM `information_schema`.`TABLES` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ?"
+	if m.dialect == dialectSQLite {
+		query = "SELECT COUNT(*) FROM `sqlite_master` WHERE `type` = 'table' AND `name` = ?"
+	}
+	var n int
+	err := m.db.GetContext(ctx, &n, query, table)
+	return n > 0, err
+}
+
+// キーがなければ作る (MySQL)
+func (m *migrator) ensureBaselineIndex(ctx context.Context, idx baselineIndex) error {
+	var indexes []struct {
+		Name      string `db:"name"`
+		NonUnique bool   `db:"non_unique"`
+		Columns   string `db:"columns"`
+	}
+	err := m.db.SelectContext(ctx, &indexes,
+		"SELECT `INDEX_NAME` AS `name`, MAX(`NON_UNIQUE`) AS `non_unique`, "+
+			"GROUP_CONCAT(`COLUMN_NAME` ORDER BY `SEQ_IN_INDEX` SEPARATOR ',') AS `columns` "+
+			"FROM `information_schema`.`STATISTICS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? GROUP BY `INDEX_NAME`",
+		idx.Table)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range indexes {
+		if existing.Name == idx.Name {
+			if existing.Columns != idx.Columns || existing.NonUnique == idx.Unique {
+				return fmt.Errorf("index %s on %s is (%s) unique=%t, want (%s) unique=%t",
+					idx.Name, idx.Table, existing.Columns, !existing.NonUnique, idx.Columns, idx.Unique)
+			}
+			return nil
+		}
+	}
+	for _, existing := range indexes {
+		if existing.Name != "PRIMARY" && existing.Columns == idx.Columns && existing.NonUnique != idx.Unique {
+			// 以前のスクリプトが別の名前で作った (down で消せるよう名前をそろえる)
+			_, err := m.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE `%s` RENAME INDEX `%s` TO `%s`", idx.Table, existing.Name, idx.Name))
+			return err
+		}
+	}
+
+	if idx.Unique {
+		var duplicate string
+		err := m.db.GetContext(ctx, &duplicate,
+			fmt.Sprintf("SELECT `%s` FROM `%s` GROUP BY `%s` HAVING COUNT(*) > 1 LIMIT 1", idx.Columns, idx.Table, idx.Columns))
+		if err == nil {
+			return fmt.Errorf("cannot add unique key %s: %s has duplicate %s %q; resolve it by hand", idx.Name, idx.Table, idx.Columns, duplicate)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	kind := "INDEX"
+	if idx.Unique {
+		kind = "UNIQUE KEY"
+	}
+	_, err = m.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE `%s` ADD %s `%s` (`%s`)", idx.Table, kind, idx.Name, idx.Columns))
+	return err
+}
+
+// スキーマが最新でなければエラーを返す (起動時の確認用)
+func checkSchemaVersion(ctx context.Context) error {
+	m, err := newMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("schema is behind: %d pending migration(s) starting at %04d_%s; run `migrate up`",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+// migrate up [N] | down [N] | status
+func runMigrateCommand(ctx context.Context, args []string, out io.Writer) error {
+	usage := fmt.Errorf("usage: migrate up [N] | down [N] | status")
+	if len(args) == 0 || len(args) > 2 {
+		return usage
+	}
+
+	m, err := newMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	steps := 0
+	if len(args) == 2 {
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps <= 0 {
+			return usage
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx, steps)
+		for _, mig := range applied {
+			fmt.Fprintf(out, "up   %04d_%s\n", mig.Version, mig.Name)
+		}
+		return err
+
+	case "down":
+		// 誤ってすべて消さないよう、既定では1つだけ戻す
+		if steps == 0 {
+			steps = 1
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, mig := range reverted {
+			fmt.Fprintf(out, "down %04d_%s\n", mig.Version, mig.Name)
+		}
+		return err
+
+	case "status":
+		if len(args) != 1 {
+			return usage
+		}
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.In(location).Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	}
+
+	return usage
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS `book_author_suffix`;
+DROP TABLE IF EXISTS `book_title_suffix`;
+DROP TABLE IF EXISTS `member`;
+DROP TABLE IF EXISTS `lending`;
+DROP TABLE IF EXISTS `key`;
+DROP TABLE IF EXISTS `book`;
@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS `book` (
+  `id` varchar(26) NOT NULL,
+  `title` varchar(255) NOT NULL,
+  `author` varchar(255) NOT NULL,
+  `genre` int NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_genre_id` (`genre`, `id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `key` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `key` char(16) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `lending` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(255) NOT NULL,
+  `book_id` varchar(255) NOT NULL,
+  `due` datetime(6) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `UQ_book_id` (`book_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `member` (
+  `id` varchar(26) NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `address` varchar(255) NOT NULL,
+  `phone_number` varchar(255) NOT NULL,
+  `banned` tinyint(1) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_banned_id` (`banned`, `id`),
+  INDEX `IX_banned_name` (`banned`, `name`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `book_title_suffix` (
+  `book_id` varchar(26) NOT NULL,
+  `title_suffix` varchar(255) NOT NULL
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `book_author_suffix` (
+  `book_id` varchar(26) NOT NULL,
+  `author_suffix` varchar(255) NOT NULL
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS `stats` (
+  `name` varchar(64) NOT NULL,
+  `value` bigint NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
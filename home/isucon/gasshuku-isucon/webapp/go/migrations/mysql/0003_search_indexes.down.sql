@@ -0,0 +1,3 @@
+DROP INDEX `IX_lending_member_id` ON `lending`;
+DROP INDEX `IX_book_author_suffix` ON `book_author_suffix`;
+DROP INDEX `IX_book_title_suffix` ON `book_title_suffix`;
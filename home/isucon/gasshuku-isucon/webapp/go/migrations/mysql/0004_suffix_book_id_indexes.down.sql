@@ -0,0 +1,2 @@
+DROP INDEX `IX_book_author_suffix_book_id` ON `book_author_suffix`;
+DROP INDEX `IX_book_title_suffix_book_id` ON `book_title_suffix`;
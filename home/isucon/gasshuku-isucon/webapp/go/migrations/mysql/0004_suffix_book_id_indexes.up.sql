@@ -0,0 +1,2 @@
+CREATE INDEX `IX_book_title_suffix_book_id` ON `book_title_suffix` (`book_id`);
+CREATE INDEX `IX_book_author_suffix_book_id` ON `book_author_suffix` (`book_id`);
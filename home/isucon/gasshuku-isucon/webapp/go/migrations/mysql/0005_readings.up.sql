@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS `member_reading` (
+  `member_id` varchar(26) NOT NULL,
+  `reading` varchar(255) NOT NULL,
+  PRIMARY KEY (`member_id`),
+  INDEX `IX_member_reading` (`reading`, `member_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `book_reading` (
+  `book_id` varchar(26) NOT NULL,
+  `title_reading` varchar(255) NOT NULL,
+  `author_reading` varchar(255) NOT NULL,
+  PRIMARY KEY (`book_id`),
+  INDEX `IX_book_title_reading` (`title_reading`),
+  INDEX `IX_book_author_reading` (`author_reading`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `book_popularity`;
+DROP TABLE IF EXISTS `book_co_borrow`;
+DROP TABLE IF EXISTS `lending_history`;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS `lending_history` (
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`member_id`, `book_id`),
+  INDEX `IX_lending_history_member_created_at` (`member_id`, `created_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `book_co_borrow` (
+  `book_id` varchar(26) NOT NULL,
+  `other_book_id` varchar(26) NOT NULL,
+  `count` bigint NOT NULL,
+  PRIMARY KEY (`book_id`, `other_book_id`),
+  INDEX `IX_book_co_borrow_count` (`book_id`, `count`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `book_popularity` (
+  `book_id` varchar(26) NOT NULL,
+  `genre` int NOT NULL,
+  `borrowed` bigint NOT NULL,
+  PRIMARY KEY (`book_id`),
+  INDEX `IX_book_popularity_genre_borrowed` (`genre`, `borrowed`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
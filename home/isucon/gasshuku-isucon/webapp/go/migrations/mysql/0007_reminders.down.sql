@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `reminder`;
+DROP TABLE IF EXISTS `member_email`;
+DROP INDEX `IX_lending_due` ON `lending`;
@@ -0,0 +1,20 @@
+CREATE INDEX `IX_lending_due` ON `lending` (`due`);
+
+CREATE TABLE IF NOT EXISTS `member_email` (
+  `member_id` varchar(26) NOT NULL,
+  `email` varchar(255) NOT NULL,
+  PRIMARY KEY (`member_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `reminder` (
+  `lending_id` varchar(26) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `due` datetime(6) NOT NULL,
+  `notifier` varchar(16) NOT NULL,
+  `skipped` tinyint(1) NOT NULL DEFAULT 0,
+  `sent_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`lending_id`, `kind`),
+  INDEX `IX_reminder_member_sent_at` (`member_id`, `sent_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS `webhook` (
+  `id` varchar(26) NOT NULL,
+  `url` varchar(2048) NOT NULL,
+  `secret` varchar(64) NOT NULL,
+  `events` varchar(255) NOT NULL,
+  `active` tinyint(1) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `webhook_outbox` (
+  `id` varchar(26) NOT NULL,
+  `webhook_id` varchar(26) NOT NULL,
+  `event_id` varchar(26) NOT NULL,
+  `event_type` varchar(32) NOT NULL,
+  `payload` mediumtext NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` int NOT NULL,
+  `next_attempt_at` datetime(6) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  `delivered_at` datetime(6) NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_webhook_outbox_status_next_attempt_at` (`status`, `next_attempt_at`),
+  INDEX `IX_webhook_outbox_webhook_id` (`webhook_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `webhook_delivery` (
+  `id` varchar(26) NOT NULL,
+  `webhook_id` varchar(26) NOT NULL,
+  `outbox_id` varchar(26) NOT NULL,
+  `event_id` varchar(26) NOT NULL,
+  `event_type` varchar(32) NOT NULL,
+  `attempt` int NOT NULL,
+  `status_code` int NOT NULL,
+  `error` varchar(1024) NOT NULL,
+  `duration_ms` bigint NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_webhook_delivery_webhook_id_created_at` (`webhook_id`, `created_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
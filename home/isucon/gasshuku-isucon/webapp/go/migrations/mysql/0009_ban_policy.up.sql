@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `member_sanction` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `action` varchar(16) NOT NULL,
+  `source` varchar(16) NOT NULL,
+  `reason` varchar(1024) NOT NULL,
+  `lending_id` varchar(26) NOT NULL,
+  `expires_at` datetime(6) NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_member_sanction_member_id_created_at` (`member_id`, `created_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,3 @@
+ALTER TABLE `member_reading`
+  DROP INDEX `IX_member_reading_sort_key`,
+  DROP COLUMN `sort_key`;
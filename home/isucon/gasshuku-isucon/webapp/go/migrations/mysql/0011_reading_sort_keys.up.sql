@@ -0,0 +1,3 @@
+ALTER TABLE `member_reading`
+  ADD COLUMN `sort_key` varchar(511) NOT NULL DEFAULT '',
+  ADD INDEX `IX_member_reading_sort_key` (`sort_key`, `member_id`);
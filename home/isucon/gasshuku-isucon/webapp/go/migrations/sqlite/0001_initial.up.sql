@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS `book` (
+  `id` varchar(26) NOT NULL,
+  `title` varchar(255) NOT NULL,
+  `author` varchar(255) NOT NULL,
+  `genre` int NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_genre_id` ON `book` (`genre`, `id`);
+
+CREATE TABLE IF NOT EXISTS `key` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `key` char(16) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS `lending` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(255) NOT NULL,
+  `book_id` varchar(255) NOT NULL,
+  `due` datetime NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS `UQ_book_id` ON `lending` (`book_id`);
+
+CREATE TABLE IF NOT EXISTS `member` (
+  `id` varchar(26) NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `address` varchar(255) NOT NULL,
+  `phone_number` varchar(255) NOT NULL,
+  `banned` boolean NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_banned_id` ON `member` (`banned`, `id`);
+CREATE INDEX IF NOT EXISTS `IX_banned_name` ON `member` (`banned`, `name`);
+
+CREATE TABLE IF NOT EXISTS `book_title_suffix` (
+  `book_id` varchar(26) NOT NULL,
+  `title_suffix` varchar(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS `book_author_suffix` (
+  `book_id` varchar(26) NOT NULL,
+  `author_suffix` varchar(255) NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS `stats` (
+  `name` varchar(64) NOT NULL,
+  `value` bigint NOT NULL,
+  PRIMARY KEY (`name`)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS `IX_lending_member_id`;
+DROP INDEX IF EXISTS `IX_book_author_suffix`;
+DROP INDEX IF EXISTS `IX_book_title_suffix`;
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS `IX_book_title_suffix` ON `book_title_suffix` (`title_suffix`);
+CREATE INDEX IF NOT EXISTS `IX_book_author_suffix` ON `book_author_suffix` (`author_suffix`);
+CREATE INDEX IF NOT EXISTS `IX_lending_member_id` ON `lending` (`member_id`);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS `IX_book_author_suffix_book_id`;
+DROP INDEX IF EXISTS `IX_book_title_suffix_book_id`;
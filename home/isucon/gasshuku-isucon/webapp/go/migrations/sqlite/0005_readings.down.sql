@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `book_reading`;
+DROP TABLE IF EXISTS `member_reading`;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS `member_reading` (
+  `member_id` varchar(26) NOT NULL,
+  `reading` varchar(255) NOT NULL,
+  PRIMARY KEY (`member_id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_member_reading` ON `member_reading` (`reading`, `member_id`);
+
+CREATE TABLE IF NOT EXISTS `book_reading` (
+  `book_id` varchar(26) NOT NULL,
+  `title_reading` varchar(255) NOT NULL,
+  `author_reading` varchar(255) NOT NULL,
+  PRIMARY KEY (`book_id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_book_title_reading` ON `book_reading` (`title_reading`);
+CREATE INDEX IF NOT EXISTS `IX_book_author_reading` ON `book_reading` (`author_reading`);
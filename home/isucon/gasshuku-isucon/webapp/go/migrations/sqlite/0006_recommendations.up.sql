@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS `lending_history` (
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`member_id`, `book_id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_lending_history_member_created_at` ON `lending_history` (`member_id`, `created_at`);
+
+CREATE TABLE IF NOT EXISTS `book_co_borrow` (
+  `book_id` varchar(26) NOT NULL,
+  `other_book_id` varchar(26) NOT NULL,
+  `count` bigint NOT NULL,
+  PRIMARY KEY (`book_id`, `other_book_id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_book_co_borrow_count` ON `book_co_borrow` (`book_id`, `count`);
+
+CREATE TABLE IF NOT EXISTS `book_popularity` (
+  `book_id` varchar(26) NOT NULL,
+  `genre` int NOT NULL,
+  `borrowed` bigint NOT NULL,
+  PRIMARY KEY (`book_id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_book_popularity_genre_borrowed` ON `book_popularity` (`genre`, `borrowed`);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `reminder`;
+DROP TABLE IF EXISTS `member_email`;
+DROP INDEX IF EXISTS `IX_lending_due`;
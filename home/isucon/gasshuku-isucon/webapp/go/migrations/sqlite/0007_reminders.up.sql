@@ -0,0 +1,21 @@
+CREATE INDEX IF NOT EXISTS `IX_lending_due` ON `lending` (`due`);
+
+CREATE TABLE IF NOT EXISTS `member_email` (
+  `member_id` varchar(26) NOT NULL,
+  `email` varchar(255) NOT NULL,
+  PRIMARY KEY (`member_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `reminder` (
+  `lending_id` varchar(26) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `due` datetime NOT NULL,
+  `notifier` varchar(16) NOT NULL,
+  `skipped` boolean NOT NULL DEFAULT false,
+  `sent_at` datetime NOT NULL,
+  PRIMARY KEY (`lending_id`, `kind`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_reminder_member_sent_at` ON `reminder` (`member_id`, `sent_at`);
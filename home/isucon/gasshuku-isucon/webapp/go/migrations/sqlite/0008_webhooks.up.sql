@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS `webhook` (
+  `id` varchar(26) NOT NULL,
+  `url` varchar(2048) NOT NULL,
+  `secret` varchar(64) NOT NULL,
+  `events` varchar(255) NOT NULL,
+  `active` boolean NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_outbox` (
+  `id` varchar(26) NOT NULL,
+  `webhook_id` varchar(26) NOT NULL,
+  `event_id` varchar(26) NOT NULL,
+  `event_type` varchar(32) NOT NULL,
+  `payload` text NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` int NOT NULL,
+  `next_attempt_at` datetime NOT NULL,
+  `created_at` datetime NOT NULL,
+  `delivered_at` datetime NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_webhook_outbox_status_next_attempt_at` ON `webhook_outbox` (`status`, `next_attempt_at`);
+CREATE INDEX IF NOT EXISTS `IX_webhook_outbox_webhook_id` ON `webhook_outbox` (`webhook_id`);
+
+CREATE TABLE IF NOT EXISTS `webhook_delivery` (
+  `id` varchar(26) NOT NULL,
+  `webhook_id` varchar(26) NOT NULL,
+  `outbox_id` varchar(26) NOT NULL,
+  `event_id` varchar(26) NOT NULL,
+  `event_type` varchar(32) NOT NULL,
+  `attempt` int NOT NULL,
+  `status_code` int NOT NULL,
+  `error` varchar(1024) NOT NULL,
+  `duration_ms` bigint NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_webhook_delivery_webhook_id_created_at` ON `webhook_delivery` (`webhook_id`, `created_at`);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS `member_sanction` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `action` varchar(16) NOT NULL,
+  `source` varchar(16) NOT NULL,
+  `reason` varchar(1024) NOT NULL,
+  `lending_id` varchar(26) NOT NULL,
+  `expires_at` datetime NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE INDEX IF NOT EXISTS `IX_member_sanction_member_id_created_at` ON `member_sanction` (`member_id`, `created_at`);
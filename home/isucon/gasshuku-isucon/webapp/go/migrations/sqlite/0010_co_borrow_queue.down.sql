@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `co_borrow_queue`;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS `co_borrow_queue` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+);
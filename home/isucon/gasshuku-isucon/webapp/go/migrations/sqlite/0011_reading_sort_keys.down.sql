@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS `IX_member_reading_sort_key`;
+
+ALTER TABLE `member_reading` DROP COLUMN `sort_key`;
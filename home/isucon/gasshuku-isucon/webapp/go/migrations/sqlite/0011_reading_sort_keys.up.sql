@@ -0,0 +1,3 @@
+ALTER TABLE `member_reading` ADD COLUMN `sort_key` varchar(511) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS `IX_member_reading_sort_key` ON `member_reading` (`sort_key`, `member_id`);
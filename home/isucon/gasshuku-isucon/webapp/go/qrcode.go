@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/draw"
+)
+
+/*
+---------------------------------------------------------------
+QR Code Formats
+---------------------------------------------------------------
+*/
+
+// QRコードの出力形式
+// 既定 (format も scale もなし) は generateQRCode の49x49のPNGをそのまま返す
+const (
+	qrFormatPNG = "png"
+	qrFormatSVG = "svg"
+)
+
+const (
+	mimeImagePNG = "image/png"
+	mimeImageSVG = "image/svg+xml"
+)
+
+// 1モジュールの大きさ (px) の上限
+const maxQRScale = 32
+
+// format, scale と Accept からQRコードを出力する
+func writeQRCode(c echo.Context, id string) error {
+	format, err := negotiateQRFormat(c)
+	if err != nil {
+		return err
+	}
+	scale := 1
+	if s := c.QueryParam("scale"); s != "" {
+		scale, err = strconv.Atoi(s)
+		if err != nil || scale < 1 || scale > maxQRScale {
+			return echo.NewHTTPError(http.StatusBadRequest, "scale must be between 1 and "+strconv.Itoa(maxQRScale))
+		}
+	}
+
+	qrCode, err := generateQRCode(id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if format == qrFormatPNG && scale == 1 {
+		return c.Blob(http.StatusOK, mimeImagePNG, qrCode)
+	}
+
+	img, err := png.Decode(bytes.NewReader(qrCode))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if format == qrFormatSVG {
+		return c.Blob(http.StatusOK, mimeImageSVG, qrCodeSVG(img, scale))
+	}
+
+	// モジュールがぼやけないよう最近傍で拡大する
+	src := img.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, src.Dx()*scale, src.Dy()*scale))
+	draw.NearestNeighbor.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.Blob(http.StatusOK, mimeImagePNG, buf.Bytes())
+}
+
+// format があればそれに従い、なければ Accept で png と svg の好まれる方を選ぶ
+// どちらも受け付けない Accept でも、これまで通りPNGを返す
+// 同じURLでも Accept で中身が変わるので、Accept がないときや format を指定したときも Vary を付ける
+func negotiateQRFormat(c echo.Context) (string, error) {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+
+	switch format := c.QueryParam("format"); format {
+	case qrFormatPNG, qrFormatSVG:
+		return format, nil
+	case "":
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, "format must be png or svg")
+	}
+
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	if accept == "" {
+		return qrFormatPNG, nil
+	}
+
+	var pngQ, svgQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case mimeImagePNG:
+			pngQ = max(pngQ, q)
+		case mimeImageSVG:
+			svgQ = max(svgQ, q)
+		case "image/*", "*/*":
+			// ワイルドカードはPNGを優先する
+			pngQ = max(pngQ, q)
+		}
+	}
+	if svgQ > pngQ {
+		return qrFormatSVG, nil
+	}
+	return qrFormatPNG, nil
+}
+
+// 暗いモジュールを横に連続する分ずつ1つのパスにまとめたSVG
+func qrCodeSVG(img image.Image, scale int) []byte {
+	b := img.Bounds()
+	var path strings.Builder
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; {
+			if !isDarkModule(img.At(x, y)) {
+				x++
+				continue
+			}
+			start := x
+			for x < b.Max.X && isDarkModule(img.At(x, y)) {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start-b.Min.X, y-b.Min.Y, x-start, x-start)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`+"\n",
+		b.Dx()*scale, b.Dy()*scale, b.Dx(), b.Dy(), path.String())
+	return buf.Bytes()
+}
+
+func isDarkModule(c color.Color) bool {
+	return color.GrayModel.Convert(c).(color.Gray).Y < 0x80
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newQRTestContext(target, accept string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if accept != "" {
+		req.Header.Set(echo.HeaderAccept, accept)
+	}
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func TestNegotiateQRFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    string
+		wantErr bool
+	}{
+		{name: "no accept", want: qrFormatPNG},
+		{name: "png", accept: "image/png", want: qrFormatPNG},
+		{name: "svg", accept: "image/svg+xml", want: qrFormatSVG},
+		{name: "browser", accept: "text/html,application/xhtml+xml,*/*;q=0.8", want: qrFormatPNG},
+		{name: "wildcard prefers png", accept: "image/*", want: qrFormatPNG},
+		{name: "svg preferred over wildcard", accept: "image/svg+xml, */*;q=0.5", want: qrFormatSVG},
+		{name: "png preferred by quality", accept: "image/svg+xml;q=0.5, image/png", want: qrFormatPNG},
+		{name: "svg preferred by quality", accept: "image/png;q=0.2, image/svg+xml;q=0.9", want: qrFormatSVG},
+		{name: "equal quality prefers png", accept: "image/svg+xml, image/png", want: qrFormatPNG},
+		{name: "unacceptable falls back to png", accept: "application/json", want: qrFormatPNG},
+		{name: "malformed parts are ignored", accept: "image/svg+xml;q=abc, ;;, image/png;q=0.1", want: qrFormatPNG},
+		{name: "format overrides accept", query: "format=svg", accept: "image/png", want: qrFormatSVG},
+		{name: "format png", query: "format=png", accept: "image/svg+xml", want: qrFormatPNG},
+		{name: "unknown format", query: "format=gif", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newQRTestContext("/api/members/M1/qrcode?"+tt.query, tt.accept)
+			got, err := negotiateQRFormat(c)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if vary := rec.Header().Get(echo.HeaderVary); vary != echo.HeaderAccept {
+				t.Errorf("Vary = %q, want %q", vary, echo.HeaderAccept)
+			}
+		})
+	}
+}
+
+// 生成済みのQRコードを images に置き、qrencode を呼ばずに済むようにする
+func writeTestQRCode(t *testing.T, id string) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 49, 49))
+	for y := 0; y < 49; y++ {
+		for x := 0; x < 49; x++ {
+			if (x/7+y/7)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 0xff})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Paths.Images, id+".png"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteQRCodeDefaultIsUnchanged(t *testing.T) {
+	defer func(dir string) { cfg.Paths.Images = dir }(cfg.Paths.Images)
+	cfg.Paths.Images = t.TempDir()
+	want := writeTestQRCode(t, "M1")
+
+	for _, accept := range []string{"", "image/png", "*/*", "text/html"} {
+		t.Run("accept "+accept, func(t *testing.T) {
+			c, rec := newQRTestContext("/api/members/M1/qrcode", accept)
+			if err := writeQRCode(c, "M1"); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if ct := rec.Header().Get(echo.HeaderContentType); ct != mimeImagePNG {
+				t.Errorf("Content-Type = %q, want %q", ct, mimeImagePNG)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), want) {
+				t.Errorf("body differs from the generated PNG (%d bytes, want %d)", rec.Body.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestWriteQRCodeFormats(t *testing.T) {
+	defer func(dir string) { cfg.Paths.Images = dir }(cfg.Paths.Images)
+	cfg.Paths.Images = t.TempDir()
+	writeTestQRCode(t, "M1")
+
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		wantStatus  int
+		wantType    string
+		wantSize    int
+		wantPrefix  string
+		wantContent string
+	}{
+		{name: "scaled png", query: "scale=4", wantStatus: http.StatusOK, wantType: mimeImagePNG, wantSize: 49 * 4},
+		{name: "svg by accept", accept: "image/svg+xml", wantStatus: http.StatusOK, wantType: mimeImageSVG, wantPrefix: "<?xml", wantContent: `width="49" height="49"`},
+		{name: "scaled svg", query: "format=svg&scale=8", wantStatus: http.StatusOK, wantType: mimeImageSVG, wantPrefix: "<?xml", wantContent: `width="392" height="392" viewBox="0 0 49 49"`},
+		{name: "scale too large", query: "scale=33", wantStatus: http.StatusBadRequest},
+		{name: "scale zero", query: "scale=0", wantStatus: http.StatusBadRequest},
+		{name: "scale not a number", query: "scale=x", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newQRTestContext("/api/members/M1/qrcode?"+tt.query, tt.accept)
+			err := writeQRCode(c, "M1")
+			if tt.wantStatus != http.StatusOK {
+				httpErr, ok := err.(*echo.HTTPError)
+				if !ok || httpErr.Code != tt.wantStatus {
+					t.Fatalf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct := rec.Header().Get(echo.HeaderContentType); ct != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantType)
+			}
+			body := rec.Body.String()
+			if tt.wantSize > 0 {
+				img, err := png.Decode(strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b := img.Bounds(); b.Dx() != tt.wantSize || b.Dy() != tt.wantSize {
+					t.Errorf("size = %v, want %dx%d", b.Size(), tt.wantSize, tt.wantSize)
+				}
+			}
+			if !strings.HasPrefix(body, tt.wantPrefix) || !strings.Contains(body, tt.wantContent) {
+				t.Errorf("unexpected body %.200q", body)
+			}
+		})
+	}
+}
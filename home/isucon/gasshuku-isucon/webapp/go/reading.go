@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dbgofy/gasshuku-isucon-20230909/home/isucon/gasshuku-isucon/webapp/go/suffix"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+---------------------------------------------------------------
+Readings
+---------------------------------------------------------------
+*/
+
+// 会員名・蔵書の読み仮名は member_reading / book_reading に持つ
+// 初期データのダンプは列名なしのINSERTなので、member / book には列を足さない
+//
+// 読み仮名はひらがなにそろえて保存する
+// utf8mb4_bin (コードポイント順) では小書きの仮名が元の仮名より前に、長音符がすべての仮名の後に並ぶので、
+// 名前順には suffix.ReadingSortKey で作った sort_key を使う
+
+// 検索の対象
+const (
+	matchText    = "text"
+	matchReading = "reading"
+)
+
+func parseMatch(c echo.Context) (string, error) {
+	match := c.QueryParam("match")
+	switch match {
+	case "":
+		return matchText, nil
+	case matchText, matchReading:
+		return match, nil
+	}
+	return "", echo.NewHTTPError(http.StatusBadRequest, "match must be text or reading")
+}
+
+// 読み仮名を正規化する (空なら空のまま)
+func normalizeReading(field, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	reading, ok := suffix.Reading(s)
+	if !ok {
+		return "", echo.NewHTTPError(http.StatusBadRequest, field+" must be kana")
+	}
+	return reading, nil
+}
+
+func setMemberReading(ctx context.Context, tx *sqlx.Tx, memberID, reading string) error {
+	_, err := tx.ExecContext(ctx, "REPLACE INTO `member_reading` (`member_id`, `reading`, `sort_key`) VALUES (?, ?, ?)",
+		memberID, reading, suffix.ReadingSortKey(reading))
+	return err
+}
+
+// sort_key を足す前に登録された読み仮名の sort_key を埋める (起動時)
+func fillReadingSortKeys(ctx context.Context) error {
+	var readings []struct {
+		MemberID string `db:"member_id"`
+		Reading  string `db:"reading"`
+	}
+	if err := db.SelectContext(ctx, &readings, "SELECT `member_id`, `reading` FROM `member_reading` WHERE `sort_key` = ''"); err != nil {
+		return err
+	}
+	for _, r := range readings {
+		_, err := db.ExecContext(ctx, "UPDATE `member_reading` SET `sort_key` = ? WHERE `member_id` = ? AND `reading` = ?",
+			suffix.ReadingSortKey(r.Reading), r.MemberID, r.Reading)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 蔵書の読み仮名
+type bookReading struct {
+	BookID        string `db:"book_id"`
+	TitleReading  string `db:"title_reading"`
+	AuthorReading string `db:"author_reading"`
+}
+
+func setBookReadings(ctx context.Context, tx *sqlx.Tx, readings []bookReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	_, err := tx.NamedExecContext(ctx, "REPLACE INTO `book_reading` (`book_id`, `title_reading`, `author_reading`) VALUES (:book_id, :title_reading, :author_reading)", readings)
+	return err
+}
+
+// 蔵書に読み仮名を埋める
+func attachBookReadings(ctx context.Context, db sqlx.ExtContext, books []Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+	bookIDs := make([]string, 0, len(books))
+	for _, book := range books {
+		bookIDs = append(bookIDs, book.ID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM `book_reading` WHERE `book_id` IN (?)", bookIDs)
+	if err != nil {
+		return err
+	}
+
+	var readings []bookReading
+	if err := sqlx.SelectContext(ctx, db, &readings, db.Rebind(query), args...); err != nil {
+		return err
+	}
+	readingMap := make(map[string]bookReading, len(readings))
+	for _, reading := range readings {
+		readingMap[reading.BookID] = reading
+	}
+	for i := range books {
+		reading := readingMap[books[i].ID]
+		books[i].TitleReading = reading.TitleReading
+		books[i].AuthorReading = reading.AuthorReading
+	}
+	return nil
+}
+
+/*
+---------------------------------------------------------------
+Member Listing
+---------------------------------------------------------------
+*/
+
+// 読み仮名を付けて会員を引くクエリ (WHERE以降を足して使う)
+const memberWithReadingQuery = "SELECT m.*, COALESCE(r.`reading`, '') AS `name_reading` FROM `member` AS m LEFT JOIN `member_reading` AS r ON r.`member_id` = m.`id` "
+
+// 会員一覧の絞り込み
+type memberFilter struct {
+	// 名前の前方一致
+	Name string
+	// 読み仮名の前方一致
+	Reading string
+}
+
+func (f memberFilter) empty() bool {
+	return f.Name == "" && f.Reading == ""
+}
+
+func (f memberFilter) where() (string, []any) {
+	switch {
+	case f.Name != "":
+		return "AND m.`name` LIKE ?" + likeEscape() + " ", []any{likePrefix(f.Name)}
+	case f.Reading != "":
+		return "AND r.`reading` LIKE ? ", []any{f.Reading + "%"}
+	}
+	return "", nil
+}
+
+func countMembers(ctx context.Context, db sqlx.QueryerContext, filter memberFilter) (int, error) {
+	where, args := filter.where()
+	var total int
+	err := sqlx.GetContext(ctx, db, &total, "SELECT COUNT(*) FROM `member` AS m LEFT JOIN `member_reading` AS r ON r.`member_id` = m.`id` WHERE m.`banned` = false "+where, args...)
+	return total, err
+}
+
+// 名前順の一覧の区間
+// 読み仮名のある会員 (五十音順) とない会員 (名前順) をそれぞれインデックスで引いてつなげる
+type memberSegment struct {
+	hasReading bool
+	query      string
+	key        string
+}
+
+var memberSegments = []memberSegment{
+	{
+		hasReading: true,
+		query:      "SELECT m.*, r.`reading` AS `name_reading` FROM `member_reading` AS r INNER JOIN `member` AS m ON m.`id` = r.`member_id` WHERE m.`banned` = false ",
+		key:        "r.`sort_key`",
+	},
+	{
+		hasReading: false,
+		query:      "SELECT m.*, '' AS `name_reading` FROM `member` AS m LEFT JOIN `member_reading` AS r ON r.`member_id` = m.`id` WHERE m.`banned` = false AND r.`member_id` IS NULL ",
+		key:        "m.`name`",
+	},
+}
+
+// 会員一覧の1ページ分
+// last は前のページの最後の会員 (名前順のときは読み仮名も入っていること)
+func selectMembers(ctx context.Context, db sqlx.QueryerContext, filter memberFilter, order string, last *Member, limit int) ([]Member, error) {
+	where, filterArgs := filter.where()
+	members := []Member{}
+
+	if order == "" {
+		query := memberWithReadingQuery + "WHERE m.`banned` = false " + where
+		args := append([]any{}, filterArgs...)
+		if last != nil {
+			query += "AND m.`id` > ? "
+			args = append(args, last.ID)
+		}
+		query += "ORDER BY m.`id` ASC LIMIT ?"
+		args = append(args, limit)
+		err := sqlx.SelectContext(ctx, db, &members, query, args...)
+		return members, err
+	}
+
+	segments := memberSegments
+	op, dir := ">", "ASC"
+	if order == "name_desc" {
+		segments = []memberSegment{memberSegments[1], memberSegments[0]}
+		op, dir = "<", "DESC"
+	}
+
+	started := last == nil
+	for _, seg := range segments {
+		if filter.Reading != "" && !seg.hasReading {
+			continue
+		}
+
+		query := seg.query + where
+		args := append([]any{}, filterArgs...)
+		if !started {
+			// 前のページの最後の会員がいる区間から続ける
+			if seg.hasReading != (last.NameReading != "") {
+				continue
+			}
+			started = true
+			value := last.Name
+			if seg.hasReading {
+				value = suffix.ReadingSortKey(last.NameReading)
+			}
+			query += "AND (" + seg.key + " " + op + " ? OR (" + seg.key + " = ? AND m.`id` " + op + " ?)) "
+			args = append(args, value, value, last.ID)
+		}
+		query += "ORDER BY " + seg.key + " " + dir + ", m.`id` " + dir + " LIMIT ?"
+		args = append(args, limit-len(members))
+
+		var page []Member
+		if err := sqlx.SelectContext(ctx, db, &page, query, args...); err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(members) >= limit {
+			break
+		}
+	}
+	return members, nil
+}
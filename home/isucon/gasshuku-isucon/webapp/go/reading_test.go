@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dbgofy/gasshuku-isucon-20230909/home/isucon/gasshuku-isucon/webapp/go/suffix"
+	"github.com/jmoiron/sqlx"
+)
+
+// 一時ファイルのSQLiteにマイグレーションを当てて db にする
+func setupTestSQLite(t *testing.T) {
+	t.Helper()
+	dsn, err := DBConfig{URL: "sqlite:" + filepath.Join(t.TempDir(), "test.db")}.DataSource("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sqlx.Open(string(dialectSQLite), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedDB, savedDialect, savedLocation := db, dialect, location
+	db, dialect, location = conn, dialectSQLite, time.FixedZone("Asia/Tokyo", 9*60*60)
+	t.Cleanup(func() {
+		db, dialect, location = savedDB, savedDialect, savedLocation
+		conn.Close()
+	})
+
+	m, err := newMigrator(conn, dialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 会員を登録する (reading が空なら読み仮名なし)
+func insertTestMember(t *testing.T, id, name, reading string, banned bool) {
+	t.Helper()
+	if _, err := db.Exec("INSERT INTO `member` (`id`, `name`, `address`, `phone_number`, `banned`, `created_at`) VALUES (?, ?, '', '', ?, ?)",
+		id, name, banned, time.Now().In(location)); err != nil {
+		t.Fatal(err)
+	}
+	if reading == "" {
+		return
+	}
+	if _, err := db.Exec("INSERT INTO `member_reading` (`member_id`, `reading`, `sort_key`) VALUES (?, ?, ?)",
+		id, reading, suffix.ReadingSortKey(reading)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectMembersPagination(t *testing.T) {
+	setupTestSQLite(t)
+	for _, m := range []struct {
+		id, name, reading string
+		banned            bool
+	}{
+		{id: "M1", name: "山田花子", reading: "やまだ はなこ"},
+		{id: "M2", name: "青木", reading: "あおき"},
+		{id: "M3", name: "加藤", reading: "かとう"},
+		{id: "M4", name: "我藤", reading: "がとう"},
+		{id: "M5", name: "Bob"},
+		{id: "M6", name: "Alice"},
+		{id: "M7", name: "山田"},
+		{id: "M8", name: "安達", reading: "あだち", banned: true},
+		{id: "M9", name: "加藤", reading: "かとう"},
+		{id: "MA", name: "Alice"},
+	} {
+		insertTestMember(t, m.id, m.name, m.reading, m.banned)
+	}
+
+	tests := []struct {
+		name   string
+		filter memberFilter
+		order  string
+		want   []string
+	}{
+		{name: "id", want: []string{"M1", "M2", "M3", "M4", "M5", "M6", "M7", "M9", "MA"}},
+		{name: "name asc", order: "name_asc", want: []string{"M2", "M3", "M9", "M4", "M1", "M6", "MA", "M5", "M7"}},
+		{name: "name desc", order: "name_desc", want: []string{"M7", "M5", "MA", "M6", "M1", "M4", "M9", "M3", "M2"}},
+		{name: "name prefix", filter: memberFilter{Name: "山"}, order: "name_asc", want: []string{"M1", "M7"}},
+		{name: "name prefix desc", filter: memberFilter{Name: "山"}, order: "name_desc", want: []string{"M7", "M1"}},
+		{name: "reading prefix", filter: memberFilter{Reading: "か"}, order: "name_asc", want: []string{"M3", "M9"}},
+		{name: "reading prefix desc", filter: memberFilter{Reading: "か"}, order: "name_desc", want: []string{"M9", "M3"}},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 3, 100} {
+			t.Run(tt.name+"/limit "+strconv.Itoa(limit), func(t *testing.T) {
+				got := []string{}
+				var last *Member
+				for page := 0; page <= len(tt.want); page++ {
+					members, err := selectMembers(ctx, db, tt.filter, tt.order, last, limit)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(members) > limit {
+						t.Fatalf("got %d members, want at most %d", len(members), limit)
+					}
+					if len(members) == 0 {
+						break
+					}
+					for _, m := range members {
+						got = append(got, m.ID)
+					}
+					last = &members[len(members)-1]
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
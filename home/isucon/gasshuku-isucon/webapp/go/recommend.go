@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+---------------------------------------------------------------
+Recommendations
+---------------------------------------------------------------
+*/
+
+// 貸出記録は返却で消えるので、推薦には別に残しておく
+//
+//	lending_history: 会員が一度でも借りた蔵書 (同じ本を何度借りても1行)
+//	book_co_borrow:  同じ会員に借りられた蔵書の組の数 (両方向に持つ)
+//	book_popularity: 蔵書を借りた会員の数 (分類ごとの人気順に使う)
+//
+// 貸出履歴と人気は貸出のトランザクションの中で更新する (人気の行は貸し出した本のものだけなので競合しない)
+// 共起の行は多くの貸出で共有するので、初めて借りた本を co_borrow_queue に積み、
+// 別のゴルーチンで短いトランザクションに分けて数える (推薦に反映されるまで少し遅れる)
+
+// 共起を数える相手にする、会員の直近の貸出履歴の件数
+// 借りた冊数の多い会員でも1冊あたりの更新量が一定に収まるようにする
+const recommendHistoryLimit = 100
+
+// 推薦の件数
+const (
+	defaultRecommendLimit = 10
+	maxRecommendLimit     = 100
+)
+
+// 推薦の理由
+const (
+	// 同じ本を借りた会員が借りている
+	recommendReasonAlsoBorrowed = "also_borrowed"
+	// よく借りる分類で人気がある
+	recommendReasonGenre = "genre"
+)
+
+type Recommendation struct {
+	Book
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason"`
+}
+
+type GetRecommendationsResponse struct {
+	Recommendations []Recommendation `json:"recommendations"`
+}
+
+// 貸し出した蔵書を推薦のモデルに反映する
+// 共起は co_borrow_queue に積むだけで、aggregateCoBorrows で数える
+func recordBorrowing(ctx context.Context, tx *sqlx.Tx, memberID string, books []Book, at time.Time) error {
+	for _, book := range books {
+		_, err := tx.ExecContext(ctx, "INSERT INTO `lending_history` (`member_id`, `book_id`, `created_at`) VALUES (?, ?, ?)", memberID, book.ID, at)
+		if err != nil {
+			if isDuplicateKeyError(err) {
+				// 前にも借りた本なので、人気と共起はもう数えてある
+				continue
+			}
+			return err
+		}
+
+		// 同じ会員が何度借りても人気は1回と数える (作り直すときと揃える)
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO `book_popularity` (`book_id`, `genre`, `borrowed`) VALUES (?, ?, 1)"+upsertAddClause([]string{"book_id"}, "borrowed"),
+			book.ID, book.Genre)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO `co_borrow_queue` (`id`, `member_id`, `book_id`, `created_at`) VALUES (?, ?, ?, ?)",
+			generateID(), memberID, book.ID, at)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* --- Co-borrow Aggregation --- */
+
+// 共起を数える待ちの貸出 (会員が初めて借りた本)
+type coBorrowQueueEntry struct {
+	ID        string    `db:"id"`
+	MemberID  string    `db:"member_id"`
+	BookID    string    `db:"book_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// 定期的に共起を数える
+func startCoBorrowAggregator(ctx context.Context, interval time.Duration, batchSize int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// 初期化中はテーブルが作り直されている
+			if initializeRunning() {
+				continue
+			}
+			if _, err := aggregateCoBorrows(ctx, batchSize); err != nil {
+				appLogger.Error("co-borrow aggregation failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// 待ちの貸出を古い順に数え、数えた件数を返す
+// 1件ずつトランザクションを分け、待ちの行を消せたときだけ数える (複数のインスタンスで動かしても二重に数えない)
+func aggregateCoBorrows(ctx context.Context, batchSize int) (int, error) {
+	var entries []coBorrowQueueEntry
+	if err := db.SelectContext(ctx, &entries, "SELECT * FROM `co_borrow_queue` ORDER BY `id` ASC LIMIT ?", batchSize); err != nil {
+		return 0, err
+	}
+
+	counted := 0
+	for _, entry := range entries {
+		err := runInTx(ctx, nil, func(tx *sqlx.Tx) error {
+			res, err := tx.ExecContext(ctx, "DELETE FROM `co_borrow_queue` WHERE `id` = ?", entry.ID)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				// 他のインスタンスが数えた
+				return err
+			}
+			return countCoBorrows(ctx, tx, entry)
+		})
+		if err != nil {
+			return counted, err
+		}
+		counted++
+	}
+	return counted, nil
+}
+
+// 借りた本と、それより前に借りた本の組を数える
+// 後から借りた本との組はその本の番で数えるので、同じ組を二重に数えない
+// (同時に借りた本どうしは蔵書IDの順で前後を決める)
+func countCoBorrows(ctx context.Context, tx *sqlx.Tx, entry coBorrowQueueEntry) error {
+	var others []string
+	err := tx.SelectContext(ctx, &others,
+		"SELECT `book_id` FROM `lending_history` "+
+			"WHERE `member_id` = ? AND (`created_at` < ? OR (`created_at` = ? AND `book_id` < ?)) "+
+			"ORDER BY `created_at` DESC LIMIT ?",
+		entry.MemberID, entry.CreatedAt, entry.CreatedAt, entry.BookID, recommendHistoryLimit)
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	// ロックの順序をそろえてデッドロックを起こりにくくする
+	type pair struct{ a, b string }
+	pairs := make([]pair, 0, len(others)*2)
+	for _, other := range others {
+		pairs = append(pairs, pair{entry.BookID, other}, pair{other, entry.BookID})
+	}
+	slices.SortFunc(pairs, func(x, y pair) int {
+		if c := strings.Compare(x.a, y.a); c != 0 {
+			return c
+		}
+		return strings.Compare(x.b, y.b)
+	})
+
+	query := "INSERT INTO `book_co_borrow` (`book_id`, `other_book_id`, `count`) VALUES " +
+		strings.TrimSuffix(strings.Repeat("(?, ?, 1), ", len(pairs)), ", ") +
+		upsertAddClause([]string{"book_id", "other_book_id"}, "count")
+	args := make([]any, 0, len(pairs)*2)
+	for _, p := range pairs {
+		args = append(args, p.a, p.b)
+	}
+	_, err = tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// 初期データの貸出記録から推薦のモデルを作り直す
+func rebuildRecommendations(ctx context.Context) error {
+	return runInTxOnce(ctx, nil, func(tx *sqlx.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM `co_borrow_queue`",
+			"DELETE FROM `book_co_borrow`",
+			"DELETE FROM `book_popularity`",
+			"DELETE FROM `lending_history`",
+			"INSERT INTO `lending_history` (`member_id`, `book_id`, `created_at`) " +
+				"SELECT `member_id`, `book_id`, MIN(`created_at`) FROM `lending` GROUP BY `member_id`, `book_id`",
+			"INSERT INTO `book_popularity` (`book_id`, `genre`, `borrowed`) " +
+				"SELECT h.`book_id`, b.`genre`, COUNT(*) FROM `lending_history` AS h INNER JOIN `book` AS b ON b.`id` = h.`book_id` GROUP BY h.`book_id`, b.`genre`",
+			"INSERT INTO `book_co_borrow` (`book_id`, `other_book_id`, `count`) " +
+				"SELECT a.`book_id`, b.`book_id`, COUNT(*) FROM `lending_history` AS a INNER JOIN `lending_history` AS b ON a.`member_id` = b.`member_id` AND a.`book_id` != b.`book_id` GROUP BY a.`book_id`, b.`book_id`",
+		} {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func parseRecommendLimit(c echo.Context) (int, error) {
+	s := c.QueryParam("limit")
+	if s == "" {
+		return defaultRecommendLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxRecommendLimit {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxRecommendLimit))
+	}
+	return limit, nil
+}
+
+// 推薦の点数の付いた蔵書IDから推薦を作る (点数の高い順)
+func buildRecommendations(ctx context.Context, db sqlx.ExtContext, scored []scoredBook, limit int) ([]Recommendation, error) {
+	slices.SortStableFunc(scored, func(a, b scoredBook) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return strings.Compare(a.BookID, b.BookID)
+	})
+	if len(scored) > limit {
+		scored = scored[:limit]
+	}
+
+	recommendations := []Recommendation{}
+	if len(scored) == 0 {
+		return recommendations, nil
+	}
+
+	bookIDs := make([]string, 0, len(scored))
+	for _, s := range scored {
+		bookIDs = append(bookIDs, s.BookID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM `book` WHERE `id` IN (?)", bookIDs)
+	if err != nil {
+		return nil, err
+	}
+	var books []Book
+	if err := sqlx.SelectContext(ctx, db, &books, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	if err := attachBookReadings(ctx, db, books); err != nil {
+		return nil, err
+	}
+	bookMap := make(map[string]Book, len(books))
+	for _, book := range books {
+		bookMap[book.ID] = book
+	}
+
+	for _, s := range scored {
+		book, ok := bookMap[s.BookID]
+		if !ok {
+			continue
+		}
+		recommendations = append(recommendations, Recommendation{Book: book, Score: s.Score, Reason: s.Reason})
+	}
+	return recommendations, nil
+}
+
+type scoredBook struct {
+	BookID string  `db:"book_id"`
+	Score  float64 `db:"score"`
+	Reason string  `db:"-"`
+}
+
+// この本を借りた会員はこんな本も借りています
+func getBookRecommendationsHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
+	}
+	limit, err := parseRecommendLimit(c)
+	if err != nil {
+		return err
+	}
+
+	// 蔵書の存在確認
+	err = readDB(c).GetContext(c.Request().Context(), &Book{}, "SELECT * FROM `book` WHERE `id` = ?", id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var scored []scoredBook
+	err = readDB(c).SelectContext(c.Request().Context(), &scored,
+		"SELECT `other_book_id` AS `book_id`, `count` AS `score` FROM `book_co_borrow` WHERE `book_id` = ? ORDER BY `count` DESC, `other_book_id` ASC LIMIT ?",
+		id, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	for i := range scored {
+		scored[i].Reason = recommendReasonAlsoBorrowed
+	}
+
+	recommendations, err := buildRecommendations(c.Request().Context(), readDB(c), scored, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, GetRecommendationsResponse{Recommendations: recommendations})
+}
+
+// 会員の貸出履歴と、よく借りる分類から推薦する
+// 共起の点数はその本の分類を借りた割合だけ上乗せし、足りない分は分類ごとの人気の本で埋める
+func getMemberRecommendationsHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
+	}
+	limit, err := parseRecommendLimit(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+
+	// 会員の存在確認
+	err = readDB(c).GetContext(ctx, &Member{}, "SELECT * FROM `member` WHERE `id` = ? AND `banned` = false", id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var history []struct {
+		BookID string `db:"book_id"`
+		Genre  Genre  `db:"genre"`
+	}
+	err = readDB(c).SelectContext(ctx, &history,
+		"SELECT h.`book_id`, b.`genre` FROM `lending_history` AS h INNER JOIN `book` AS b ON b.`id` = h.`book_id` "+
+			"WHERE h.`member_id` = ? ORDER BY h.`created_at` DESC LIMIT ?",
+		id, recommendHistoryLimit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if len(history) == 0 {
+		return c.JSON(http.StatusOK, GetRecommendationsResponse{Recommendations: []Recommendation{}})
+	}
+
+	borrowed := make(map[string]struct{}, len(history))
+	genreShare := make(map[Genre]float64)
+	historyIDs := make([]string, 0, len(history))
+	for _, h := range history {
+		borrowed[h.BookID] = struct{}{}
+		genreShare[h.Genre] += 1 / float64(len(history))
+		historyIDs = append(historyIDs, h.BookID)
+	}
+
+	// 借りた本と一緒に借りられている本
+	// 借りた本自体は除くので、その分を多めに取っておく
+	query, args, err := sqlx.In(
+		"SELECT c.`other_book_id` AS `book_id`, b.`genre` AS `genre`, SUM(c.`count`) AS `score` FROM `book_co_borrow` AS c "+
+			"INNER JOIN `book` AS b ON b.`id` = c.`other_book_id` WHERE c.`book_id` IN (?) "+
+			"GROUP BY c.`other_book_id`, b.`genre` ORDER BY `score` DESC LIMIT ?",
+		historyIDs, limit+len(historyIDs))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	var coBorrowed []struct {
+		BookID string  `db:"book_id"`
+		Genre  Genre   `db:"genre"`
+		Score  float64 `db:"score"`
+	}
+	if err := readDB(c).SelectContext(ctx, &coBorrowed, readDB(c).Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	scored := make([]scoredBook, 0, limit)
+	picked := make(map[string]struct{}, limit)
+	for _, b := range coBorrowed {
+		if _, ok := borrowed[b.BookID]; ok {
+			continue
+		}
+		scored = append(scored, scoredBook{BookID: b.BookID, Score: b.Score * (1 + genreShare[b.Genre]), Reason: recommendReasonAlsoBorrowed})
+		picked[b.BookID] = struct{}{}
+	}
+
+	// 足りなければ、よく借りる分類の順に人気の本で埋める
+	if len(scored) < limit {
+		genres := make([]Genre, 0, len(genreShare))
+		for genre := range genreShare {
+			genres = append(genres, genre)
+		}
+		slices.SortFunc(genres, func(a, b Genre) int {
+			switch {
+			case genreShare[a] > genreShare[b]:
+				return -1
+			case genreShare[a] < genreShare[b]:
+				return 1
+			}
+			return int(a - b)
+		})
+
+		for _, genre := range genres {
+			var popular []scoredBook
+			err := readDB(c).SelectContext(ctx, &popular,
+				"SELECT `book_id`, `borrowed` AS `score` FROM `book_popularity` WHERE `genre` = ? ORDER BY `borrowed` DESC LIMIT ?",
+				genre, limit+len(historyIDs))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			for _, p := range popular {
+				if len(scored) >= limit {
+					break
+				}
+				if _, ok := borrowed[p.BookID]; ok {
+					continue
+				}
+				if _, ok := picked[p.BookID]; ok {
+					continue
+				}
+				// 共起で選んだ本より上には来ないよう、分類の割合で小さくする
+				scored = append(scored, scoredBook{BookID: p.BookID, Score: genreShare[genre] * p.Score / (p.Score + 1), Reason: recommendReasonGenre})
+				picked[p.BookID] = struct{}{}
+			}
+			if len(scored) >= limit {
+				break
+			}
+		}
+	}
+
+	recommendations, err := buildRecommendations(ctx, readDB(c), scored, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, GetRecommendationsResponse{Recommendations: recommendations})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+---------------------------------------------------------------
+Cache Reconciliation
+---------------------------------------------------------------
+*/
+
+var (
+	cacheReconcileTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_reconcile_total",
+		Help:      "Number of cache reconciliation runs.",
+	})
+
+	cacheDriftTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_drift_corrections_total",
+		Help:      "Number of in-process counters corrected by reconciliation.",
+	}, []string{"cache"})
+
+	cacheDriftAbsolute = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_drift_absolute_total",
+		Help:      "Sum of absolute differences corrected by reconciliation.",
+	}, []string{"cache"})
+)
+
+// 照合で見つかったずれ
+type CacheDrift struct {
+	Cache    string `json:"cache"`
+	Cached   int64  `json:"cached"`
+	Actual   int64  `json:"actual"`
+	Resolved bool   `json:"resolved"`
+}
+
+type ReconcileResponse struct {
+	Drifts []CacheDrift `json:"drifts"`
+}
+
+type CacheStateResponse struct {
+	Ready    bool                 `json:"ready"`
+	Backend  string               `json:"backend"`
+	Epoch    int64                `json:"epoch"`
+	Counters map[counterKey]int64 `json:"counters"`
+}
+
+// 照合を同時に走らせない
+var reconcileLock sync.Mutex
+
+// 定期的にキャッシュをDBと照合する
+func startCacheReconciler(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if !cachesLoaded() {
+				continue
+			}
+			if _, err := reconcileCaches(ctx); err != nil {
+				appLogger.Error("cache reconciliation failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// カウンタをDBから数え直して補正する
+// カウンタの値と同じ時点のDBのスナップショットで数え直し、差を加える
+// (数え直しの間の更新はカウンタにもそのまま反映されるので、差を加えれば正しい値になる)
+func reconcileCaches(ctx context.Context) ([]CacheDrift, error) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	cacheReconcileTotal.Inc()
+
+	before, actual, err := reconcileCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []CacheDrift
+	for _, key := range allCounterKeys() {
+		if before[key] == actual[key] {
+			continue
+		}
+		if err := counters.Add(ctx, key, actual[key]-before[key]); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, CacheDrift{Cache: string(key), Cached: before[key], Actual: actual[key], Resolved: true})
+	}
+
+	for _, drift := range drifts {
+		attrs := []slog.Attr{
+			slog.String("cache", drift.Cache),
+			slog.Int64("cached", drift.Cached),
+			slog.Int64("actual", drift.Actual),
+			slog.Bool("resolved", drift.Resolved),
+		}
+		appLogger.LogAttrs(ctx, slog.LevelWarn, "cache drift", attrs...)
+		diff := drift.Actual - drift.Cached
+		if diff < 0 {
+			diff = -diff
+		}
+		cacheDriftTotal.WithLabelValues(drift.Cache).Inc()
+		cacheDriftAbsolute.WithLabelValues(drift.Cache).Add(float64(diff))
+	}
+
+	return drifts, nil
+}
+
+// カウンタの値と、同じ時点のDBから数え直した値
+// 補正はトランザクションを閉じてから行う (SQLiteではトランザクションが書き込みのロックを取る)
+func reconcileCounts(ctx context.Context) (before, actual map[counterKey]int64, err error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	before, err = reconcileSnapshot(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	actual, err = countFromDB(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, actual, nil
+}
+
+// 照合の基準にするカウンタの値を読み、tx のスナップショットをその時点に固定する
+// statsテーブルのカウンタは tx で読めば揃う
+// プロセス内のカウンタはコミットから Committed までの間を除くため、書き込みロックの間に
+// スナップショットを作る読み取りとカウンタの読み取りを済ませる (数え直しの間は止めない)
+func reconcileSnapshot(ctx context.Context, tx *sqlx.Tx) (map[counterKey]int64, error) {
+	if counters.Shared() {
+		return counters.Snapshot(ctx, tx)
+	}
+
+	counterCommitLock.Lock()
+	defer counterCommitLock.Unlock()
+	var n int
+	if err := tx.GetContext(ctx, &n, "SELECT COUNT(*) FROM `member` WHERE `id` = ''"); err != nil {
+		return nil, err
+	}
+	return counters.Snapshot(ctx, tx)
+}
+
+// キャッシュをすぐに照合する
+func reconcileCachesHandler(c echo.Context) error {
+	if !cachesLoaded() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "caches are not populated")
+	}
+
+	drifts, err := reconcileCaches(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if drifts == nil {
+		drifts = []CacheDrift{}
+	}
+
+	return c.JSON(http.StatusOK, ReconcileResponse{Drifts: drifts})
+}
+
+// 現在のキャッシュの値を取得
+func getCacheStateHandler(c echo.Context) error {
+	snapshot, err := counters.Snapshot(c.Request().Context(), db)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, CacheStateResponse{
+		Ready:    cachesLoaded(),
+		Backend:  cfg.Cache.CounterBackend,
+		Epoch:    cacheEpoch.Load(),
+		Counters: snapshot,
+	})
+}
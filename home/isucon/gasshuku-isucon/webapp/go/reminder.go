@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+---------------------------------------------------------------
+Due-date Reminders
+---------------------------------------------------------------
+*/
+
+// 貸出期限が近い・過ぎた貸出を定期的に探して会員に通知する
+// 送った通知は reminder に (貸出, 種類) ごとに記録し、同じ通知を二度送らない
+// 送る前に記録を入れて枠を取り、送れなかったら記録を消して次回に回す
+// (複数のインスタンスで動かしても、先に記録を入れた方だけが送る)
+
+// 通知の種類
+const (
+	reminderKindDueSoon = "due_soon"
+	reminderKindOverdue = "overdue"
+	// 延滞が続いたらBAN・停止するという警告 (ban_policy.go から送る)
+	reminderKindBanWarning = "ban_warning"
+)
+
+// 通知の送り方
+const (
+	notifierFile    = "file"
+	notifierWebhook = "webhook"
+	notifierSMTP    = "smtp"
+)
+
+var reminderNotifiers = []string{notifierFile, notifierWebhook, notifierSMTP}
+
+var (
+	remindersSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reminders_sent_total",
+		Help:      "Number of due-date reminders sent by kind.",
+	}, []string{"kind"})
+
+	remindersFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reminders_failed_total",
+		Help:      "Number of due-date reminders that failed to send and will be retried.",
+	}, []string{"kind"})
+)
+
+// 会員への通知1件
+type Reminder struct {
+	Kind       string    `json:"kind" db:"-"`
+	LendingID  string    `json:"lending_id" db:"lending_id"`
+	MemberID   string    `json:"member_id" db:"member_id"`
+	MemberName string    `json:"member_name" db:"member_name"`
+	Email      string    `json:"email,omitempty" db:"email"`
+	BookID     string    `json:"book_id" db:"book_id"`
+	BookTitle  string    `json:"book_title" db:"book_title"`
+	Due        time.Time `json:"due" db:"due"`
+	// 警告でBAN・停止する予定の時刻
+	BanAt   *time.Time `json:"ban_at,omitempty" db:"-"`
+	Subject string     `json:"subject" db:"-"`
+	Body    string     `json:"body" db:"-"`
+}
+
+// テンプレートで使う期限の日付
+func (r Reminder) DueDate() string {
+	return r.Due.In(location).Format("2006/01/02")
+}
+
+// テンプレートで使うBAN・停止の予定時刻
+func (r Reminder) BanDate() string {
+	if r.BanAt == nil {
+		return ""
+	}
+	return r.BanAt.In(location).Format("2006/01/02 15:04")
+}
+
+var defaultReminderTemplates = ReminderTemplates{
+	DueSoonSubject: "【ISUCON図書館】返却期限が近づいています",
+	DueSoonBody: "{{.MemberName}} 様\n\n" +
+		"お借りになっている「{{.BookTitle}}」の返却期限は {{.DueDate}} です。\n" +
+		"期限までにご返却ください。\n",
+	OverdueSubject: "【ISUCON図書館】返却期限を過ぎています",
+	OverdueBody: "{{.MemberName}} 様\n\n" +
+		"お借りになっている「{{.BookTitle}}」の返却期限 ({{.DueDate}}) を過ぎています。\n" +
+		"お早めにご返却ください。\n",
+	BanWarningSubject: "【ISUCON図書館】ご返却がない場合は利用を停止します",
+	BanWarningBody: "{{.MemberName}} 様\n\n" +
+		"お借りになっている「{{.BookTitle}}」の返却期限 ({{.DueDate}}) を過ぎています。\n" +
+		"{{.BanDate}} までにご返却がない場合、図書館のご利用を停止します。\n",
+}
+
+// 種類ごとの件名・本文のテンプレート
+type reminderTemplates map[string]struct{ subject, body *template.Template }
+
+func parseReminderTemplates(t ReminderTemplates) (reminderTemplates, error) {
+	templates := reminderTemplates{}
+	for kind, src := range map[string][2]string{
+		reminderKindDueSoon:    {t.DueSoonSubject, t.DueSoonBody},
+		reminderKindOverdue:    {t.OverdueSubject, t.OverdueBody},
+		reminderKindBanWarning: {t.BanWarningSubject, t.BanWarningBody},
+	} {
+		subject, err := template.New(kind + "_subject").Option("missingkey=error").Parse(src[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse %s subject template: %w", kind, err)
+		}
+		body, err := template.New(kind + "_body").Option("missingkey=error").Parse(src[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse %s body template: %w", kind, err)
+		}
+		templates[kind] = struct{ subject, body *template.Template }{subject, body}
+	}
+	return templates, nil
+}
+
+// 件名・本文を埋める
+func (t reminderTemplates) render(r *Reminder) error {
+	var buf bytes.Buffer
+	if err := t[r.Kind].subject.Execute(&buf, r); err != nil {
+		return err
+	}
+	// 件名はヘッダに入るので1行にする
+	r.Subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := t[r.Kind].body.Execute(&buf, r); err != nil {
+		return err
+	}
+	r.Body = buf.String()
+	return nil
+}
+
+/* --- Member Email --- */
+
+// 通知用のメールアドレスは member_email に持つ (member には列を足さない)
+// 通知にだけ使うので会員の取得・一覧には出さない
+
+// メールアドレスを検証する (空なら空のまま)
+func normalizeEmail(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "email must be a mail address")
+	}
+	return addr.Address, nil
+}
+
+func setMemberEmail(ctx context.Context, tx *sqlx.Tx, memberID, email string) error {
+	_, err := tx.ExecContext(ctx, "REPLACE INTO `member_email` (`member_id`, `email`) VALUES (?, ?)", memberID, email)
+	return err
+}
+
+/* --- Notifiers --- */
+
+// 通知の送り先
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, r Reminder) error
+}
+
+// 送り先がない会員 (メールアドレス未登録など)
+// 記録だけ残して送ったことにする
+var errNoRecipient = errors.New("member has no recipient address")
+
+func newNotifier(c ReminderConfig) (Notifier, error) {
+	switch c.Notifier {
+	case notifierFile:
+		return newFileNotifier(c.File)
+	case notifierWebhook:
+		return &webhookNotifier{url: c.WebhookURL, client: &http.Client{Timeout: c.Timeout}}, nil
+	case notifierSMTP:
+		return &smtpNotifier{config: c.SMTP, timeout: c.Timeout}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", c.Notifier)
+}
+
+// 通知をJSON Linesで書き出す (手元での確認用)
+type fileNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newFileNotifier(path string) (*fileNotifier, error) {
+	if path == "" || path == "stdout" {
+		return &fileNotifier{w: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileNotifier{w: file}, nil
+}
+
+func (n *fileNotifier) Name() string { return notifierFile }
+
+func (n *fileNotifier) Notify(_ context.Context, r Reminder) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return json.NewEncoder(n.w).Encode(r)
+}
+
+// 通知をJSONでPOSTする
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Name() string { return notifierWebhook }
+
+func (n *webhookNotifier) Notify(ctx context.Context, r Reminder) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return nil
+}
+
+// 会員のメールアドレス (member_email) にメールを送る
+type smtpNotifier struct {
+	config  SMTPConfig
+	timeout time.Duration
+}
+
+func (n *smtpNotifier) Name() string { return notifierSMTP }
+
+func (n *smtpNotifier) Notify(ctx context.Context, r Reminder) error {
+	if r.Email == "" {
+		return errNoRecipient
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", r.Email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", r.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", currentTime().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	body := base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(r.Body, "\n", "\r\n")))
+	for len(body) > 76 {
+		msg.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	msg.WriteString(body + "\r\n")
+
+	// smtp.SendMail はタイムアウトを取らないので、接続とやり取りの期限を自前で付ける
+	addr := net.JoinHostPort(n.config.Host, n.config.Port)
+	dialer := net.Dialer{Timeout: n.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if n.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(n.timeout))
+	}
+	client, err := smtp.NewClient(conn, n.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.config.Host}); err != nil {
+			return err
+		}
+	}
+	if n.config.Username != "" {
+		auth := smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.config.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(r.Email); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/* --- Scheduler --- */
+
+type reminderScheduler struct {
+	notifier  Notifier
+	templates reminderTemplates
+	leadTime  time.Duration
+	batchSize int
+
+	// 確認を同時に走らせない
+	mu sync.Mutex
+}
+
+var reminders *reminderScheduler
+
+func newReminderScheduler(c ReminderConfig) (*reminderScheduler, error) {
+	notifier, err := newNotifier(c)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := parseReminderTemplates(c.Templates)
+	if err != nil {
+		return nil, err
+	}
+	return &reminderScheduler{
+		notifier:  notifier,
+		templates: templates,
+		leadTime:  c.LeadTime,
+		batchSize: c.BatchSize,
+	}, nil
+}
+
+// 定期的に通知を送る
+func (s *reminderScheduler) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// 初期化中はテーブルが作り直されている
+			if initializeRunning() {
+				continue
+			}
+			if _, err := s.Run(ctx); err != nil {
+				appLogger.Error("reminder run failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+type ReminderRunResult struct {
+	Notifier string `json:"notifier"`
+	Sent     int    `json:"sent"`
+	// 送り先がなく記録だけしたもの
+	Skipped int `json:"skipped"`
+	// 送れずに次回に回したもの
+	Failed int `json:"failed"`
+}
+
+// 期限を過ぎた貸出、期限が近い貸出の順に、まだ通知していないものを送る
+func (s *reminderScheduler) Run(ctx context.Context) (ReminderRunResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := ReminderRunResult{Notifier: s.notifier.Name()}
+	now := currentTime()
+	for _, kind := range []string{reminderKindOverdue, reminderKindDueSoon} {
+		limit := s.batchSize - result.Sent - result.Skipped - result.Failed
+		if limit <= 0 {
+			break
+		}
+		pending, err := s.pending(ctx, kind, now, limit)
+		if err != nil {
+			return result, err
+		}
+		for _, r := range pending {
+			if err := s.send(ctx, r, now, &result); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// まだ通知していない貸出
+func (s *reminderScheduler) pending(ctx context.Context, kind string, now time.Time, limit int) ([]Reminder, error) {
+	query := "SELECT l.`id` AS `lending_id`, l.`member_id`, l.`book_id`, l.`due`, " +
+		"m.`name` AS `member_name`, b.`title` AS `book_title`, COALESCE(e.`email`, '') AS `email` " +
+		"FROM `lending` AS l " +
+		"INNER JOIN `member` AS m ON m.`id` = l.`member_id` " +
+		"INNER JOIN `book` AS b ON b.`id` = l.`book_id` " +
+		"LEFT JOIN `member_email` AS e ON e.`member_id` = l.`member_id` " +
+		"LEFT JOIN `reminder` AS r ON r.`lending_id` = l.`id` AND r.`kind` = ? " +
+		"WHERE r.`lending_id` IS NULL "
+	args := []any{kind}
+	if kind == reminderKindOverdue {
+		query += "AND l.`due` <= ? "
+		args = append(args, now)
+	} else {
+		query += "AND l.`due` > ? AND l.`due` <= ? "
+		args = append(args, now, now.Add(s.leadTime))
+	}
+	query += "ORDER BY l.`due` ASC LIMIT ?"
+	args = append(args, limit)
+
+	var pending []Reminder
+	if err := db.SelectContext(ctx, &pending, query, args...); err != nil {
+		return nil, err
+	}
+	for i := range pending {
+		pending[i].Kind = kind
+	}
+	return pending, nil
+}
+
+func (s *reminderScheduler) send(ctx context.Context, r Reminder, now time.Time, result *ReminderRunResult) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO `reminder` (`lending_id`, `kind`, `member_id`, `book_id`, `due`, `notifier`, `skipped`, `sent_at`) VALUES (?, ?, ?, ?, ?, ?, false, ?)",
+		r.LendingID, r.Kind, r.MemberID, r.BookID, r.Due, s.notifier.Name(), now)
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			// 他のインスタンスが先に送った
+			return nil
+		}
+		return err
+	}
+
+	if err := s.templates.render(&r); err != nil {
+		return errors.Join(err, s.release(ctx, r))
+	}
+
+	attrs := []slog.Attr{
+		slog.String("kind", r.Kind),
+		slog.String("lending_id", r.LendingID),
+		slog.String("member_id", r.MemberID),
+		slog.String("notifier", s.notifier.Name()),
+	}
+	err = s.notifier.Notify(ctx, r)
+	switch {
+	case err == nil:
+		result.Sent++
+		remindersSentTotal.WithLabelValues(r.Kind).Inc()
+	case errors.Is(err, errNoRecipient):
+		result.Skipped++
+		_, err = db.ExecContext(ctx, "UPDATE `reminder` SET `skipped` = true WHERE `lending_id` = ? AND `kind` = ?", r.LendingID, r.Kind)
+		return err
+	default:
+		result.Failed++
+		remindersFailedTotal.WithLabelValues(r.Kind).Inc()
+		appLogger.LogAttrs(ctx, slog.LevelWarn, "reminder failed", append(attrs, slog.String("error", err.Error()))...)
+		return s.release(ctx, r)
+	}
+	appLogger.LogAttrs(ctx, slog.LevelInfo, "reminder sent", attrs...)
+	return nil
+}
+
+// 送れなかった通知の記録を消して次回に回す
+// 送信がキャンセルで失敗したときも消せるよう、ctx のキャンセルは引き継がない (消せないと二度と送られない)
+func (s *reminderScheduler) release(ctx context.Context, r Reminder) error {
+	_, err := db.ExecContext(context.WithoutCancel(ctx), "DELETE FROM `reminder` WHERE `lending_id` = ? AND `kind` = ?", r.LendingID, r.Kind)
+	return err
+}
+
+/* --- Admin API --- */
+
+// 期限の通知をすぐに送る
+func runRemindersHandler(c echo.Context) error {
+	result, err := reminders.Run(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+type SentReminder struct {
+	LendingID string    `json:"lending_id" db:"lending_id"`
+	Kind      string    `json:"kind" db:"kind"`
+	MemberID  string    `json:"member_id" db:"member_id"`
+	BookID    string    `json:"book_id" db:"book_id"`
+	Due       time.Time `json:"due" db:"due"`
+	Notifier  string    `json:"notifier" db:"notifier"`
+	Skipped   bool      `json:"skipped" db:"skipped"`
+	SentAt    time.Time `json:"sent_at" db:"sent_at"`
+}
+
+// 会員に送った通知の記録
+func getMemberRemindersHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
+	}
+
+	sent := []SentReminder{}
+	err := readDB(c).SelectContext(c.Request().Context(), &sent,
+		"SELECT * FROM `reminder` WHERE `member_id` = ? ORDER BY `sent_at` DESC", id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, sent)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/opentelemetry-go-extra/otelsql"
+	"github.com/uptrace/opentelemetry-go-extra/otelsqlx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+/*
+---------------------------------------------------------------
+Read Replica Routing
+---------------------------------------------------------------
+*/
+
+// 読み取りを任せる会員を明示するヘッダ (パスやクエリに会員IDがないリクエスト用)
+const memberIDHeader = "X-Member-ID"
+
+// 参照系のクエリをリードレプリカに振り分ける
+// 会員が書き込んだ直後は、その会員に関する読み取りをしばらくプライマリに向ける (read-your-writes)
+type replicaRouter struct {
+	primary  *sqlx.DB
+	replicas []*replica
+	next     atomic.Uint64
+
+	stickyWindow time.Duration
+	// 会員ID -> プライマリを使い続ける期限
+	sticky sync.Map
+}
+
+type replica struct {
+	db      *sqlx.DB
+	healthy atomic.Bool
+}
+
+var router = &replicaRouter{}
+
+// トレース付きでDBに接続し、コネクションプールを設定する
+func openDB(d sqlDialect, dsn string, revision string) (*sqlx.DB, error) {
+	conn, err := otelsqlx.Open(string(d), dsn, otelsql.WithAttributes(semconv.DBSystemKey.String(string(d)+":"+revision)))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	conn.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+	conn.SetConnMaxLifetime(cfg.DB.ConnMaxLifetime)
+	return conn, nil
+}
+
+// レプリカに接続する
+// 時刻の扱いをプライマリと揃えるため、DSNのparseTimeとlocは上書きする
+func openReplicaDB(dsn string, revision string) (*sqlx.DB, error) {
+	replicaCfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	replicaCfg.ParseTime = true
+	replicaCfg.Loc = location
+	return openDB(dialectMySQL, replicaCfg.FormatDSN(), revision)
+}
+
+func newReplicaRouter(primary *sqlx.DB, replicaDBs []*sqlx.DB, stickyWindow time.Duration) *replicaRouter {
+	r := &replicaRouter{
+		primary:      primary,
+		stickyWindow: stickyWindow,
+	}
+	for _, replicaDB := range replicaDBs {
+		rep := &replica{db: replicaDB}
+		rep.healthy.Store(true)
+		r.replicas = append(r.replicas, rep)
+	}
+	return r
+}
+
+// 会員の書き込み後に呼び、その会員の読み取りをしばらくプライマリに向ける
+func (r *replicaRouter) markWrite(memberID string) {
+	if len(r.replicas) == 0 || memberID == "" {
+		return
+	}
+	r.sticky.Store(memberID, time.Now().Add(r.stickyWindow))
+}
+
+// 登録した蔵書の読み取りをしばらくプライマリに向ける
+// 蔵書IDは会員IDと同じ表に、接頭辞を付けて入れる
+const bookStickyPrefix = "book:"
+
+func (r *replicaRouter) markBookWrite(bookIDs ...string) {
+	for _, id := range bookIDs {
+		r.markWrite(bookStickyPrefix + id)
+	}
+}
+
+func (r *replicaRouter) isSticky(memberID string) bool {
+	if memberID == "" {
+		return false
+	}
+	v, ok := r.sticky.Load(memberID)
+	if !ok {
+		return false
+	}
+	if time.Now().Before(v.(time.Time)) {
+		return true
+	}
+	r.sticky.CompareAndDelete(memberID, v)
+	return false
+}
+
+// 期限の切れた会員を消す (書き込んだ会員が溜まり続けないように)
+func (r *replicaRouter) pruneSticky() {
+	now := time.Now()
+	r.sticky.Range(func(key, v any) bool {
+		if !now.Before(v.(time.Time)) {
+			r.sticky.CompareAndDelete(key, v)
+		}
+		return true
+	})
+}
+
+// プライマリで読む (プライマリ側のカウンタと件数を揃えるときなど)
+func (r *replicaRouter) primaryReader() readerDB {
+	return readerDB{router: r}
+}
+
+// 読み取りに使うDB
+// レプリカがない、すべて落ちている、または会員が直前に書き込んでいればプライマリを使う
+func (r *replicaRouter) reader(memberID string) readerDB {
+	if len(r.replicas) == 0 || r.isSticky(memberID) {
+		return readerDB{router: r}
+	}
+
+	start := r.next.Add(1)
+	for i := range r.replicas {
+		rep := r.replicas[(start+uint64(i))%uint64(len(r.replicas))]
+		if rep.healthy.Load() {
+			return readerDB{router: r, replica: rep}
+		}
+	}
+	return readerDB{router: r}
+}
+
+// 読み取り用のDB
+// レプリカへの接続でエラーになったら、そのレプリカを振り分けから外してプライマリでやり直す
+// (外したレプリカはヘルスチェックのpingが通れば戻る)
+type readerDB struct {
+	router *replicaRouter
+	// nilならプライマリ
+	replica *replica
+}
+
+func (r readerDB) db() *sqlx.DB {
+	if r.replica == nil {
+		return r.router.primary
+	}
+	return r.replica.db
+}
+
+// プライマリでやり直すか
+func (r readerDB) fallback(ctx context.Context, err error) bool {
+	if r.replica == nil || !isConnError(err) {
+		return false
+	}
+	if r.replica.healthy.Swap(false) {
+		appLogger.LogAttrs(ctx, slog.LevelWarn, "replica unavailable, falling back to primary", slog.String("error", err.Error()))
+	}
+	return true
+}
+
+func (r readerDB) GetContext(ctx context.Context, dest any, query string, args ...any) error {
+	err := r.db().GetContext(ctx, dest, query, args...)
+	if r.fallback(ctx, err) {
+		err = r.router.primary.GetContext(ctx, dest, query, args...)
+	}
+	return err
+}
+
+func (r readerDB) SelectContext(ctx context.Context, dest any, query string, args ...any) error {
+	err := r.db().SelectContext(ctx, dest, query, args...)
+	if r.fallback(ctx, err) {
+		// 途中まで読んだ行を捨てる (空のスライスはnilにしない)
+		if v := reflect.ValueOf(dest).Elem(); v.Kind() == reflect.Slice {
+			v.SetLen(0)
+		}
+		err = r.router.primary.SelectContext(ctx, dest, query, args...)
+	}
+	return err
+}
+
+// トランザクションは始めるときだけやり直す (始めた後のエラーはそのまま返る)
+func (r readerDB) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error) {
+	tx, err := r.db().BeginTxx(ctx, opts)
+	if r.fallback(ctx, err) {
+		tx, err = r.router.primary.BeginTxx(ctx, opts)
+	}
+	return tx, err
+}
+
+func (r readerDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := r.db().QueryContext(ctx, query, args...)
+	if r.fallback(ctx, err) {
+		rows, err = r.router.primary.QueryContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+func (r readerDB) QueryxContext(ctx context.Context, query string, args ...any) (*sqlx.Rows, error) {
+	rows, err := r.db().QueryxContext(ctx, query, args...)
+	if r.fallback(ctx, err) {
+		rows, err = r.router.primary.QueryxContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+func (r readerDB) QueryRowxContext(ctx context.Context, query string, args ...any) *sqlx.Row {
+	row := r.db().QueryRowxContext(ctx, query, args...)
+	if r.fallback(ctx, row.Err()) {
+		row = r.router.primary.QueryRowxContext(ctx, query, args...)
+	}
+	return row
+}
+
+func (r readerDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	res, err := r.db().ExecContext(ctx, query, args...)
+	if r.fallback(ctx, err) {
+		res, err = r.router.primary.ExecContext(ctx, query, args...)
+	}
+	return res, err
+}
+
+func (r readerDB) DriverName() string {
+	return r.db().DriverName()
+}
+
+func (r readerDB) Rebind(query string) string {
+	return r.db().Rebind(query)
+}
+
+func (r readerDB) BindNamed(query string, arg any) (string, []any, error) {
+	return r.db().BindNamed(query, arg)
+}
+
+// 接続できない・切れたなど、別のDBでやり直せばよいエラー
+func isConnError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
+
+// 定期的にレプリカへpingし、落ちているレプリカを振り分けから外す
+// ついでに期限の切れた会員をプライマリに向ける対象から消す
+func (r *replicaRouter) startHealthCheck(ctx context.Context, interval time.Duration) {
+	if len(r.replicas) == 0 || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			r.pruneSticky()
+			for i, rep := range r.replicas {
+				pingCtx, cancel := context.WithTimeout(ctx, interval)
+				err := rep.db.PingContext(pingCtx)
+				cancel()
+
+				healthy := err == nil
+				if rep.healthy.Swap(healthy) != healthy {
+					attrs := []slog.Attr{slog.Int("replica", i), slog.Bool("healthy", healthy)}
+					if err != nil {
+						attrs = append(attrs, slog.String("error", err.Error()))
+					}
+					appLogger.LogAttrs(ctx, slog.LevelWarn, "replica health changed", attrs...)
+				}
+			}
+		}
+	}()
+}
+
+func (r *replicaRouter) Close() error {
+	for _, rep := range r.replicas {
+		_ = rep.db.Close()
+	}
+	return nil
+}
+
+// リクエストに対応する読み取り用のDB
+func readDB(c echo.Context) readerDB {
+	if requestBookSticky(c) {
+		return router.primaryReader()
+	}
+	return router.reader(requestMemberID(c))
+}
+
+// 蔵書のリクエストをプライマリで読むか
+// 登録した直後の蔵書と、暗号化したID (登録してすぐ印刷したQRコードから読むことが多い) はプライマリで読む
+func requestBookSticky(c echo.Context) bool {
+	if len(router.replicas) == 0 || !strings.HasPrefix(c.Path(), "/api/books/") {
+		return false
+	}
+	id := c.Param("id")
+	if id == "" {
+		return false
+	}
+	return c.QueryParam("encrypted") == "true" || router.isSticky(bookStickyPrefix+id)
+}
+
+// リクエストが対象とする会員ID
+// 暗号化したIDは復号してから使う (書き込んだ会員は平文のIDで覚えている)
+func requestMemberID(c echo.Context) string {
+	if strings.HasPrefix(c.Path(), "/api/members/") {
+		if id := c.Param("id"); id != "" {
+			if c.QueryParam("encrypted") != "true" {
+				return id
+			}
+			if plain, err := decrypt(id); err == nil {
+				return plain
+			}
+			// 復号できなければハンドラが400を返す
+			return ""
+		}
+	}
+	if id := c.QueryParam("member_id"); id != "" {
+		return id
+	}
+	return c.Request().Header.Get(memberIDHeader)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/oklog/ulid/v2"
+)
+
+/*
+---------------------------------------------------------------
+Scan API
+---------------------------------------------------------------
+*/
+
+// 端末で読み取ったQRコードの中身 (暗号化されたID) から会員か蔵書かを判別する
+// 会員と蔵書のIDはどちらもULIDで重ならないので、両方を引いて見つかった方を返す
+
+// 1回に解決できるペイロードの数
+const maxScanPayloads = 100
+
+// 復号できない、または今の鍵で作られていないペイロード
+var (
+	errInvalidPayload = errors.New("invalid payload")
+	errUnknownKey     = errors.New("qr code was made with an unknown key")
+)
+
+// ペイロードを今の鍵で復号してIDを取り出す
+// CTRモードは鍵が違っても復号自体はできてしまうので、IDがULIDになっているかで鍵を確かめる
+func decryptPayload(payload string) (string, error) {
+	// qrencodeには echo で渡しているので、読み取った中身には改行が付いている
+	id, err := decrypt(strings.TrimSpace(payload))
+	if err != nil {
+		return "", errInvalidPayload
+	}
+	if _, err := ulid.ParseStrict(id); err != nil {
+		return "", errUnknownKey
+	}
+	return id, nil
+}
+
+// 解決した種類
+const (
+	scanTypeMember  = "member"
+	scanTypeBook    = "book"
+	scanTypeUnknown = "unknown"
+)
+
+type ScanMember struct {
+	Member
+	// 貸出中の蔵書
+	Lendings []GetLendingsResponse `json:"lendings"`
+}
+
+type ScanResult struct {
+	Payload string           `json:"payload"`
+	Type    string           `json:"type"`
+	Member  *ScanMember      `json:"member,omitempty"`
+	Book    *GetBookResponse `json:"book,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// ペイロードを復号し、会員・蔵書をまとめて引く
+func resolvePayloads(ctx context.Context, db sqlx.ExtContext, payloads []string) ([]ScanResult, error) {
+	results := make([]ScanResult, len(payloads))
+	// 復号できたペイロードのID (できなければ空)
+	decrypted := make([]string, len(payloads))
+	ids := make([]string, 0, len(payloads))
+	for i, payload := range payloads {
+		results[i] = ScanResult{Payload: payload, Type: scanTypeUnknown}
+		id, err := decryptPayload(payload)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		decrypted[i] = id
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	query, args, err := sqlx.In(memberWithReadingQuery+"WHERE m.`id` IN (?) AND m.`banned` = false", ids)
+	if err != nil {
+		return nil, err
+	}
+	var members []Member
+	if err := sqlx.SelectContext(ctx, db, &members, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	memberMap := make(map[string]*ScanMember, len(members))
+	memberIDs := make([]string, 0, len(members))
+	for _, member := range members {
+		memberMap[member.ID] = &ScanMember{Member: member, Lendings: []GetLendingsResponse{}}
+		memberIDs = append(memberIDs, member.ID)
+	}
+
+	if len(memberIDs) > 0 {
+		query, args, err := sqlx.In("SELECT "+
+			"`lending`.`id` as `lending_id`, "+
+			"`lending`.`member_id` as `member_id`, "+
+			"`lending`.`book_id` as `book_id`, "+
+			"`lending`.`due` as `due`, "+
+			"`lending`.`created_at` as `created_at`, "+
+			"`member`.`name` as `member_name`, "+
+			"`book`.`title` as `book_title` "+
+			" FROM `lending` INNER JOIN `member` ON `lending`.`member_id` = `member`.`id` INNER JOIN `book` ON `lending`.`book_id` = `book`.`id` "+
+			" WHERE `lending`.`member_id` IN (?) ORDER BY `lending`.`id` ASC", memberIDs)
+		if err != nil {
+			return nil, err
+		}
+		var lendings []GetLendingsHandlerQuery
+		if err := sqlx.SelectContext(ctx, db, &lendings, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, lending := range lendings {
+			m := memberMap[lending.MemberID]
+			m.Lendings = append(m.Lendings, GetLendingsResponse{
+				Lending: Lending{
+					ID:        lending.ID,
+					MemberID:  lending.MemberID,
+					BookID:    lending.BookID,
+					Due:       lending.Due,
+					CreatedAt: lending.CreatedAt,
+				},
+				MemberName: lending.MemberName,
+				BookTitle:  lending.BookTitle,
+			})
+		}
+	}
+
+	query, args, err = sqlx.In("SELECT * FROM `book` WHERE `id` IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	var books []Book
+	if err := sqlx.SelectContext(ctx, db, &books, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	if err := attachBookReadings(ctx, db, books); err != nil {
+		return nil, err
+	}
+	bookMap := make(map[string]*GetBookResponse, len(books))
+	bookIDs := make([]string, 0, len(books))
+	for _, book := range books {
+		bookMap[book.ID] = &GetBookResponse{Book: book}
+		bookIDs = append(bookIDs, book.ID)
+	}
+
+	if len(bookIDs) > 0 {
+		query, args, err := sqlx.In("SELECT `book_id` FROM `lending` WHERE `book_id` IN (?)", bookIDs)
+		if err != nil {
+			return nil, err
+		}
+		var lendingBookIDs []string
+		if err := sqlx.SelectContext(ctx, db, &lendingBookIDs, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, bookID := range lendingBookIDs {
+			bookMap[bookID].Lending = true
+		}
+	}
+
+	for i := range results {
+		id := decrypted[i]
+		if id == "" {
+			continue
+		}
+		if member, ok := memberMap[id]; ok {
+			results[i].Type = scanTypeMember
+			results[i].Member = member
+		} else if book, ok := bookMap[id]; ok {
+			results[i].Type = scanTypeBook
+			results[i].Book = book
+		} else {
+			results[i].Error = "not found"
+		}
+	}
+	return results, nil
+}
+
+type PostScanRequest struct {
+	// 1件だけ解決する場合
+	Payload string `json:"payload"`
+	// まとめて解決する場合
+	Payloads []string `json:"payloads"`
+}
+
+type PostScanResponse struct {
+	Results []ScanResult `json:"results"`
+}
+
+// QRコードの中身から会員・蔵書を引く
+// payload なら ScanResult を、payloads なら結果の配列を返す
+func postScanHandler(c echo.Context) error {
+	var req PostScanRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if (req.Payload == "") == (len(req.Payloads) == 0) {
+		return echo.NewHTTPError(http.StatusBadRequest, "either payload or payloads is required")
+	}
+	if len(req.Payloads) > maxScanPayloads {
+		return echo.NewHTTPError(http.StatusBadRequest, "too many payloads (max "+strconv.Itoa(maxScanPayloads)+")")
+	}
+
+	if req.Payload != "" {
+		results, err := resolvePayloads(c.Request().Context(), readDB(c), []string{req.Payload})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if err := scanResultError(results[0]); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, results[0])
+	}
+
+	results, err := resolvePayloads(c.Request().Context(), readDB(c), req.Payloads)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, PostScanResponse{Results: results})
+}
+
+func scanResultError(result ScanResult) error {
+	switch result.Error {
+	case "":
+		return nil
+	case "not found":
+		return echo.NewHTTPError(http.StatusNotFound, result.Error)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, result.Error)
+}
+
+type PostScanCheckoutRequest struct {
+	// 会員証のQRコードの中身
+	Member string `json:"member"`
+	// 蔵書のQRコードの中身
+	Books []string `json:"books"`
+}
+
+// セルフ貸出: 会員証と蔵書のQRコードの中身から、そのまま貸し出す
+func postScanCheckoutHandler(c echo.Context) error {
+	var req PostScanCheckoutRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Member == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "member is required")
+	}
+	if len(req.Books) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one books is required")
+	}
+	if len(req.Books)+1 > maxScanPayloads {
+		return echo.NewHTTPError(http.StatusBadRequest, "too many books (max "+strconv.Itoa(maxScanPayloads-1)+")")
+	}
+
+	results, err := resolvePayloads(c.Request().Context(), readDB(c), append([]string{req.Member}, req.Books...))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := scanResultError(results[0]); err != nil {
+		return err
+	}
+	if results[0].Type != scanTypeMember {
+		return echo.NewHTTPError(http.StatusBadRequest, "member payload is not a member card")
+	}
+	memberID := results[0].Member.ID
+
+	bookIDs := make([]string, 0, len(req.Books))
+	for _, result := range results[1:] {
+		if err := scanResultError(result); err != nil {
+			return err
+		}
+		if result.Type != scanTypeBook {
+			return echo.NewHTTPError(http.StatusBadRequest, "books payload is not a book label")
+		}
+		bookIDs = append(bookIDs, result.Book.ID)
+	}
+	addLogAttrs(c, slog.String("member_id", memberID), slog.Any("book_ids", bookIDs))
+
+	res, err := lendBooks(c.Request().Context(), memberID, bookIDs)
+	if err != nil {
+		return txHTTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, res)
+}
+
+/*
+---------------------------------------------------------------
+Scan Image API
+---------------------------------------------------------------
+*/
+
+// カメラしかない端末向けに、撮った画像からQRコードを読み取って解決する
+
+// アップロードできる画像の大きさ
+const maxScanImageSize = 10 << 20
+
+// 画像の画素数の上限 (小さなファイルでも展開すると巨大になる画像を、展開する前に断る)
+// スマートフォンのカメラの画像 (12メガピクセル程度) が収まるようにする
+const maxScanImagePixels = 20_000_000
+
+// multipart のヘッダーなどの分、リクエストの本文には画像より少し多く許す
+const maxScanRequestSize = maxScanImageSize + 1<<20
+
+// 画像からQRコードの中身を読み取る
+func decodeQRImage(img image.Image) (string, error) {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+	// カメラで撮った画像はQRコードが小さかったり傾いていたりするので、時間をかけて探す
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, hints)
+	if err != nil {
+		return "", err
+	}
+	return result.GetText(), nil
+}
+
+// multipart の image にPNGかJPEGの画像を受け取り、写っているQRコードの会員・蔵書を返す
+func postScanImageHandler(c echo.Context) error {
+	// 大きすぎる本文は multipart を読む前に打ち切る
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxScanRequestSize)
+	fileHeader, err := c.FormFile("image")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "image is too large (max "+strconv.Itoa(maxScanImageSize>>20)+"MB)")
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
+	}
+	if fileHeader.Size > maxScanImageSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "image is too large (max "+strconv.Itoa(maxScanImageSize>>20)+"MB)")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer file.Close()
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil || (format != "png" && format != "jpeg") {
+		return echo.NewHTTPError(http.StatusBadRequest, "image must be png or jpeg")
+	}
+	if int64(config.Width)*int64(config.Height) > maxScanImagePixels {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "image has too many pixels (max "+strconv.Itoa(maxScanImagePixels/1_000_000)+" megapixels)")
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "image must be png or jpeg")
+	}
+	payload, err := decodeQRImage(img)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "qr code could not be read from image")
+	}
+
+	results, err := resolvePayloads(c.Request().Context(), readDB(c), []string{payload})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := scanResultError(results[0]); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, results[0])
+}
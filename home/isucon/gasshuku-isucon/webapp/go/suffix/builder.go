@@ -0,0 +1,400 @@
+package suffix
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/errgroup"
+)
+
+// 接尾辞テーブルを蔵書から構築・検証する
+type Builder struct {
+	db *sqlx.DB
+	// 並列にINSERTするコネクション数 (SQLiteでは常に1)
+	Workers int
+	// 進捗の出力先 (nilなら出力しない)
+	Logf func(format string, args ...any)
+}
+
+func NewBuilder(db *sqlx.DB) *Builder {
+	return &Builder{db: db, Workers: 4}
+}
+
+func (b *Builder) sqlite() bool {
+	return b.db.DriverName() == "sqlite"
+}
+
+func (b *Builder) logf(format string, args ...any) {
+	if b.Logf != nil {
+		b.Logf(format, args...)
+	}
+}
+
+// 全蔵書から接尾辞テーブルを作り直す
+// MySQLでは別のテーブルに書き込んでから入れ替えるので、途中で失敗しても元のテーブルはそのまま残る
+// 動いているwebappの横で実行してよい (入れ替えまでに登録された蔵書は入れ替えた後に追加する)
+// SQLiteでは1つのトランザクションで作り直す
+func (b *Builder) Rebuild(ctx context.Context, kinds ...Kind) error {
+	g, ctx := errgroup.WithContext(ctx)
+	if b.sqlite() {
+		g.SetLimit(1)
+	}
+	for _, k := range kinds {
+		k := k
+		g.Go(func() error {
+			if b.sqlite() {
+				return b.rebuildInTx(ctx, k)
+			}
+			return b.rebuildAndSwap(ctx, k)
+		})
+	}
+	return g.Wait()
+}
+
+func (b *Builder) rebuildAndSwap(ctx context.Context, k Kind) error {
+	staging := k.Table() + "_new"
+	old := k.Table() + "_old"
+
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS `" + staging + "`",
+		"DROP TABLE IF EXISTS `" + old + "`",
+		"CREATE TABLE `" + staging + "` LIKE `" + k.Table() + "`",
+	} {
+		if _, err := b.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	batches := make(chan []Row, b.Workers)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(batches)
+		return b.scanBooks(gctx, k, batches)
+	})
+	for i := 0; i < max(b.Workers, 1); i++ {
+		g.Go(func() error {
+			for rows := range batches {
+				if err := insertInto(gctx, b.db, staging, k, rows); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// RENAME TABLEは複数のテーブルをまとめてアトミックに入れ替える
+	_, err := b.db.ExecContext(ctx, "RENAME TABLE `"+k.Table()+"` TO `"+old+"`, `"+staging+"` TO `"+k.Table()+"`")
+	if err != nil {
+		return err
+	}
+	if _, err := b.db.ExecContext(ctx, "DROP TABLE `"+old+"`"); err != nil {
+		return err
+	}
+
+	// 読み込み中に登録された蔵書の接尾辞は入れ替える前のテーブルに入っているので、入れ替えた後に追加する
+	// (蔵書は登録されるだけで更新・削除されないので、接尾辞のない蔵書を足せば揃う)
+	n, err := b.Update(ctx, k)
+	if err != nil {
+		return err
+	}
+	b.logf("%s: added suffixes for %d books registered during the rebuild", k, n)
+	return nil
+}
+
+func (b *Builder) rebuildInTx(ctx context.Context, k Kind) error {
+	tx, err := b.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `"+k.Table()+"`"); err != nil {
+		return err
+	}
+
+	batches := make(chan []Row)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(batches)
+		// 書き込み中のトランザクションと同じコネクションは使えないので、蔵書は別のコネクションで読む
+		return b.scanBooks(gctx, k, batches)
+	})
+	g.Go(func() error {
+		for rows := range batches {
+			if err := Insert(gctx, tx, k, rows); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 接尾辞が1行もない蔵書の分だけ追加する
+// 1冊分の行は必ず同じINSERTに入れるので、途中で止まっても次の実行で残りが追加される
+func (b *Builder) Update(ctx context.Context, kinds ...Kind) (int, error) {
+	var total int
+	for _, k := range kinds {
+		query := "SELECT `id`, `title`, `author` FROM `book` AS b WHERE b.`" + string(k) + "` != '' AND NOT EXISTS (" +
+			"SELECT 1 FROM `" + k.Table() + "` AS s WHERE s.`book_id` = b.`id`) ORDER BY `id`"
+
+		var books []Book
+		if err := b.db.SelectContext(ctx, &books, query); err != nil {
+			return total, err
+		}
+		b.logf("%s: %d books without suffixes", k, len(books))
+
+		rows := make([]Row, 0, BatchSize)
+		for i, book := range books {
+			rows = append(rows, Rows(k, book)...)
+			if len(rows) >= BatchSize || i == len(books)-1 {
+				if err := Insert(ctx, b.db, k, rows); err != nil {
+					return total, err
+				}
+				rows = rows[:0]
+			}
+		}
+		total += len(books)
+	}
+	return total, nil
+}
+
+// 検証で見つかった問題
+type Issue struct {
+	Type   string `json:"type"`
+	BookID string `json:"book_id"`
+	Suffix string `json:"suffix"`
+}
+
+const (
+	// 蔵書にあるのにテーブルにない接尾辞
+	IssueMissing = "missing"
+	// 存在しない蔵書や、今のタイトル・著者にない接尾辞
+	IssueOrphaned = "orphaned"
+	// 同じ接尾辞が複数行ある
+	IssueDuplicate = "duplicate"
+)
+
+type Report struct {
+	Kind       Kind    `json:"kind"`
+	Books      int     `json:"books"`
+	Rows       int     `json:"rows"`
+	Missing    int     `json:"missing"`
+	Orphaned   int     `json:"orphaned"`
+	Duplicates int     `json:"duplicates"`
+	Samples    []Issue `json:"samples"`
+}
+
+func (r *Report) OK() bool {
+	return r.Missing == 0 && r.Orphaned == 0 && r.Duplicates == 0
+}
+
+// レポートに載せる問題の件数
+const maxSamples = 20
+
+func (r *Report) add(typ, bookID, suffix string) {
+	switch typ {
+	case IssueMissing:
+		r.Missing++
+	case IssueOrphaned:
+		r.Orphaned++
+	case IssueDuplicate:
+		r.Duplicates++
+	}
+	if len(r.Samples) < maxSamples {
+		r.Samples = append(r.Samples, Issue{Type: typ, BookID: bookID, Suffix: suffix})
+	}
+}
+
+// 接尾辞テーブルを蔵書と突き合わせる
+// 蔵書と接尾辞をどちらも book_id 順に読んで突き合わせるので、全件をメモリに載せない
+func (b *Builder) Verify(ctx context.Context, k Kind) (*Report, error) {
+	report := &Report{Kind: k}
+
+	books, err := b.db.QueryxContext(ctx, "SELECT `id`, `title`, `author` FROM `book` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+	defer books.Close()
+
+	suffixes, err := b.db.QueryContext(ctx, "SELECT `book_id`, `"+k.Column()+"` FROM `"+k.Table()+"` ORDER BY `book_id`, `"+k.Column()+"`")
+	if err != nil {
+		return nil, err
+	}
+	defer suffixes.Close()
+
+	var (
+		row    Row
+		hasRow bool
+	)
+	nextRow := func() error {
+		hasRow = suffixes.Next()
+		if !hasRow {
+			return suffixes.Err()
+		}
+		report.Rows++
+		return suffixes.Scan(&row.BookID, &row.Suffix)
+	}
+	if err := nextRow(); err != nil {
+		return nil, err
+	}
+
+	for books.Next() {
+		var book Book
+		if err := books.StructScan(&book); err != nil {
+			return nil, err
+		}
+		report.Books++
+
+		// 存在しない蔵書の行
+		for hasRow && row.BookID < book.ID {
+			report.add(IssueOrphaned, row.BookID, row.Suffix)
+			if err := nextRow(); err != nil {
+				return nil, err
+			}
+		}
+
+		var actual []string
+		for hasRow && row.BookID == book.ID {
+			actual = append(actual, row.Suffix)
+			if err := nextRow(); err != nil {
+				return nil, err
+			}
+		}
+
+		expected := Of(book.Key(k))
+		slices.Sort(expected)
+		compare(report, book.ID, expected, actual)
+	}
+	if err := books.Err(); err != nil {
+		return nil, err
+	}
+
+	for hasRow {
+		report.add(IssueOrphaned, row.BookID, row.Suffix)
+		if err := nextRow(); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// ソート済みの期待値と実際の行を突き合わせる
+func compare(report *Report, bookID string, expected, actual []string) {
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case j > 0 && j < len(actual) && actual[j] == actual[j-1]:
+			report.add(IssueDuplicate, bookID, actual[j])
+			j++
+		case j >= len(actual) || (i < len(expected) && expected[i] < actual[j]):
+			report.add(IssueMissing, bookID, expected[i])
+			i++
+		case i >= len(expected) || actual[j] < expected[i]:
+			report.add(IssueOrphaned, bookID, actual[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+}
+
+// 全蔵書の接尾辞をmysqldump形式で書き出す
+func (b *Builder) Dump(ctx context.Context, k Kind, w io.Writer) error {
+	bw := bufio.NewWriterSize(w, 1<<20)
+	fmt.Fprintln(bw, DumpHeader(k))
+	fmt.Fprintf(bw, "LOCK TABLES `%s` WRITE;\n", k.Table())
+
+	batches := make(chan []Row)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(batches)
+		return b.scanBooks(gctx, k, batches)
+	})
+	g.Go(func() error {
+		for rows := range batches {
+			fmt.Fprintf(bw, "INSERT INTO `%s` VALUES ", k.Table())
+			for i, row := range rows {
+				if i > 0 {
+					bw.WriteByte(',')
+				}
+				bw.WriteString("(" + quote(row.BookID) + "," + quote(row.Suffix) + ")")
+			}
+			bw.WriteString(";\n")
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	bw.WriteString("UNLOCK TABLES;\n")
+	return bw.Flush()
+}
+
+// 蔵書を順に読み、1冊の行が分かれないようにBatchSize程度ずつ接尾辞の行を送る
+func (b *Builder) scanBooks(ctx context.Context, k Kind, batches chan<- []Row) error {
+	var total int
+	if err := b.db.GetContext(ctx, &total, "SELECT COUNT(*) FROM `book`"); err != nil {
+		return err
+	}
+
+	books, err := b.db.QueryxContext(ctx, "SELECT `id`, `title`, `author` FROM `book` ORDER BY `id`")
+	if err != nil {
+		return err
+	}
+	defer books.Close()
+
+	rows := make([]Row, 0, BatchSize)
+	send := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		select {
+		case batches <- rows:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		rows = make([]Row, 0, BatchSize)
+		return nil
+	}
+
+	var done, logged int
+	for books.Next() {
+		var book Book
+		if err := books.StructScan(&book); err != nil {
+			return err
+		}
+		rows = append(rows, Rows(k, book)...)
+		if len(rows) >= BatchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+
+		done++
+		if percent := done * 100 / max(total, 1); percent >= logged+10 {
+			logged = percent / 10 * 10
+			b.logf("%s: %d%% (%d/%d)", k, logged, done, total)
+		}
+	}
+	if err := books.Err(); err != nil {
+		return err
+	}
+	return send()
+}
@@ -0,0 +1,156 @@
+package suffix
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// 検索の正規化の設定
+// 接尾辞テーブルを作った時と検索する時で同じ設定にすること (変えたら rebuild が必要)
+type Options struct {
+	// ひらがなとカタカナを区別しない
+	FoldKana bool
+}
+
+var options atomic.Pointer[Options]
+
+func init() {
+	options.Store(&Options{})
+}
+
+// 正規化の設定を変える (起動時に一度だけ呼ぶ)
+func SetOptions(o Options) {
+	options.Store(&o)
+}
+
+// 検索用に文字列を正規化する
+// 全角・半角を揃え (width.Fold)、NFKCで互換文字をまとめ、大文字小文字を区別しないようにする
+// 列に入らない長さになったら MaxLength 文字で切る
+// "ｱﾒﾘｶ" と "アメリカ"、"ﾌﾟｰﾙｻｲﾄﾞ" と "プールサイド"、"tolstoy" と "Tolstoy" が同じになる
+func Normalize(s string) string {
+	s = width.Fold.String(s)
+	s = norm.NFKC.String(s)
+	s = cases.Fold().String(s)
+	// 大文字小文字の変換でNFKCでなくなる文字があるので、もう一度揃える
+	s = norm.NFKC.String(s)
+	if options.Load().FoldKana {
+		s = foldKana(s)
+	}
+	return truncate(s)
+}
+
+// 接尾辞・読み仮名の列の長さ (varchar(255))
+// NFKCで "㌀" が "アパート" になるなど、正規化すると元の文字列より長くなることがある
+const MaxLength = 255
+
+// 列に入るように文字単位で切り詰める
+func truncate(s string) string {
+	n := 0
+	for i := range s {
+		if n == MaxLength {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// カタカナをひらがなにする
+func foldKana(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'ァ' && r <= 'ヶ', r == 'ヽ', r == 'ヾ':
+			return r - ('ァ' - 'ぁ')
+		}
+		return r
+	}, s)
+}
+
+// 正規化の方法を表す文字列
+// ダンプに書いておき、読み込む時に今の設定と同じか確かめる
+func Signature() string {
+	if options.Load().FoldKana {
+		return "width+nfkc+casefold+kana"
+	}
+	return "width+nfkc+casefold"
+}
+
+// 蔵書の検索用の文字列
+func (b Book) Key(k Kind) string {
+	return Normalize(b.Text(k))
+}
+
+// 読み仮名を検索・並び替え用に正規化する
+// 全角・半角やひらがな・カタカナの違いをなくしてひらがなにそろえる (search.fold_kana の設定によらない)
+// ひらがな・長音符・空白以外が含まれていれば false を返す
+func Reading(s string) (string, bool) {
+	s = strings.TrimRight(truncate(strings.Join(strings.Fields(foldKana(norm.NFKC.String(width.Fold.String(s)))), " ")), " ")
+	for _, r := range s {
+		if !(r >= 'ぁ' && r <= 'ゖ') && r != 'ゝ' && r != 'ゞ' && r != 'ー' && r != ' ' {
+			return s, false
+		}
+	}
+	return s, true
+}
+
+// 読み仮名の並び替え用のキー
+// コードポイント順 (utf8mb4_bin) で並べると五十音順になるようにする
+//   - 濁音・半濁音・小書きの仮名は元の仮名として比べ、同じなら読み仮名そのもので比べる (か < が < かあ)
+//   - 長音符は直前の仮名の母音として比べる (らーめん は らあめん と同じ位置)
+//   - 空白は無視する (姓と名の区切りで順番が変わらないように)
+//
+// 後半の比較用に読み仮名を空白で区切って付けるので、読み仮名の倍の長さまでになる
+func ReadingSortKey(reading string) string {
+	reading = strings.ReplaceAll(reading, " ", "")
+	var primary []rune
+	for _, r := range norm.NFD.String(reading) {
+		switch r {
+		case '\u3099', '\u309a':
+			// 濁点・半濁点
+			continue
+		case 'ー':
+			if len(primary) > 0 {
+				if v, ok := kanaVowels[primary[len(primary)-1]]; ok {
+					r = v
+				}
+			}
+		case 'ゝ', 'ゞ':
+			if len(primary) > 0 {
+				r = primary[len(primary)-1]
+			}
+		}
+		if large, ok := smallKana[r]; ok {
+			r = large
+		}
+		primary = append(primary, r)
+	}
+	return string(primary) + " " + reading
+}
+
+// 小書きの仮名と元の仮名
+var smallKana = map[rune]rune{
+	'ぁ': 'あ', 'ぃ': 'い', 'ぅ': 'う', 'ぇ': 'え', 'ぉ': 'お',
+	'っ': 'つ', 'ゃ': 'や', 'ゅ': 'ゆ', 'ょ': 'よ', 'ゎ': 'わ',
+	'ゕ': 'か', 'ゖ': 'け',
+}
+
+// 仮名の母音 (長音符を置き換える)
+var kanaVowels = map[rune]rune{}
+
+func init() {
+	for vowel, row := range map[rune]string{
+		'あ': "あかさたなはまやらわ",
+		'い': "いきしちにひみりゐ",
+		'う': "うくすつぬふむゆる",
+		'え': "えけせてねへめれゑ",
+		'お': "おこそとのほもよろを",
+	} {
+		for _, r := range row {
+			kanaVowels[r] = vowel
+		}
+	}
+}
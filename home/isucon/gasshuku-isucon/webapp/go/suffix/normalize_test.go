@@ -0,0 +1,157 @@
+package suffix
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		foldKana bool
+		want     string
+	}{
+		{name: "empty", in: "", want: ""},
+		{name: "half-width katakana", in: "ｱﾒﾘｶ", want: "アメリカ"},
+		{name: "half-width voiced marks", in: "ﾌﾟｰﾙｻｲﾄﾞ", want: "プールサイド"},
+		{name: "full-width latin", in: "ＴＯＬＳＴＯＹ", want: "tolstoy"},
+		{name: "case folding", in: "Tolstoy", want: "tolstoy"},
+		{name: "compatibility characters", in: "㌀", want: "アパート"},
+		{name: "full-width digits and spaces", in: "１２３　４", want: "123 4"},
+		{name: "kana kept without folding", in: "あアｱ", want: "あアア"},
+		{name: "kana folding", in: "あアｱヴヽ", foldKana: true, want: "あああゔゝ"},
+		{name: "kana folding keeps long vowel", in: "ラーメン", foldKana: true, want: "らーめん"},
+	}
+
+	defer SetOptions(Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetOptions(Options{FoldKana: tt.foldKana})
+			if got := Normalize(tt.in); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTruncates(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{name: "fits", in: strings.Repeat("あ", MaxLength), want: MaxLength},
+		{name: "expanded by nfkc", in: strings.Repeat("㌀", MaxLength), want: MaxLength},
+		{name: "multibyte boundary", in: strings.Repeat("𠮷", MaxLength+1), want: MaxLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Normalize(tt.in)
+			if !utf8.ValidString(got) {
+				t.Fatalf("Normalize returned invalid UTF-8")
+			}
+			if n := utf8.RuneCountInString(got); n != tt.want {
+				t.Errorf("got %d runes, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestReading(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{in: "やまだ", want: "やまだ", ok: true},
+		{in: "ヤマダ", want: "やまだ", ok: true},
+		{in: "ﾔﾏﾀﾞ", want: "やまだ", ok: true},
+		{in: "  やまだ　 たろう ", want: "やまだ たろう", ok: true},
+		{in: "ラーメン", want: "らーめん", ok: true},
+		{in: "ゝゞ", want: "ゝゞ", ok: true},
+		{in: "山田", want: "山田", ok: false},
+		{in: "yamada", want: "yamada", ok: false},
+		{in: "やまだ1", want: "やまだ1", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := Reading(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Reading(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadingIgnoresFoldKanaOption(t *testing.T) {
+	defer SetOptions(Options{})
+	SetOptions(Options{FoldKana: false})
+	if got, _ := Reading("カナ"); got != "かな" {
+		t.Errorf("Reading(%q) = %q, want %q", "カナ", got, "かな")
+	}
+}
+
+func TestReadingSortKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "か", want: "か か"},
+		{in: "が", want: "か が"},
+		{in: "ぱ", want: "は ぱ"},
+		{in: "ぁい", want: "あい ぁい"},
+		{in: "らっぱ", want: "らつは らっぱ"},
+		{in: "らーめん", want: "らあめん らーめん"},
+		{in: "きー", want: "きい きー"},
+		{in: "ー", want: "ー ー"},
+		{in: "んー", want: "んー んー"},
+		{in: "ゔぁ", want: "うあ ゔぁ"},
+		{in: "いすゞ", want: "いすす いすゞ"},
+		{in: "やまだ たろう", want: "やまたたろう やまだたろう"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := ReadingSortKey(tt.in); got != tt.want {
+				t.Errorf("ReadingSortKey(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadingSortKeyOrder(t *testing.T) {
+	// 五十音順
+	want := []string{
+		"ああ",
+		"ぁい",
+		"あい",
+		"か",
+		"が",
+		"かあ",
+		"かー",
+		"かい",
+		"は",
+		"ば",
+		"ぱ",
+		"はい",
+		"やまだ たろう",
+		"やまだたろうまる",
+		"やまだ はなこ",
+		"らあめん",
+		"らーめん",
+		"らいす",
+		"らっぱ",
+		"わ",
+		"ん",
+	}
+
+	got := append([]string{}, want...)
+	sort.Slice(got, func(i, j int) bool {
+		return ReadingSortKey(got[i]) < ReadingSortKey(got[j])
+	})
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
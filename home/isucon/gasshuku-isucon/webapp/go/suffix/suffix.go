@@ -0,0 +1,153 @@
+// Package suffix は蔵書のタイトル・著者の部分一致検索に使う接尾辞テーブルを扱う
+//
+// book_title_suffix / book_author_suffix には文字列のすべての接尾辞を1行ずつ入れておき、
+// `title_suffix LIKE 'キーワード%'` の前方一致で部分一致検索をインデックスで引けるようにしている
+package suffix
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// 接尾辞を作る対象の列
+type Kind string
+
+const (
+	Title  Kind = "title"
+	Author Kind = "author"
+)
+
+var Kinds = []Kind{Title, Author}
+
+func (k Kind) Table() string {
+	return "book_" + string(k) + "_suffix"
+}
+
+func (k Kind) Column() string {
+	return string(k) + "_suffix"
+}
+
+// init_db.sh が読み込むダンプのファイル名
+func (k Kind) DumpFile() string {
+	return "2_" + k.Table() + ".sql"
+}
+
+// ダンプの1行目
+// 今の正規化の設定で作ったダンプかどうかをこれで見分ける
+func DumpHeader(k Kind) string {
+	return dumpHeaderPrefix(k) + Signature() + ")"
+}
+
+// line が DumpHeader で書いた行か (正規化の設定は問わない)
+func IsDumpHeader(k Kind, line string) bool {
+	return strings.HasPrefix(line, dumpHeaderPrefix(k))
+}
+
+func dumpHeaderPrefix(k Kind) string {
+	return "-- " + k.Table() + " generated from `book` (normalization: "
+}
+
+// 接尾辞の元になる蔵書
+type Book struct {
+	ID     string `db:"id"`
+	Title  string `db:"title"`
+	Author string `db:"author"`
+}
+
+func (b Book) Text(k Kind) string {
+	if k == Author {
+		return b.Author
+	}
+	return b.Title
+}
+
+// 接尾辞テーブルの1行
+type Row struct {
+	BookID string
+	Suffix string
+}
+
+// 文字列のすべての接尾辞 (長い順)
+// 文字単位で切るので、マルチバイト文字の途中で切れることはない
+func Of(s string) []string {
+	suffixes := make([]string, 0, len(s))
+	for i := range s {
+		suffixes = append(suffixes, s[i:])
+	}
+	return suffixes
+}
+
+// 蔵書の接尾辞テーブルの行 (正規化した文字列の接尾辞)
+func Rows(k Kind, books ...Book) []Row {
+	var rows []Row
+	for _, book := range books {
+		for _, s := range Of(book.Key(k)) {
+			rows = append(rows, Row{BookID: book.ID, Suffix: s})
+		}
+	}
+	return rows
+}
+
+// 1文でINSERTする行数
+// SQLiteのプレースホルダ数の上限 (32766) に収まるようにしている
+const BatchSize = 10000
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// 複数行のINSERTでまとめて書き込む
+func Insert(ctx context.Context, db execer, k Kind, rows []Row) error {
+	return insertInto(ctx, db, k.Table(), k, rows)
+}
+
+func insertInto(ctx context.Context, db execer, table string, k Kind, rows []Row) error {
+	for len(rows) > 0 {
+		n := min(len(rows), BatchSize)
+
+		var query strings.Builder
+		query.Grow(64 + n*8)
+		query.WriteString("INSERT INTO `" + table + "` (`book_id`, `" + k.Column() + "`) VALUES ")
+		args := make([]any, 0, n*2)
+		for i, row := range rows[:n] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(?, ?)")
+			args = append(args, row.BookID, row.Suffix)
+		}
+		if _, err := db.ExecContext(ctx, query.String(), args...); err != nil {
+			return err
+		}
+
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// mysqldumpと同じ規則で文字列リテラルにする
+func quote(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0x1a:
+			b.WriteString(`\Z`)
+		case '\'', '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package suffix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "", want: []string{}},
+		{in: "a", want: []string{"a"}},
+		{in: "abc", want: []string{"abc", "bc", "c"}},
+		{in: "吾輩は猫", want: []string{"吾輩は猫", "輩は猫", "は猫", "猫"}},
+		{in: "aあ𠮷", want: []string{"aあ𠮷", "あ𠮷", "𠮷"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := Of(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Of(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRows(t *testing.T) {
+	books := []Book{
+		{ID: "B1", Title: "ﾈｺ", Author: "Soseki"},
+		{ID: "B2", Title: "", Author: "Ab"},
+	}
+	tests := []struct {
+		kind Kind
+		want []Row
+	}{
+		{kind: Title, want: []Row{{"B1", "ネコ"}, {"B1", "コ"}}},
+		{kind: Author, want: []Row{
+			{"B1", "soseki"}, {"B1", "oseki"}, {"B1", "seki"}, {"B1", "eki"}, {"B1", "ki"}, {"B1", "i"},
+			{"B2", "ab"}, {"B2", "b"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.kind), func(t *testing.T) {
+			if got := Rows(tt.kind, books...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rows(%s) = %v, want %v", tt.kind, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDumpHeader(t *testing.T) {
+	defer SetOptions(Options{})
+
+	SetOptions(Options{})
+	plain := DumpHeader(Title)
+	SetOptions(Options{FoldKana: true})
+	folded := DumpHeader(Title)
+
+	tests := []struct {
+		name string
+		kind Kind
+		line string
+		want bool
+	}{
+		{name: "current", kind: Title, line: folded, want: true},
+		{name: "other normalization", kind: Title, line: plain, want: true},
+		{name: "other kind", kind: Author, line: plain, want: false},
+		{name: "mysqldump", kind: Title, line: "-- MySQL dump 10.13  Distrib 8.0.34", want: false},
+		{name: "empty", kind: Title, line: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsDumpHeader(tt.kind, tt.line); got != tt.want {
+				t.Errorf("IsDumpHeader(%s, %q) = %v, want %v", tt.kind, tt.line, got, tt.want)
+			}
+		})
+	}
+	if plain == folded {
+		t.Errorf("DumpHeader does not depend on the normalization: %q", plain)
+	}
+}
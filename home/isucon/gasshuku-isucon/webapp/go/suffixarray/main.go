@@ -2,107 +2,149 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 
+	"github.com/dbgofy/gasshuku-isucon-20230909/home/isucon/gasshuku-isucon/webapp/go/dbsource"
+	"github.com/dbgofy/gasshuku-isucon-20230909/home/isucon/gasshuku-isucon/webapp/go/suffix"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/sync/errgroup"
+	_ "modernc.org/sqlite"
 )
 
-type suffix struct {
-	ID    string `db:"id"`
-	Value string `db:"value"`
-}
+const usage = `usage: suffixarray [flags] <mode>
+
+modes:
+  rebuild  rebuild the suffix tables from every book (swapped in atomically)
+  update   add suffixes for books that have none
+  verify   report missing, orphaned and duplicate suffix rows (exit 1 if any)
+  dump     write the 2_book_*_suffix.sql files loaded by init_db.sh
+
+flags:
+`
 
 func main() {
-	host := getEnvOrDefault("DB_HOST", "localhost")
-	port := getEnvOrDefault("DB_PORT", "3306")
-	user := getEnvOrDefault("DB_USER", "isucon")
-	pass := getEnvOrDefault("DB_PASS", "isucon")
-	name := getEnvOrDefault("DB_NAME", "isulibrary")
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=Asia%%2FTokyo", user, pass, host, port, name)
-
-	db, err := sqlx.Open("mysql", dsn)
+	foldKanaDefault, _ := strconv.ParseBool(os.Getenv("SEARCH_FOLD_KANA"))
+	var (
+		kindFlag = flag.String("kind", "all", "suffix table to process (title, author, all)")
+		dir      = flag.String("dir", "../sql", "output directory for dump")
+		workers  = flag.Int("workers", 4, "parallel insert connections for rebuild")
+		dbURL    = flag.String("db-url", os.Getenv("DATABASE_URL"), "database URL (sqlite:<path> or mysql://<dsn>); defaults to MySQL from DB_* env")
+		foldKana = flag.Bool("fold-kana", foldKanaDefault, "treat hiragana and katakana as equal (must match the webapp's search.fold_kana)")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	suffix.SetOptions(suffix.Options{FoldKana: *foldKana})
+
+	kinds := suffix.Kinds
+	if *kindFlag != "all" {
+		kind := suffix.Kind(*kindFlag)
+		if kind != suffix.Title && kind != suffix.Author {
+			log.Fatalf("unknown kind %q", *kindFlag)
+		}
+		kinds = []suffix.Kind{kind}
+	}
+
+	db, err := open(*dbURL)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln("open database", err)
 	}
 	defer db.Close()
 
 	ctx := context.Background()
+	builder := suffix.NewBuilder(db)
+	builder.Workers = *workers
+	builder.Logf = log.Printf
 
-	var books []struct {
-		ID     string `db:"id"`
-		Title  string `db:"title"`
-		Author string `db:"author"`
-	}
-	if err := db.SelectContext(ctx, &books, "SELECT id, title, author FROM `book`"); err != nil {
-		log.Fatalln("select books", err)
-	}
+	switch mode := flag.Arg(0); mode {
+	case "rebuild":
+		if err := builder.Rebuild(ctx, kinds...); err != nil {
+			log.Fatalln("rebuild", err)
+		}
 
-	size := 20000
-	titles := make([]suffix, 0, size)
-	authors := make([]suffix, 0, size)
-
-	g, ctx := errgroup.WithContext(ctx)
-
-	g.Go(func() error {
-		for j, book := range books {
-			title := []rune(book.Title)
-			for i := 0; i < len(title); i++ {
-				titles = append(titles, suffix{book.ID, string(title[i:])})
-				if len(titles)%size == 0 {
-					if err := insert(ctx, db, "title", titles); err != nil {
-						return err
-					}
-					titles = make([]suffix, 0, size)
-				}
+	case "update":
+		n, err := builder.Update(ctx, kinds...)
+		if err != nil {
+			log.Fatalln("update", err)
+		}
+		log.Printf("added suffixes for %d books", n)
+
+	case "verify":
+		ok := true
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		for _, kind := range kinds {
+			report, err := builder.Verify(ctx, kind)
+			if err != nil {
+				log.Fatalln("verify", err)
 			}
-			if j%(len(books)/100) == 0 {
-				log.Printf("title %d%% (%d/%d)\n", j*100/len(books), j, len(books))
+			if err := enc.Encode(report); err != nil {
+				log.Fatalln(err)
 			}
+			ok = ok && report.OK()
 		}
-		return insert(ctx, db, "title", titles)
-	})
-
-	g.Go(func() error {
-		for j, book := range books {
-			author := []rune(book.Author)
-			for i := 0; i < len(author); i++ {
-				authors = append(authors, suffix{book.ID, string(author[i:])})
-				if len(authors)%size == 0 {
-					if err := insert(ctx, db, "author", authors); err != nil {
-						return err
-					}
-					authors = make([]suffix, 0, size)
-				}
-			}
-			if j%(len(books)/100) == 0 {
-				log.Printf("author %d%% (%d/%d)\n", j*100/len(books), j, len(books))
+		if !ok {
+			os.Exit(1)
+		}
+
+	case "dump":
+		for _, kind := range kinds {
+			if err := dump(ctx, builder, kind, filepath.Join(*dir, kind.DumpFile())); err != nil {
+				log.Fatalln("dump", err)
 			}
 		}
-		return insert(ctx, db, "author", authors)
-	})
 
-	if err := g.Wait(); err != nil {
-		log.Fatalln(err)
+	default:
+		log.Fatalf("unknown mode %q", mode)
 	}
 }
 
-func insert(ctx context.Context, db *sqlx.DB, column string, values []suffix) error {
-	_, err := db.NamedExecContext(ctx, "INSERT INTO `book_"+column+"_suffix` (`book_id`, `"+column+"_suffix`) VALUES (:id , :value)", values)
+// 書き終わるまでは一時ファイルに書き、init_db.shが途中までのダンプを読まないようにする
+func dump(ctx context.Context, builder *suffix.Builder, kind suffix.Kind, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
 	if err != nil {
-		return fmt.Errorf("insert %s: %w", column, err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := builder.Dump(ctx, kind, tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
 	}
+	log.Printf("wrote %s", path)
 	return nil
 }
 
-func getEnvOrDefault(key string, defaultValue string) string {
-	val := os.Getenv(key)
-	if val != "" {
-		return val
+// webapp と同じURL・環境変数 (DATABASE_URL, DB_HOST など) で接続する
+func open(url string) (*sqlx.DB, error) {
+	src := dbsource.FromEnv()
+	src.URL = url
+	timezone := os.Getenv("APP_TIMEZONE")
+	if timezone == "" {
+		timezone = "Asia/Tokyo"
 	}
-
-	return defaultValue
+	dsn, err := src.DataSource(timezone)
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.Open(src.Driver(), dsn)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/uptrace/uptrace-go/uptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+/*
+---------------------------------------------------------------
+Tracing
+---------------------------------------------------------------
+*/
+
+// トレースのエクスポート先
+const (
+	tracingExporterUptrace  = "uptrace"
+	tracingExporterOTLPGRPC = "otlp-grpc"
+	tracingExporterOTLPHTTP = "otlp-http"
+	tracingExporterFile     = "file"
+	tracingExporterOff      = "off"
+)
+
+var tracingExporters = []string{
+	tracingExporterUptrace,
+	tracingExporterOTLPGRPC,
+	tracingExporterOTLPHTTP,
+	tracingExporterFile,
+	tracingExporterOff,
+}
+
+// 設定に従ってOpenTelemetryのTracerProviderを構築し、グローバルに登録する
+// otelsql/otelechoはグローバルのTracerProviderを使うので、どのエクスポータでも計装はそのまま動く
+// 戻り値の関数でバッファされたスパンをフラッシュして終了する
+func setupTracing(ctx context.Context, c TracingConfig, serviceName string) (func(context.Context) error, error) {
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))
+
+	switch c.Exporter {
+	case tracingExporterOff:
+		return func(context.Context) error { return nil }, nil
+
+	case tracingExporterUptrace:
+		opts := []uptrace.Option{
+			uptrace.WithServiceName(serviceName),
+			uptrace.WithTraceSampler(sampler),
+		}
+		if c.UptraceDSN != "" {
+			opts = append(opts, uptrace.WithDSN(c.UptraceDSN))
+		}
+		uptrace.ConfigureOpentelemetry(opts...)
+		return uptrace.Shutdown, nil
+	}
+
+	exporter, closeExporter, err := newSpanExporter(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewSchemaless(semconv.ServiceName(serviceName))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := closeExporter(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+func newSpanExporter(ctx context.Context, c TracingConfig) (sdktrace.SpanExporter, func() error, error) {
+	noop := func() error { return nil }
+
+	switch c.Exporter {
+	case tracingExporterOTLPGRPC:
+		opts := []otlptracegrpc.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err := otlptrace.New(ctx, otlptracegrpc.NewClient(opts...))
+		return exporter, noop, err
+
+	case tracingExporterOTLPHTTP:
+		opts := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptrace.New(ctx, otlptracehttp.NewClient(opts...))
+		return exporter, noop, err
+
+	case tracingExporterFile:
+		// 1スパン1行のJSONで追記する
+		file, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			_ = file.Close()
+			return nil, nil, err
+		}
+		return exporter, file.Close, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown tracing exporter %q", c.Exporter)
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+/*
+---------------------------------------------------------------
+Webhooks
+---------------------------------------------------------------
+*/
+
+// イベントは変更と同じトランザクションで webhook_outbox に購読先ごとに積み、
+// ディスパッチャが定期的に取り出して署名付きでPOSTする
+// 失敗したら指数的に間隔を空けて再送し、試行はすべて webhook_delivery に残す
+
+// 送信待ちの状態
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+)
+
+// 署名などのリクエストヘッダ
+// 署名は "t=<UNIX秒>,v1=<HMAC-SHA256(secret, "<UNIX秒>.<本文>") の16進>"
+const (
+	webhookEventHeader     = "X-Isulibrary-Event"
+	webhookEventIDHeader   = "X-Isulibrary-Event-Id"
+	webhookDeliveryHeader  = "X-Isulibrary-Delivery"
+	webhookSignatureHeader = "X-Isulibrary-Signature"
+)
+
+// webhook_delivery.error に残すエラーの長さ
+const maxDeliveryErrorLength = 1024
+
+var webhookDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "webhook_deliveries_total",
+	Help:      "Number of webhook delivery attempts by result (delivered, retry, failed).",
+}, []string{"result"})
+
+// カンマ区切りで保存するイベントの種類のリスト
+type eventTypeList []string
+
+func (l eventTypeList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *eventTypeList) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into event types", src)
+	}
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+type Webhook struct {
+	ID     string        `json:"id" db:"id"`
+	URL    string        `json:"url" db:"url"`
+	Events eventTypeList `json:"events" db:"events"`
+	// 作成時にだけ返す
+	Secret    string    `json:"secret,omitempty" db:"secret"`
+	Active    bool      `json:"active" db:"active"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type webhookOutbox struct {
+	ID            string       `db:"id"`
+	WebhookID     string       `db:"webhook_id"`
+	EventID       string       `db:"event_id"`
+	EventType     string       `db:"event_type"`
+	Payload       string       `db:"payload"`
+	Status        string       `db:"status"`
+	Attempts      int          `db:"attempts"`
+	NextAttemptAt time.Time    `db:"next_attempt_at"`
+	CreatedAt     time.Time    `db:"created_at"`
+	DeliveredAt   sql.NullTime `db:"delivered_at"`
+}
+
+// 送信の試行1回分
+type WebhookDelivery struct {
+	ID         string    `json:"id" db:"id"`
+	WebhookID  string    `json:"webhook_id" db:"webhook_id"`
+	OutboxID   string    `json:"outbox_id" db:"outbox_id"`
+	EventID    string    `json:"event_id" db:"event_id"`
+	EventType  string    `json:"event_type" db:"event_type"`
+	Attempt    int       `json:"attempt" db:"attempt"`
+	StatusCode int       `json:"status_code" db:"status_code"`
+	Error      string    `json:"error,omitempty" db:"error"`
+	DurationMs int64     `json:"duration_ms" db:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+/* --- Subscriptions --- */
+
+// 有効なwebhookの購読 (書き込みのたびに webhook を読まないよう、メモリに持つ)
+// このインスタンスでの登録・編集・削除と初期化で捨て、次に使うときに読み直す
+// 他のインスタンスでの変更はディスパッチャの間隔ごとに読み直して反映する
+var (
+	webhookSubscriptions   atomic.Pointer[[]Webhook]
+	webhookSubscriptionsMu sync.Mutex
+)
+
+// 書き込みのトランザクションの中で読み直すときは、別の接続を待たないよう tx で読む
+func activeWebhookSubscriptions(ctx context.Context, q sqlx.QueryerContext) ([]Webhook, error) {
+	if hooks := webhookSubscriptions.Load(); hooks != nil {
+		return *hooks, nil
+	}
+	return reloadWebhookSubscriptions(ctx, q)
+}
+
+func reloadWebhookSubscriptions(ctx context.Context, q sqlx.QueryerContext) ([]Webhook, error) {
+	// 古い一覧を読んだ後に捨てられた一覧を上書きしないよう、読み直しと破棄を順に行う
+	webhookSubscriptionsMu.Lock()
+	defer webhookSubscriptionsMu.Unlock()
+
+	hooks := []Webhook{}
+	if err := sqlx.SelectContext(ctx, q, &hooks, "SELECT `id`, `events` FROM `webhook` WHERE `active` = true"); err != nil {
+		return nil, err
+	}
+	webhookSubscriptions.Store(&hooks)
+	return hooks, nil
+}
+
+func invalidateWebhookSubscriptions() {
+	webhookSubscriptionsMu.Lock()
+	defer webhookSubscriptionsMu.Unlock()
+	webhookSubscriptions.Store(nil)
+}
+
+// イベントを購読しているwebhookごとに送信待ちを積む
+func enqueueWebhookDeliveries(ctx context.Context, tx *sqlx.Tx, events []Event) error {
+	hooks, err := activeWebhookSubscriptions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	now := currentTime()
+	var rows []webhookOutbox
+	for _, event := range events {
+		var payload []byte
+		for _, hook := range hooks {
+			if !slices.Contains(hook.Events, event.Type) {
+				continue
+			}
+			if payload == nil {
+				var err error
+				if payload, err = json.Marshal(event); err != nil {
+					return err
+				}
+			}
+			rows = append(rows, webhookOutbox{
+				ID:            generateID(),
+				WebhookID:     hook.ID,
+				EventID:       event.ID,
+				EventType:     event.Type,
+				Payload:       string(payload),
+				Status:        outboxPending,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err = tx.NamedExecContext(ctx,
+		"INSERT INTO `webhook_outbox` (`id`, `webhook_id`, `event_id`, `event_type`, `payload`, `status`, `attempts`, `next_attempt_at`, `created_at`) "+
+			"VALUES (:id, :webhook_id, :event_id, :event_type, :payload, :status, :attempts, :next_attempt_at, :created_at)", rows)
+	return err
+}
+
+/* --- Dispatcher --- */
+
+type webhookDispatcher struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+func newWebhookDispatcher(c WebhookConfig) *webhookDispatcher {
+	return &webhookDispatcher{
+		config: c,
+		client: &http.Client{Timeout: c.Timeout},
+	}
+}
+
+// 定期的に送信待ちを送る
+func (d *webhookDispatcher) Start(ctx context.Context) {
+	if d.config.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(d.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// 初期化中はテーブルが作り直されている
+			if initializeRunning() {
+				continue
+			}
+			if _, err := reloadWebhookSubscriptions(ctx, db); err != nil {
+				appLogger.Error("webhook subscriptions reload failed", slog.String("error", err.Error()))
+			}
+			if err := d.dispatch(ctx); err != nil {
+				appLogger.Error("webhook dispatch failed", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// 送信待ちと送り先
+type webhookTask struct {
+	webhookOutbox
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// 送る時期が来た送信待ちを1バッチ分送る
+func (d *webhookDispatcher) dispatch(ctx context.Context) error {
+	now := currentTime()
+	var tasks []webhookTask
+	err := db.SelectContext(ctx, &tasks,
+		"SELECT o.*, w.`url`, w.`secret` FROM `webhook_outbox` AS o INNER JOIN `webhook` AS w ON w.`id` = o.`webhook_id` "+
+			"WHERE o.`status` = ? AND o.`next_attempt_at` <= ? AND w.`active` = true ORDER BY o.`next_attempt_at` ASC LIMIT ?",
+		outboxPending, now, d.config.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	// 1件の記録に失敗しても他の送信は続ける
+	var g errgroup.Group
+	g.SetLimit(d.config.Concurrency)
+	for _, task := range tasks {
+		task := task
+		g.Go(func() error {
+			claimed, err := d.claim(ctx, task)
+			if err != nil || !claimed {
+				return err
+			}
+			return d.deliver(ctx, task)
+		})
+	}
+	return g.Wait()
+}
+
+// 他のインスタンスと同じ送信待ちを送らないよう、送っている間は次の送信時刻を先に延ばしておく
+// 空きを待ってから送る直前に取るので、期限は取った時刻から数える
+func (d *webhookDispatcher) claim(ctx context.Context, task webhookTask) (bool, error) {
+	now := currentTime()
+	res, err := db.ExecContext(ctx,
+		"UPDATE `webhook_outbox` SET `next_attempt_at` = ? WHERE `id` = ? AND `status` = ? AND `attempts` = ? AND `next_attempt_at` <= ?",
+		now.Add(2*d.config.Timeout), task.ID, outboxPending, task.Attempts, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// 1件送って結果を記録する
+func (d *webhookDispatcher) deliver(ctx context.Context, task webhookTask) error {
+	delivery := WebhookDelivery{
+		ID:        generateID(),
+		WebhookID: task.WebhookID,
+		OutboxID:  task.ID,
+		EventID:   task.EventID,
+		EventType: task.EventType,
+		Attempt:   task.Attempts + 1,
+	}
+	start := time.Now()
+	statusCode, err := d.post(ctx, task)
+	delivery.StatusCode = statusCode
+	delivery.DurationMs = time.Since(start).Milliseconds()
+	delivery.CreatedAt = currentTime()
+	if err != nil {
+		delivery.Error = strings.ToValidUTF8(truncate(err.Error(), maxDeliveryErrorLength), "")
+	}
+
+	outbox := task.webhookOutbox
+	outbox.Attempts = delivery.Attempt
+	switch {
+	case err == nil:
+		outbox.Status = outboxDelivered
+		outbox.DeliveredAt = sql.NullTime{Time: delivery.CreatedAt, Valid: true}
+		webhookDeliveriesTotal.WithLabelValues(outboxDelivered).Inc()
+	case outbox.Attempts >= d.config.MaxAttempts:
+		outbox.Status = outboxFailed
+		webhookDeliveriesTotal.WithLabelValues(outboxFailed).Inc()
+		appLogger.LogAttrs(ctx, slog.LevelWarn, "webhook delivery gave up",
+			slog.String("webhook_id", task.WebhookID),
+			slog.String("event_id", task.EventID),
+			slog.Int("attempts", outbox.Attempts),
+			slog.String("error", delivery.Error))
+	default:
+		outbox.NextAttemptAt = delivery.CreatedAt.Add(d.backoff(outbox.Attempts))
+		webhookDeliveriesTotal.WithLabelValues("retry").Inc()
+	}
+
+	return runInTx(ctx, nil, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx,
+			"INSERT INTO `webhook_delivery` (`id`, `webhook_id`, `outbox_id`, `event_id`, `event_type`, `attempt`, `status_code`, `error`, `duration_ms`, `created_at`) "+
+				"VALUES (:id, :webhook_id, :outbox_id, :event_id, :event_type, :attempt, :status_code, :error, :duration_ms, :created_at)", delivery)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx,
+			"UPDATE `webhook_outbox` SET `status` = :status, `attempts` = :attempts, `next_attempt_at` = :next_attempt_at, `delivered_at` = :delivered_at WHERE `id` = :id", outbox)
+		return err
+	})
+}
+
+// 署名を付けてPOSTする
+// 2xx以外の応答も失敗として扱い、ステータスコードを返す
+func (d *webhookDispatcher) post(ctx context.Context, task webhookTask) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, task.URL, strings.NewReader(task.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(webhookEventHeader, task.EventType)
+	req.Header.Set(webhookEventIDHeader, task.EventID)
+	req.Header.Set(webhookDeliveryHeader, task.ID)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(task.Secret, time.Now(), []byte(task.Payload)))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func signWebhookPayload(secret string, at time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// attempts 回失敗した後に待つ時間 (backoff_base * 2^(attempts-1)、backoff_max まで)
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.config.BackoffBase
+	for i := 1; i < attempts && wait < d.config.BackoffMax; i++ {
+		wait *= 2
+	}
+	return min(wait, d.config.BackoffMax)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+/* --- Webhooks API --- */
+
+type PostWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// 空なら生成する
+	Secret string `json:"secret"`
+}
+
+func validateWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+func validateEventTypes(events []string) (eventTypeList, error) {
+	if len(events) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "at least one events is required")
+	}
+	list := eventTypeList{}
+	for _, event := range events {
+		if !slices.Contains(eventTypes, event) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "unknown event: "+event+" (one of "+strings.Join(eventTypes, ", ")+")")
+		}
+		if !slices.Contains(list, event) {
+			list = append(list, event)
+		}
+	}
+	return list, nil
+}
+
+// webhookを登録
+// 署名の秘密鍵はこのレスポンスでしか返さない
+func postWebhookHandler(c echo.Context) error {
+	var req PostWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		return err
+	}
+	events, err := validateEventTypes(req.Events)
+	if err != nil {
+		return err
+	}
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		secret = hex.EncodeToString(b)
+	} else if len(secret) < 16 || len(secret) > 64 {
+		return echo.NewHTTPError(http.StatusBadRequest, "secret must be 16 to 64 characters")
+	}
+
+	hook := Webhook{
+		ID:        generateID(),
+		URL:       req.URL,
+		Events:    events,
+		Secret:    secret,
+		Active:    true,
+		CreatedAt: currentTime(),
+	}
+	_, err = db.NamedExecContext(c.Request().Context(),
+		"INSERT INTO `webhook` (`id`, `url`, `secret`, `events`, `active`, `created_at`) VALUES (:id, :url, :secret, :events, :active, :created_at)", hook)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	invalidateWebhookSubscriptions()
+	addLogAttrs(c, slog.String("webhook_id", hook.ID))
+
+	return c.JSON(http.StatusCreated, hook)
+}
+
+// webhookの一覧
+func getWebhooksHandler(c echo.Context) error {
+	hooks := []Webhook{}
+	err := db.SelectContext(c.Request().Context(), &hooks, "SELECT `id`, `url`, `events`, `active`, `created_at` FROM `webhook` ORDER BY `id` ASC")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, hooks)
+}
+
+func getWebhook(ctx context.Context, db sqlx.QueryerContext, id string) (Webhook, error) {
+	var hook Webhook
+	err := sqlx.GetContext(ctx, db, &hook, "SELECT `id`, `url`, `events`, `active`, `created_at` FROM `webhook` WHERE `id` = ?", id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return hook, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return hook, err
+	}
+	return hook, nil
+}
+
+// webhookを取得
+func getWebhookHandler(c echo.Context) error {
+	hook, err := getWebhook(c.Request().Context(), db, c.Param("id"))
+	if err != nil {
+		return txHTTPError(err)
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+type PatchWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// webhookを編集
+// active=false の間は送信待ちを積まず、積まれている分も送らない
+func patchWebhookHandler(c echo.Context) error {
+	id := c.Param("id")
+
+	var req PatchWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.URL == "" && req.Events == nil && req.Active == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "url, events or active is required")
+	}
+
+	query := "UPDATE `webhook` SET "
+	params := []any{}
+	if req.URL != "" {
+		if err := validateWebhookURL(req.URL); err != nil {
+			return err
+		}
+		query += "`url` = ?, "
+		params = append(params, req.URL)
+	}
+	if req.Events != nil {
+		events, err := validateEventTypes(req.Events)
+		if err != nil {
+			return err
+		}
+		query += "`events` = ?, "
+		params = append(params, events)
+	}
+	if req.Active != nil {
+		query += "`active` = ?, "
+		params = append(params, *req.Active)
+	}
+	query = strings.TrimSuffix(query, ", ") + " WHERE `id` = ?"
+	params = append(params, id)
+
+	err := runInTx(c.Request().Context(), nil, func(tx *sqlx.Tx) error {
+		if _, err := getWebhook(c.Request().Context(), tx, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(c.Request().Context(), query, params...)
+		return err
+	})
+	if err != nil {
+		return txHTTPError(err)
+	}
+	invalidateWebhookSubscriptions()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// webhookを削除 (送信待ちと送信記録も消す)
+func deleteWebhookHandler(c echo.Context) error {
+	id := c.Param("id")
+
+	err := runInTx(c.Request().Context(), nil, func(tx *sqlx.Tx) error {
+		if _, err := getWebhook(c.Request().Context(), tx, id); err != nil {
+			return err
+		}
+		for _, query := range []string{
+			"DELETE FROM `webhook_delivery` WHERE `webhook_id` = ?",
+			"DELETE FROM `webhook_outbox` WHERE `webhook_id` = ?",
+			"DELETE FROM `webhook` WHERE `id` = ?",
+		} {
+			if _, err := tx.ExecContext(c.Request().Context(), query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return txHTTPError(err)
+	}
+	invalidateWebhookSubscriptions()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 送信記録の件数の既定値と上限
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+// webhookの送信記録 (新しい順)
+func getWebhookDeliveriesHandler(c echo.Context) error {
+	id := c.Param("id")
+	limit := defaultDeliveryLimit
+	if s := c.QueryParam("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxDeliveryLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxDeliveryLimit))
+		}
+	}
+
+	if _, err := getWebhook(c.Request().Context(), db, id); err != nil {
+		return txHTTPError(err)
+	}
+	deliveries := []WebhookDelivery{}
+	err := db.SelectContext(c.Request().Context(), &deliveries,
+		"SELECT * FROM `webhook_delivery` WHERE `webhook_id` = ? ORDER BY `created_at` DESC, `id` DESC LIMIT ?", id, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
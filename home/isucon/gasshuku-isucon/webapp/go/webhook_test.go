@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	d := newWebhookDispatcher(WebhookConfig{BackoffBase: time.Second, BackoffMax: time.Minute})
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: time.Second},
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 3, want: 4 * time.Second},
+		{attempts: 6, want: 32 * time.Second},
+		{attempts: 7, want: time.Minute},
+		{attempts: 100, want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	d = newWebhookDispatcher(WebhookConfig{BackoffBase: time.Minute, BackoffMax: time.Minute})
+	if got := d.backoff(5); got != time.Minute {
+		t.Errorf("backoff(5) with base = max is %v, want %v", got, time.Minute)
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	at := time.Unix(1694217600, 0)
+	tests := []struct {
+		name    string
+		secret  string
+		at      time.Time
+		payload string
+		want    string
+	}{
+		{
+			name:    "payload",
+			secret:  "s3cret",
+			at:      at,
+			payload: `{"id":"E1"}`,
+			want:    "t=1694217600,v1=62719ee9566dd66686f97642de01712dd1de514777ada2255ba399de688c6fc5",
+		},
+		{
+			name:    "empty payload",
+			secret:  "s3cret",
+			at:      at,
+			payload: "",
+			want:    "t=1694217600,v1=08d3de779f8fd81f0ed0b9e456635afac079a07832ef3ab04fbf17ffc7dde7dc",
+		},
+		{
+			name:    "timestamp is in unix seconds regardless of the zone",
+			secret:  "s3cret",
+			at:      at.In(time.FixedZone("JST", 9*60*60)).Add(999 * time.Millisecond),
+			payload: `{"id":"E1"}`,
+			want:    "t=1694217600,v1=62719ee9566dd66686f97642de01712dd1de514777ada2255ba399de688c6fc5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhookPayload(tt.secret, tt.at, []byte(tt.payload)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	base := signWebhookPayload("s3cret", at, []byte(`{"id":"E1"}`))
+	for name, sig := range map[string]string{
+		"secret":  signWebhookPayload("s3cret2", at, []byte(`{"id":"E1"}`)),
+		"time":    signWebhookPayload("s3cret", at.Add(time.Second), []byte(`{"id":"E1"}`)),
+		"payload": signWebhookPayload("s3cret", at, []byte(`{"id":"E2"}`)),
+	} {
+		if sig == base {
+			t.Errorf("signature does not depend on the %s", name)
+		}
+	}
+}
@@ -1,3 +1,7 @@
+-- init_db.sh (init.loader: script) 用。go/migrations/mysql の最新のスキーマと揃えること
+-- 初期データを読み込むテーブルの一部のインデックスは、読み込んだ後に 4_index.sql で作る
+-- マイグレーションを足したら末尾の schema_migrations にも足すこと
+
 DROP TABLE IF EXISTS `book`;
 
 CREATE TABLE `book` (
@@ -26,7 +30,8 @@ CREATE TABLE `lending` (
   `book_id` varchar(255) NOT NULL,
   `due` datetime(6) NOT NULL,
   `created_at` datetime(6) NOT NULL,
-  PRIMARY KEY (`id`)
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `UQ_book_id` (`book_id`)
 ) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
 
 DROP TABLE IF EXISTS `member`;
@@ -56,3 +61,180 @@ CREATE TABLE `book_author_suffix` (
    `book_id` varchar(26) NOT NULL,
    `author_suffix` varchar(255) NOT NULL
 ) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `stats`;
+
+CREATE TABLE `stats` (
+  `name` varchar(64) NOT NULL,
+  `value` bigint NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `member_reading`;
+
+CREATE TABLE `member_reading` (
+  `member_id` varchar(26) NOT NULL,
+  `reading` varchar(255) NOT NULL,
+  `sort_key` varchar(511) NOT NULL DEFAULT '',
+  PRIMARY KEY (`member_id`),
+  INDEX `IX_member_reading` (`reading`, `member_id`),
+  INDEX `IX_member_reading_sort_key` (`sort_key`, `member_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `book_reading`;
+
+CREATE TABLE `book_reading` (
+  `book_id` varchar(26) NOT NULL,
+  `title_reading` varchar(255) NOT NULL,
+  `author_reading` varchar(255) NOT NULL,
+  PRIMARY KEY (`book_id`),
+  INDEX `IX_book_title_reading` (`title_reading`),
+  INDEX `IX_book_author_reading` (`author_reading`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `lending_history`;
+
+CREATE TABLE `lending_history` (
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`member_id`, `book_id`),
+  INDEX `IX_lending_history_member_created_at` (`member_id`, `created_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `book_co_borrow`;
+
+CREATE TABLE `book_co_borrow` (
+  `book_id` varchar(26) NOT NULL,
+  `other_book_id` varchar(26) NOT NULL,
+  `count` bigint NOT NULL,
+  PRIMARY KEY (`book_id`, `other_book_id`),
+  INDEX `IX_book_co_borrow_count` (`book_id`, `count`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `book_popularity`;
+
+CREATE TABLE `book_popularity` (
+  `book_id` varchar(26) NOT NULL,
+  `genre` int NOT NULL,
+  `borrowed` bigint NOT NULL,
+  PRIMARY KEY (`book_id`),
+  INDEX `IX_book_popularity_genre_borrowed` (`genre`, `borrowed`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `member_email`;
+
+CREATE TABLE `member_email` (
+  `member_id` varchar(26) NOT NULL,
+  `email` varchar(255) NOT NULL,
+  PRIMARY KEY (`member_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `reminder`;
+
+CREATE TABLE `reminder` (
+  `lending_id` varchar(26) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `due` datetime(6) NOT NULL,
+  `notifier` varchar(16) NOT NULL,
+  `skipped` tinyint(1) NOT NULL DEFAULT 0,
+  `sent_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`lending_id`, `kind`),
+  INDEX `IX_reminder_member_sent_at` (`member_id`, `sent_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `webhook`;
+
+CREATE TABLE `webhook` (
+  `id` varchar(26) NOT NULL,
+  `url` varchar(2048) NOT NULL,
+  `secret` varchar(64) NOT NULL,
+  `events` varchar(255) NOT NULL,
+  `active` tinyint(1) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `webhook_outbox`;
+
+CREATE TABLE `webhook_outbox` (
+  `id` varchar(26) NOT NULL,
+  `webhook_id` varchar(26) NOT NULL,
+  `event_id` varchar(26) NOT NULL,
+  `event_type` varchar(32) NOT NULL,
+  `payload` mediumtext NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` int NOT NULL,
+  `next_attempt_at` datetime(6) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  `delivered_at` datetime(6) NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_webhook_outbox_status_next_attempt_at` (`status`, `next_attempt_at`),
+  INDEX `IX_webhook_outbox_webhook_id` (`webhook_id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `webhook_delivery`;
+
+CREATE TABLE `webhook_delivery` (
+  `id` varchar(26) NOT NULL,
+  `webhook_id` varchar(26) NOT NULL,
+  `outbox_id` varchar(26) NOT NULL,
+  `event_id` varchar(26) NOT NULL,
+  `event_type` varchar(32) NOT NULL,
+  `attempt` int NOT NULL,
+  `status_code` int NOT NULL,
+  `error` varchar(1024) NOT NULL,
+  `duration_ms` bigint NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_webhook_delivery_webhook_id_created_at` (`webhook_id`, `created_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `member_sanction`;
+
+CREATE TABLE `member_sanction` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `action` varchar(16) NOT NULL,
+  `source` varchar(16) NOT NULL,
+  `reason` varchar(1024) NOT NULL,
+  `lending_id` varchar(26) NOT NULL,
+  `expires_at` datetime(6) NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `IX_member_sanction_member_id_created_at` (`member_id`, `created_at`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `co_borrow_queue`;
+
+CREATE TABLE `co_borrow_queue` (
+  `id` varchar(26) NOT NULL,
+  `member_id` varchar(26) NOT NULL,
+  `book_id` varchar(26) NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS `schema_migrations`;
+
+CREATE TABLE `schema_migrations` (
+  `version` bigint NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `applied_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`version`)
+) ENGINE = InnoDB COLLATE = utf8mb4_bin DEFAULT CHARSET = utf8mb4;
+
+INSERT INTO `schema_migrations` (`version`, `name`, `applied_at`) VALUES
+  (1, 'initial', NOW(6)),
+  (2, 'stats', NOW(6)),
+  (3, 'search_indexes', NOW(6)),
+  (4, 'suffix_book_id_indexes', NOW(6)),
+  (5, 'readings', NOW(6)),
+  (6, 'recommendations', NOW(6)),
+  (7, 'reminders', NOW(6)),
+  (8, 'webhooks', NOW(6)),
+  (9, 'ban_policy', NOW(6)),
+  (10, 'co_borrow_queue', NOW(6)),
+  (11, 'reading_sort_keys', NOW(6));
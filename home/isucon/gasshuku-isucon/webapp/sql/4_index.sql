@@ -0,0 +1,14 @@
+-- 0_schema.sql で初期データの読み込み後に回したインデックス
+-- go/loader.go の deferredIndexes と揃えること
+
+ALTER TABLE `lending`
+  ADD INDEX `IX_lending_member_id` (`member_id`),
+  ADD INDEX `IX_lending_due` (`due`);
+
+ALTER TABLE `book_title_suffix`
+  ADD INDEX `IX_book_title_suffix` (`title_suffix`),
+  ADD INDEX `IX_book_title_suffix_book_id` (`book_id`);
+
+ALTER TABLE `book_author_suffix`
+  ADD INDEX `IX_book_author_suffix` (`author_suffix`),
+  ADD INDEX `IX_book_author_suffix_book_id` (`book_id`);